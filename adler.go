@@ -0,0 +1,71 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+// rsync's Adler-style weak checksum.  For data b_1 ... b_n,
+//
+//	a = \sum_i b_i                mod 2^16
+//	b = \sum_i (n - i + 1) b_i    mod 2^16
+//
+// and the checksum is a + 2^16 b.  Only 32 bits are significant.
+type adler struct {
+	a, b       uint32
+	windowSize int
+}
+
+// Returns an rsync-style rolling checksum over windows of windowSize bytes.
+func NewAdler(windowSize int) RollingHash {
+	return &adler{windowSize: windowSize}
+}
+
+func (d *adler) BlockSize() int {
+	return 1
+}
+
+func (d *adler) Reset() {
+	d.a = 0
+	d.b = 0
+}
+
+func (d *adler) Roll(oldData, newData []byte) (int, error) {
+	if len(oldData) != len(newData) {
+		return 0, ErrWindowMismatch
+	}
+
+	a, b := d.a, d.b
+	m := uint32(d.windowSize)
+	for ii, x := range newData {
+		old := uint32(oldData[ii])
+		a = a - old + uint32(x)
+		b = b - m*old + a
+	}
+	d.a, d.b = a&0xffff, b&0xffff
+
+	return len(newData), nil
+}
+
+func (d *adler) Size() int {
+	return 4
+}
+
+func (d *adler) Sum(b []byte) []byte {
+	s := d.Sum64()
+	return append(b, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+func (d *adler) Sum64() uint64 {
+	return uint64(d.b)<<16 | uint64(d.a)
+}
+
+func (d *adler) Write(p []byte) (n int, err error) {
+	a, b := d.a, d.b
+	for _, x := range p {
+		a += uint32(x)
+		b += a
+	}
+	d.a, d.b = a&0xffff, b&0xffff
+
+	return len(p), nil
+}
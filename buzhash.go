@@ -0,0 +1,87 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"math/bits"
+)
+
+// Byte substitution table for buzhash.
+var kBuzhashTable *[256]uint64
+
+func init() {
+	kBuzhashTable = makeRandomTable(0x62757a68617368)
+}
+
+// Buzhash (cyclic polynomial) rolling hash.  For data b_1 ... b_n, the hash
+// is
+//
+//	rot^{n-1}(T[b_1]) ^ rot^{n-2}(T[b_2]) ^ ... ^ T[b_n]
+//
+// where rot is a 1-bit left rotation and T is a fixed substitution table.
+type buzhash struct {
+	h          uint64
+	windowSize int
+}
+
+// Returns a buzhash RollingHash over windows of windowSize bytes.
+func NewBuzhash(windowSize int) RollingHash {
+	return &buzhash{windowSize: windowSize}
+}
+
+func (d *buzhash) BlockSize() int {
+	return 1
+}
+
+func (d *buzhash) Reset() {
+	d.h = 0
+}
+
+// Each byte is shifted windowSize positions by the time it leaves the
+// window, so it is removed by xoring T[b] rotated by windowSize.
+func (d *buzhash) Roll(oldData, newData []byte) (int, error) {
+	if len(oldData) != len(newData) {
+		return 0, ErrWindowMismatch
+	}
+
+	h := d.h
+	shift := d.windowSize & 63
+	for ii, b := range newData {
+		h = bits.RotateLeft64(h, 1) ^
+			bits.RotateLeft64(kBuzhashTable[oldData[ii]], shift) ^
+			kBuzhashTable[b]
+	}
+	d.h = h
+
+	return len(newData), nil
+}
+
+func (d *buzhash) Size() int {
+	return kNumBytes
+}
+
+func (d *buzhash) Sum(b []byte) []byte {
+	return appendUint64(b, d.h)
+}
+
+func (d *buzhash) Sum64() uint64 {
+	return d.h
+}
+
+func (d *buzhash) Write(p []byte) (n int, err error) {
+	h := d.h
+	for _, b := range p {
+		h = bits.RotateLeft64(h, 1) ^ kBuzhashTable[b]
+	}
+	d.h = h
+
+	return len(p), nil
+}
+
+// Appends v to b in big-endian order.
+func appendUint64(b []byte, v uint64) []byte {
+	return append(b, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,258 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Returned (wrapped) when chunker parameters are inconsistent.
+var ErrChunkerParams = errors.New("rabin: invalid chunker parameters")
+
+// A content-defined chunk of a stream.
+type Chunk struct {
+	// Position of the first byte of the chunk in the stream.
+	Offset int64
+	Length int
+
+	// The fingerprint at the cut.  For Rabin chunking, this is the
+	// fingerprint of the window that precedes the cut, or of the whole
+	// chunk if it is shorter than the window.
+	Fingerprint uint64
+
+	// The chunk contents.  Chunkers reuse their buffers, so Data is only
+	// valid until the next chunk is requested.
+	Data []byte
+}
+
+// A Splitter decides where content-defined chunks end.  Splitters are not
+// safe for concurrent use.
+type Splitter interface {
+	// Returns the length n of the first chunk in data, which begins at a
+	// chunk boundary, and the fingerprint at the cut.
+	//
+	// data holds MaxSize() bytes, or fewer only if the stream ends first.
+	// n is in [1, len(data)].  The result must depend only on data so that
+	// boundaries are content-defined.
+	Split(data []byte) (n int, fingerprint uint64)
+
+	// Returns the maximum chunk length.
+	MaxSize() int
+}
+
+// Parameters for LBFS-style chunking.  A cut occurs after the first
+// window whose fingerprint f satisfies
+//
+//	f & Mask() == Target & Mask()
+//
+// provided that the chunk holds at least MinSize bytes.  Chunks are cut
+// unconditionally at MaxSize.
+type ChunkerParams struct {
+	MinSize int
+	// The expected number of bytes between candidate cuts past MinSize.
+	// This must be a power of two.
+	AvgSize int
+	MaxSize int
+
+	// The rolling window in bytes.  This must not exceed MinSize.
+	WindowSize int
+
+	// The polynomial for fingerprinting.  If nil, the fixed polynomial is
+	// used (see NewRolling).
+	Polynomial *Polynomial
+
+	Target uint64
+}
+
+// Returns the LBFS parameters: 2KB minimum, 8KB average and 64KB maximum
+// chunks with a 48 byte window.
+func DefaultChunkerParams() ChunkerParams {
+	return ChunkerParams{
+		MinSize:    2 * 1024,
+		AvgSize:    8 * 1024,
+		MaxSize:    64 * 1024,
+		WindowSize: 48,
+		// An all-zero window fingerprints to 0, so avoid cutting runs
+		// of zeros at every MinSize.
+		Target: ^uint64(0),
+	}
+}
+
+func (p ChunkerParams) Mask() uint64 {
+	return uint64(p.AvgSize - 1)
+}
+
+func (p ChunkerParams) validate() error {
+	if p.WindowSize <= 0 {
+		return fmt.Errorf("%w: WindowSize %d", ErrChunkerParams, p.WindowSize)
+	}
+	if p.MinSize < p.WindowSize {
+		return fmt.Errorf("%w: MinSize %d < WindowSize %d",
+			ErrChunkerParams, p.MinSize, p.WindowSize)
+	}
+	if p.MaxSize < p.MinSize {
+		return fmt.Errorf("%w: MaxSize %d < MinSize %d",
+			ErrChunkerParams, p.MaxSize, p.MinSize)
+	}
+	if p.AvgSize <= 0 || !IsPowerOfTwo(p.AvgSize) {
+		return fmt.Errorf("%w: AvgSize %d is not a power of two",
+			ErrChunkerParams, p.AvgSize)
+	}
+	return nil
+}
+
+// Splits at Rabin fingerprint matches.  See ChunkerParams.
+type rabinSplitter struct {
+	params ChunkerParams
+	mask   uint64
+	target uint64
+	hash   *digest
+}
+
+// Returns a Splitter that cuts according to params.
+func NewRabinSplitter(params ChunkerParams) (Splitter, error) {
+	return newRabinSplitter(params)
+}
+
+func newRabinSplitter(params ChunkerParams) (*rabinSplitter, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	hash, err := newRollingDigest(params.Polynomial, params.WindowSize)
+	if err != nil {
+		return nil, err
+	}
+	mask := params.Mask()
+	return &rabinSplitter{
+		params: params,
+		mask:   mask,
+		target: params.Target & mask,
+		hash:   hash,
+	}, nil
+}
+
+func (s *rabinSplitter) MaxSize() int {
+	return s.params.MaxSize
+}
+
+func (s *rabinSplitter) Split(data []byte) (int, uint64) {
+	windowSize := s.params.WindowSize
+	minSize := s.params.MinSize
+	if len(data) <= minSize {
+		return len(data), s.fingerprint(data)
+	}
+
+	// Since the window lies entirely within the chunk, there is no need to
+	// hash anything before MinSize - WindowSize.
+	hash := s.hash
+	hash.Reset()
+	hash.Write(data[minSize-windowSize : minSize])
+	fp := hash.Sum64()
+	if fp&s.mask == s.target {
+		return minSize, fp
+	}
+
+	for ii := minSize; ii < len(data); ii++ {
+		fp = hash.rollByte(data[ii-windowSize], data[ii])
+		if fp&s.mask == s.target {
+			return ii + 1, fp
+		}
+	}
+	return len(data), fp
+}
+
+// Returns the fingerprint of the window at the end of chunk.
+func (s *rabinSplitter) fingerprint(chunk []byte) uint64 {
+	if len(chunk) > s.params.WindowSize {
+		chunk = chunk[len(chunk)-s.params.WindowSize:]
+	}
+	s.hash.Reset()
+	s.hash.Write(chunk)
+	return s.hash.Sum64()
+}
+
+// Chunker splits an io.Reader into content-defined chunks.  At most twice
+// the maximum chunk size is buffered, and the buffer is reused between
+// chunks.
+type Chunker struct {
+	r        io.Reader
+	splitter Splitter
+
+	// buff[start:end] holds data that has not been returned.
+	buff  []byte
+	start int
+	end   int
+
+	// Stream offset of buff[start].
+	offset int64
+
+	// The first read error, which is sticky.
+	err error
+}
+
+// Returns a Chunker that cuts r according to params.
+func NewChunker(r io.Reader, params ChunkerParams) (*Chunker, error) {
+	splitter, err := NewRabinSplitter(params)
+	if err != nil {
+		return nil, err
+	}
+	return NewChunkerWithSplitter(r, splitter), nil
+}
+
+// Returns a Chunker that cuts r wherever splitter decides.
+func NewChunkerWithSplitter(r io.Reader, splitter Splitter) *Chunker {
+	return &Chunker{
+		r:        r,
+		splitter: splitter,
+		buff:     make([]byte, 2*splitter.MaxSize()),
+	}
+}
+
+// Returns the next chunk, or io.EOF once the stream is exhausted.  The
+// returned Data is only valid until the next call to Next.
+//
+// Any other read error is returned once all chunks that do not depend on
+// the missing data have been returned.
+func (c *Chunker) Next() (Chunk, error) {
+	maxSize := c.splitter.MaxSize()
+	if c.end-c.start < maxSize && c.err == nil {
+		c.fill(maxSize)
+	}
+
+	avail := c.end - c.start
+	if avail == 0 || (avail < maxSize && c.err != io.EOF) {
+		return Chunk{}, c.err
+	}
+	if avail > maxSize {
+		avail = maxSize
+	}
+
+	data := c.buff[c.start : c.start+avail]
+	n, fp := c.splitter.Split(data)
+	chunk := Chunk{
+		Offset:      c.offset,
+		Length:      n,
+		Fingerprint: fp,
+		Data:        data[:n],
+	}
+	c.start += n
+	c.offset += int64(n)
+	return chunk, nil
+}
+
+// Reads until at least maxSize bytes are buffered or an error occurs.
+func (c *Chunker) fill(maxSize int) {
+	// Shift unreturned data to the front of the buffer.
+	c.end = copy(c.buff, c.buff[c.start:c.end])
+	c.start = 0
+
+	for c.end < maxSize && c.err == nil {
+		var n int
+		n, c.err = c.r.Read(c.buff[c.end:])
+		c.end += n
+	}
+}
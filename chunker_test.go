@@ -0,0 +1,252 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func makeRandomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// Returns all chunks from c, copying their data.
+func readAllChunks(t *testing.T, c *Chunker) []Chunk {
+	chunks := []Chunk{}
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk.Data = append([]byte{}, chunk.Data...)
+		chunks = append(chunks, chunk)
+	}
+}
+
+// Fingerprints data with New64.
+func fingerprint64(data []byte) uint64 {
+	hash := New64()
+	hash.Write(data)
+	return hash.Sum64()
+}
+
+func chunkAll(t *testing.T, r io.Reader, params ChunkerParams) []Chunk {
+	c, err := NewChunker(r, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readAllChunks(t, c)
+}
+
+// Checks that chunks tile data and respect the size limits.
+func checkChunks(t *testing.T, data []byte, chunks []Chunk, minSize, maxSize int) {
+	offset := int64(0)
+	for ii, chunk := range chunks {
+		if chunk.Offset != offset {
+			t.Fatal(fmt.Sprintf("chunk %d: offset %d != %d", ii, chunk.Offset, offset))
+		}
+		if chunk.Length != len(chunk.Data) {
+			t.Fatal(fmt.Sprintf("chunk %d: length %d != %d", ii, chunk.Length, len(chunk.Data)))
+		}
+		if !bytes.Equal(chunk.Data, data[offset:offset+int64(chunk.Length)]) {
+			t.Fatal(fmt.Sprintf("chunk %d: data mismatch", ii))
+		}
+		if chunk.Length > maxSize {
+			t.Error(fmt.Sprintf("chunk %d: length %d > max", ii, chunk.Length))
+		}
+		if chunk.Length < minSize && ii != len(chunks)-1 {
+			t.Error(fmt.Sprintf("chunk %d: length %d < min", ii, chunk.Length))
+		}
+		offset += int64(chunk.Length)
+	}
+	if offset != int64(len(data)) {
+		t.Error(fmt.Sprintf("chunks cover %d bytes, expected %d", offset, len(data)))
+	}
+}
+
+func Test_Chunker(t *testing.T) {
+	params := DefaultChunkerParams()
+	data := makeRandomData(0, 1<<20)
+	chunks := chunkAll(t, bytes.NewReader(data), params)
+	checkChunks(t, data, chunks, params.MinSize, params.MaxSize)
+
+	mask := params.Mask()
+	for ii, chunk := range chunks {
+		window := chunk.Data[chunk.Length-params.WindowSize:]
+		fp := RabinFingerprintFixed(window)
+		if fp != chunk.Fingerprint {
+			t.Error(fmt.Sprintf("chunk %d: fingerprint 0x%x != 0x%x", ii, chunk.Fingerprint, fp))
+		}
+		if ii != len(chunks)-1 && chunk.Length != params.MaxSize && fp&mask != mask {
+			t.Error(fmt.Sprintf("chunk %d: cut without a match", ii))
+		}
+	}
+
+	// The average should be near MinSize + AvgSize.
+	avg := len(data) / len(chunks)
+	if avg < params.MinSize+params.AvgSize/2 || avg > params.MinSize+2*params.AvgSize {
+		t.Error(fmt.Sprintf("unexpected average chunk size %d", avg))
+	}
+}
+
+// Boundaries must not depend on how the reader splits the stream.
+func Test_ChunkerReaders(t *testing.T) {
+	params := DefaultChunkerParams()
+	data := makeRandomData(1, 300*1024)
+	cmp := chunkAll(t, bytes.NewReader(data), params)
+
+	for name, r := range map[string]io.Reader{
+		"OneByte": iotest.OneByteReader(bytes.NewReader(data)),
+		"Half":    iotest.HalfReader(bytes.NewReader(data)),
+		"DataErr": iotest.DataErrReader(bytes.NewReader(data)),
+	} {
+		chunks := chunkAll(t, r, params)
+		if len(chunks) != len(cmp) {
+			t.Fatal(fmt.Sprintf("%s: %d chunks != %d", name, len(chunks), len(cmp)))
+		}
+		for ii := range chunks {
+			if chunks[ii].Offset != cmp[ii].Offset || chunks[ii].Fingerprint != cmp[ii].Fingerprint {
+				t.Error(fmt.Sprintf("%s: chunk %d differs", name, ii))
+			}
+		}
+	}
+}
+
+// Inserting bytes early in the stream must not shift later boundaries.
+func Test_ChunkerInsertion(t *testing.T) {
+	params := DefaultChunkerParams()
+	data := makeRandomData(2, 1<<20)
+	edited := append(append(append([]byte{}, data[:1000]...), "inserted bytes"...), data[1000:]...)
+
+	before := chunkAll(t, bytes.NewReader(data), params)
+	after := chunkAll(t, bytes.NewReader(edited), params)
+
+	seen := map[uint64]bool{}
+	for _, chunk := range before {
+		seen[fingerprint64(chunk.Data)] = true
+	}
+	changed := 0
+	for _, chunk := range after {
+		if !seen[fingerprint64(chunk.Data)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Error(fmt.Sprintf("%d of %d chunks changed after insertion", changed, len(after)))
+	}
+}
+
+func Test_ChunkerPolynomial(t *testing.T) {
+	params := DefaultChunkerParams()
+	params.Polynomial = FindIrreducible(64)
+	data := makeRandomData(3, 256*1024)
+	chunks := chunkAll(t, bytes.NewReader(data), params)
+	checkChunks(t, data, chunks, params.MinSize, params.MaxSize)
+
+	for ii, chunk := range chunks {
+		window := chunk.Data[chunk.Length-params.WindowSize:]
+		_, fp := RabinFingerprint(params.Polynomial, window).Uint64()
+		if fp != chunk.Fingerprint {
+			t.Error(fmt.Sprintf("chunk %d: fingerprint 0x%x != 0x%x", ii, chunk.Fingerprint, fp))
+		}
+	}
+}
+
+func Test_ChunkerSmall(t *testing.T) {
+	params := DefaultChunkerParams()
+	for _, size := range []int{0, 1, params.WindowSize, params.MinSize, params.MinSize + 1} {
+		data := makeRandomData(4, size)
+		chunks := chunkAll(t, bytes.NewReader(data), params)
+		checkChunks(t, data, chunks, params.MinSize, params.MaxSize)
+		if size > 0 && len(chunks) != 1 {
+			t.Error(fmt.Sprintf("size %d: %d chunks", size, len(chunks)))
+		}
+	}
+
+	// Runs of zeros are cut at MaxSize.
+	data := make([]byte, 4*params.MaxSize)
+	chunks := chunkAll(t, bytes.NewReader(data), params)
+	checkChunks(t, data, chunks, params.MinSize, params.MaxSize)
+	if len(chunks) != 4 {
+		t.Error(fmt.Sprintf("%d chunks of zeros, expected 4", len(chunks)))
+	}
+}
+
+func Test_ChunkerError(t *testing.T) {
+	errRead := errors.New("read failed")
+	params := DefaultChunkerParams()
+	data := makeRandomData(5, 200*1024)
+	r := io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errRead))
+
+	c, err := NewChunker(r, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for {
+		chunk, err := c.Next()
+		if err == errRead {
+			break
+		}
+		if err != nil {
+			t.Fatal(fmt.Sprintf("expected read error, got %v", err))
+		}
+		total += chunk.Length
+	}
+	// Only chunks that are fully determined are returned.
+	if total > len(data) || total < len(data)-params.MaxSize {
+		t.Error(fmt.Sprintf("returned %d of %d bytes before error", total, len(data)))
+	}
+	if _, err := c.Next(); err != errRead {
+		t.Error("error is not sticky")
+	}
+}
+
+func Test_ChunkerParams(t *testing.T) {
+	bad := []func(p *ChunkerParams){
+		func(p *ChunkerParams) { p.WindowSize = 0 },
+		func(p *ChunkerParams) { p.MinSize = p.WindowSize - 1 },
+		func(p *ChunkerParams) { p.MaxSize = p.MinSize - 1 },
+		func(p *ChunkerParams) { p.AvgSize = 3000 },
+	}
+	for ii, fn := range bad {
+		params := DefaultChunkerParams()
+		fn(&params)
+		if _, err := NewChunker(bytes.NewReader(nil), params); !errors.Is(err, ErrChunkerParams) {
+			t.Error(fmt.Sprintf("case %d: expected ErrChunkerParams, got %v", ii, err))
+		}
+	}
+
+	params := DefaultChunkerParams()
+	params.Polynomial = FindIrreducible(32)
+	if _, err := NewChunker(bytes.NewReader(nil), params); err != ErrPolynomialDegree {
+		t.Error(fmt.Sprintf("expected ErrPolynomialDegree, got %v", err))
+	}
+}
+
+func Benchmark_Chunker(b *testing.B) {
+	params := DefaultChunkerParams()
+	data := makeRandomData(0, 16<<20)
+	b.SetBytes(int64(len(data)))
+	for ii := 0; ii < b.N; ii++ {
+		c, _ := NewChunker(bytes.NewReader(data), params)
+		for {
+			if _, err := c.Next(); err != nil {
+				break
+			}
+		}
+	}
+}
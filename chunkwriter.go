@@ -0,0 +1,135 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"errors"
+)
+
+// Returned by ChunkWriter.Write after Close.
+var ErrWriterClosed = errors.New("rabin: write to closed ChunkWriter")
+
+// Receives the chunks that a ChunkWriter cuts.
+type ChunkSink interface {
+	// chunk.Data is only valid for the duration of the call.  A non-nil
+	// error is returned by the Write or Close that produced the chunk.
+	WriteChunk(chunk Chunk) error
+}
+
+// Adapts an ordinary function to a ChunkSink.
+type ChunkSinkFunc func(chunk Chunk) error
+
+func (f ChunkSinkFunc) WriteChunk(chunk Chunk) error {
+	return f(chunk)
+}
+
+// ChunkWriter is the push-mode counterpart of Chunker.  Data written to it
+// is cut into content-defined chunks, which are passed to a ChunkSink as
+// soon as they are complete.  Boundaries are the same as those of a
+// Chunker over the concatenated writes, no matter how the writes are
+// split.
+type ChunkWriter struct {
+	sink     ChunkSink
+	splitter Splitter
+
+	// buff[start:end] holds data that has not been cut.
+	buff  []byte
+	start int
+	end   int
+
+	// Stream offset of buff[start].
+	offset int64
+
+	// The first sink error, which is sticky.
+	err    error
+	closed bool
+}
+
+// Returns a ChunkWriter that cuts according to params.
+func NewChunkWriter(sink ChunkSink, params ChunkerParams) (*ChunkWriter, error) {
+	splitter, err := NewRabinSplitter(params)
+	if err != nil {
+		return nil, err
+	}
+	return NewChunkWriterWithSplitter(sink, splitter), nil
+}
+
+// Returns a ChunkWriter that cuts wherever splitter decides.
+func NewChunkWriterWithSplitter(sink ChunkSink, splitter Splitter) *ChunkWriter {
+	return &ChunkWriter{
+		sink:     sink,
+		splitter: splitter,
+		buff:     make([]byte, 2*splitter.MaxSize()),
+	}
+}
+
+// Buffers p and emits every chunk that can no longer change.  At most
+// MaxSize bytes are held back between calls.
+func (w *ChunkWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	maxSize := w.splitter.MaxSize()
+	written := 0
+	for len(p) > 0 {
+		if w.end == len(w.buff) {
+			// Shift pending data to the front of the buffer.  Fewer
+			// than maxSize bytes are pending here, so at least maxSize
+			// bytes are freed.
+			w.end = copy(w.buff, w.buff[w.start:w.end])
+			w.start = 0
+		}
+		n := copy(w.buff[w.end:], p)
+		w.end += n
+		p = p[n:]
+		written += n
+
+		for w.end-w.start >= maxSize {
+			if err := w.emit(maxSize); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Emits the final chunks.  The sink is not closed.
+func (w *ChunkWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+
+	maxSize := w.splitter.MaxSize()
+	for w.err == nil && w.end > w.start {
+		avail := w.end - w.start
+		if avail > maxSize {
+			avail = maxSize
+		}
+		w.emit(avail)
+	}
+	return w.err
+}
+
+// Cuts one chunk from the first avail pending bytes.
+func (w *ChunkWriter) emit(avail int) error {
+	data := w.buff[w.start : w.start+avail]
+	n, fp := w.splitter.Split(data)
+	chunk := Chunk{
+		Offset:      w.offset,
+		Length:      n,
+		Fingerprint: fp,
+		Data:        data[:n],
+	}
+	w.start += n
+	w.offset += int64(n)
+
+	w.err = w.sink.WriteChunk(chunk)
+	return w.err
+}
@@ -0,0 +1,123 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Collects copies of chunks.
+type chunkCollector struct {
+	chunks []Chunk
+}
+
+func (c *chunkCollector) WriteChunk(chunk Chunk) error {
+	chunk.Data = append([]byte{}, chunk.Data...)
+	c.chunks = append(c.chunks, chunk)
+	return nil
+}
+
+func compareChunks(t *testing.T, name string, chunks, cmp []Chunk) {
+	if len(chunks) != len(cmp) {
+		t.Fatal(fmt.Sprintf("%s: %d chunks != %d", name, len(chunks), len(cmp)))
+	}
+	for ii := range chunks {
+		if chunks[ii].Offset != cmp[ii].Offset ||
+			chunks[ii].Length != cmp[ii].Length ||
+			chunks[ii].Fingerprint != cmp[ii].Fingerprint ||
+			!bytes.Equal(chunks[ii].Data, cmp[ii].Data) {
+			t.Fatal(fmt.Sprintf("%s: chunk %d differs", name, ii))
+		}
+	}
+}
+
+func Test_ChunkWriter(t *testing.T) {
+	params := DefaultChunkerParams()
+	data := makeRandomData(0, 1<<20)
+	cmp := chunkAll(t, bytes.NewReader(data), params)
+
+	r := rand.New(rand.NewSource(0))
+	for _, maxWrite := range []int{1, 100, 4096, params.MaxSize, 3 * params.MaxSize, len(data)} {
+		collector := &chunkCollector{}
+		w, err := NewChunkWriter(collector, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for offset := 0; offset < len(data); {
+			n := 1 + r.Intn(maxWrite)
+			if offset+n > len(data) {
+				n = len(data) - offset
+			}
+			if written, err := w.Write(data[offset : offset+n]); err != nil || written != n {
+				t.Fatal(fmt.Sprintf("Write (%d, %v)", written, err))
+			}
+			offset += n
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		compareChunks(t, fmt.Sprintf("max write %d", maxWrite), collector.chunks, cmp)
+	}
+}
+
+func Test_ChunkWriterFunc(t *testing.T) {
+	data := makeRandomData(1, 100*1024)
+	total := 0
+	w, err := NewChunkWriter(ChunkSinkFunc(func(chunk Chunk) error {
+		total += chunk.Length
+		return nil
+	}), DefaultChunkerParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if total >= len(data) {
+		t.Error("final chunk emitted before Close")
+	}
+	w.Close()
+	if total != len(data) {
+		t.Error(fmt.Sprintf("%d bytes emitted, expected %d", total, len(data)))
+	}
+
+	if _, err := w.Write(data); err != ErrWriterClosed {
+		t.Error(fmt.Sprintf("expected ErrWriterClosed, got %v", err))
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_ChunkWriterSinkError(t *testing.T) {
+	errSink := errors.New("sink failed")
+	count := 0
+	w, err := NewChunkWriter(ChunkSinkFunc(func(chunk Chunk) error {
+		count++
+		if count == 3 {
+			return errSink
+		}
+		return nil
+	}), DefaultChunkerParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := makeRandomData(2, 1<<20)
+	if _, err := w.Write(data); err != errSink {
+		t.Error(fmt.Sprintf("expected sink error, got %v", err))
+	}
+	if _, err := w.Write(data); err != errSink {
+		t.Error("sink error is not sticky")
+	}
+	if err := w.Close(); err != errSink {
+		t.Error(fmt.Sprintf("expected sink error from Close, got %v", err))
+	}
+	if count != 3 {
+		t.Error(fmt.Sprintf("%d chunks emitted after error", count-3))
+	}
+}
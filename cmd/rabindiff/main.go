@@ -0,0 +1,163 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Rabindiff reports what changed between two files, two directory trees or
+// two snapshots, based on content-defined chunks.
+//
+// Usage:
+//
+//	rabindiff [flags] old new
+//	rabindiff -store dir [flags] oldSnapshot newSnapshot
+//
+// Files that were added, removed or modified are listed as "A", "D" or "M"
+// followed by the path.  For modified files, the changed byte ranges of
+// the old version ("-") and of the new version ("+") follow, as half-open
+// intervals rounded out to chunk boundaries.  Files whose chunks were only
+// reordered or repeated are listed without ranges.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kevinko/rabin"
+)
+
+func printRanges(w io.Writer, sign string, ranges []rabin.ByteRange) {
+	for _, r := range ranges {
+		fmt.Fprintf(w, "\t%s [%d, %d)\n", sign, r.Offset, r.Offset+r.Length)
+	}
+}
+
+func printDiffs(w io.Writer, diffs []rabin.FileDiff) {
+	for _, diff := range diffs {
+		switch diff.Status {
+		case rabin.DiffAdded:
+			fmt.Fprintf(w, "%v %s (%d bytes)\n", diff.Status, diff.Path, diff.NewSize)
+		case rabin.DiffRemoved:
+			fmt.Fprintf(w, "%v %s (%d bytes)\n", diff.Status, diff.Path, diff.OldSize)
+		default:
+			fmt.Fprintf(w, "%v %s (%d -> %d bytes)\n", diff.Status, diff.Path,
+				diff.OldSize, diff.NewSize)
+			printRanges(w, "-", diff.Old)
+			printRanges(w, "+", diff.New)
+		}
+	}
+}
+
+// Diffs two regular files.
+func diffFiles(oldName, newName string, params rabin.ChunkerParams) ([]rabin.FileDiff, error) {
+	oldFile, err := os.Open(oldName)
+	if err != nil {
+		return nil, err
+	}
+	defer oldFile.Close()
+	newFile, err := os.Open(newName)
+	if err != nil {
+		return nil, err
+	}
+	defer newFile.Close()
+
+	oldManifest, err := rabin.ChunkFile(oldFile, params)
+	if err != nil {
+		return nil, err
+	}
+	newManifest, err := rabin.ChunkFile(newFile, params)
+	if err != nil {
+		return nil, err
+	}
+	if oldManifest.Fingerprint == newManifest.Fingerprint &&
+		oldManifest.Size == newManifest.Size {
+		return nil, nil
+	}
+	// Files whose chunks only moved or repeat are modified without ranges.
+	diff := rabin.FileDiff{
+		Path:    newName,
+		Status:  rabin.DiffModified,
+		OldSize: oldManifest.Size,
+		NewSize: newManifest.Size,
+	}
+	diff.Old, diff.New = rabin.DiffManifests(oldManifest, newManifest)
+	return []rabin.FileDiff{diff}, nil
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("rabindiff", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	defaults := rabin.DefaultChunkerParams()
+	storeDir := flags.String("store", "", "compare snapshots in this chunk store")
+	minSize := flags.Int("min", defaults.MinSize, "minimum chunk size")
+	avgSize := flags.Int("avg", defaults.AvgSize, "average chunk size (a power of two)")
+	maxSize := flags.Int("max", defaults.MaxSize, "maximum chunk size")
+	window := flags.Int("window", defaults.WindowSize, "rolling window size")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("expected two arguments")
+	}
+	oldName, newName := flags.Arg(0), flags.Arg(1)
+
+	params := defaults
+	params.MinSize = *minSize
+	params.AvgSize = *avgSize
+	params.MaxSize = *maxSize
+	params.WindowSize = *window
+
+	var diffs []rabin.FileDiff
+	if *storeDir != "" {
+		store, err := rabin.NewFileStore(*storeDir)
+		if err != nil {
+			return err
+		}
+		oldID, err := rabin.ParseChunkID(oldName)
+		if err != nil {
+			return err
+		}
+		newID, err := rabin.ParseChunkID(newName)
+		if err != nil {
+			return err
+		}
+		if diffs, err = rabin.DiffSnapshots(store, oldID, newID); err != nil {
+			return err
+		}
+	} else {
+		oldInfo, err := os.Stat(oldName)
+		if err != nil {
+			return err
+		}
+		newInfo, err := os.Stat(newName)
+		if err != nil {
+			return err
+		}
+		switch {
+		case oldInfo.IsDir() && newInfo.IsDir():
+			diffs, err = rabin.DiffFS(os.DirFS(oldName), os.DirFS(newName), params)
+		case !oldInfo.IsDir() && !newInfo.IsDir():
+			diffs, err = diffFiles(oldName, newName, params)
+		default:
+			err = errors.New("cannot compare a file with a directory")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	printDiffs(stdout, diffs)
+	return nil
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rabindiff:", err)
+		os.Exit(2)
+	}
+}
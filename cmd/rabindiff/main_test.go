@@ -0,0 +1,103 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kevinko/rabin"
+)
+
+func Test_Run(t *testing.T) {
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(0)).Read(data)
+	oldDir, newDir := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(oldDir, "file"), data, 0644)
+	os.WriteFile(filepath.Join(oldDir, "removed"), []byte("x"), 0644)
+	data[100000] ^= 1
+	os.WriteFile(filepath.Join(newDir, "file"), data, 0644)
+
+	out := new(bytes.Buffer)
+	if err := run([]string{oldDir, newDir}, out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || lines[0] != "M file (200000 -> 200000 bytes)" ||
+		lines[3] != "D removed (1 bytes)" {
+		t.Error("unexpected output:\n" + out.String())
+	}
+
+	// Files.
+	out.Reset()
+	err := run([]string{filepath.Join(oldDir, "file"), filepath.Join(newDir, "file")},
+		out, io.Discard)
+	if err != nil || !strings.Contains(out.String(), "\t+ [") {
+		t.Error("unexpected file output:\n" + out.String())
+	}
+	out.Reset()
+	err = run([]string{filepath.Join(newDir, "file"), filepath.Join(newDir, "file")},
+		out, io.Discard)
+	if err != nil || out.Len() != 0 {
+		t.Error("unexpected output for identical files:\n" + out.String())
+	}
+
+	// A file that repeats itself has no new chunks but is still modified.
+	manifest, err := rabin.ChunkFile(bytes.NewReader(data), rabin.DefaultChunkerParams())
+	if err != nil || len(manifest.Chunks) < 3 {
+		t.Fatal(fmt.Sprintf("%d chunks: %v", len(manifest.Chunks), err))
+	}
+	// Stop at a chunk boundary that the chunker found in the data.
+	size := 0
+	for _, chunk := range manifest.Chunks[:len(manifest.Chunks)-1] {
+		size += chunk.Length
+	}
+	oldName, newName := filepath.Join(t.TempDir(), "x"), filepath.Join(t.TempDir(), "xx")
+	os.WriteFile(oldName, data[:size], 0644)
+	os.WriteFile(newName, append(data[:size:size], data[:size]...), 0644)
+	out.Reset()
+	err = run([]string{oldName, newName}, out, io.Discard)
+	if want := fmt.Sprintf("M %s (%d -> %d bytes)\n", newName, size, 2*size); err != nil || out.String() != want {
+		t.Error("unexpected output for a repeated file:\n" + out.String())
+	}
+
+	// Snapshots.
+	storeDir := t.TempDir()
+	store, _ := rabin.NewFileStore(storeDir)
+	s, _ := rabin.NewSnapshotter(store, rabin.DefaultChunkerParams())
+	oldID, err := s.SnapshotDir(oldDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, err := s.SnapshotDir(newDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotOut := new(bytes.Buffer)
+	err = run([]string{"-store", storeDir, oldID.String(), newID.String()}, snapshotOut, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	run([]string{oldDir, newDir}, out, io.Discard)
+	if snapshotOut.String() != out.String() {
+		t.Error("snapshot output differs:\n" + snapshotOut.String())
+	}
+
+	if err := run([]string{oldDir}, io.Discard, io.Discard); err == nil {
+		t.Error("accepted one argument")
+	}
+	if err := run([]string{"-h"}, io.Discard, io.Discard); !errors.Is(err, flag.ErrHelp) {
+		t.Error(fmt.Sprintf("-h: %v", err))
+	}
+}
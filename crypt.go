@@ -0,0 +1,235 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+)
+
+var (
+	// Returned when a repository key is too short.
+	ErrKeySize = errors.New("rabin: repository key too short")
+	// Returned (wrapped) when a chunk fails authentication.
+	ErrChunkAuth = errors.New("rabin: chunk authentication failed")
+)
+
+const (
+	kMinKeySize = 16
+
+	// Labels for deriving subkeys from a repository key.
+	kPolynomialLabel = "rabin polynomial"
+	kEncryptionLabel = "rabin encryption"
+	kChunkIDLabel    = "rabin chunk id"
+)
+
+// A rand.Source that generates HMAC-SHA256(key, counter) blocks.
+type hmacSource struct {
+	key     []byte
+	counter uint64
+	block   []byte
+}
+
+func (s *hmacSource) Uint64() uint64 {
+	if len(s.block) == 0 {
+		mac := hmac.New(sha256.New, s.key)
+		mac.Write(binary.BigEndian.AppendUint64(nil, s.counter))
+		s.block = mac.Sum(nil)
+		s.counter++
+	}
+	v := binary.BigEndian.Uint64(s.block)
+	s.block = s.block[8:]
+	return v
+}
+
+func (s *hmacSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *hmacSource) Seed(seed int64) {
+	panic("rabin: hmacSource cannot be seeded")
+}
+
+// Returns HMAC-SHA256(key, label).
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Returns an irreducible polynomial of given degree that is determined by
+// key.  Like FindIrreducible, but reproducible: the same key always yields
+// the same polynomial, and without the key the polynomial cannot be
+// predicted.
+func DeriveIrreducible(key []byte, degree int) *Polynomial {
+	source := &hmacSource{key: deriveKey(key, kPolynomialLabel)}
+	return FindIrreducibleRand(rand.New(source), degree)
+}
+
+// The secrets derived from a repository key: a chunking polynomial, an
+// AES-256-GCM key and an HMAC key for naming chunks.  Chunking with a
+// secret polynomial keeps an observer of chunk sizes from recognizing
+// known files, and HMAC names keep chunk IDs from revealing content.
+type Keyring struct {
+	polynomial *Polynomial
+	aead       cipher.AEAD
+	idKey      []byte
+}
+
+// Derives a Keyring from key, which must hold at least 16 bytes.
+func NewKeyring(key []byte) (*Keyring, error) {
+	if len(key) < kMinKeySize {
+		return nil, ErrKeySize
+	}
+	block, err := aes.NewCipher(deriveKey(key, kEncryptionLabel))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{
+		polynomial: DeriveIrreducible(key, kIrreduciblePolyDegree),
+		aead:       aead,
+		idKey:      deriveKey(key, kChunkIDLabel),
+	}, nil
+}
+
+// Returns the secret chunking polynomial.
+func (k *Keyring) Polynomial() *Polynomial {
+	return k.polynomial
+}
+
+// Returns the name of a chunk: its HMAC-SHA256 truncated to 64 bits.
+// Chunks with equal IDs are assumed to be equal, so deduplication relies
+// on there being no 64-bit collisions among the chunks of a store.
+func (k *Keyring) ChunkID(data []byte) ChunkID {
+	mac := hmac.New(sha256.New, k.idKey)
+	mac.Write(data)
+	return ChunkID(binary.BigEndian.Uint64(mac.Sum(nil)))
+}
+
+// Encrypts a chunk named id under a random nonce, which prefixes the
+// result.  The ciphertext is bound to id.
+func (k *Keyring) Seal(id ChunkID, data []byte) []byte {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(data)+k.aead.Overhead())
+	if _, err := io.ReadFull(crand.Reader, nonce); err != nil {
+		panic(err)
+	}
+	return k.aead.Seal(nonce, nonce, data, binary.BigEndian.AppendUint64(nil, uint64(id)))
+}
+
+// Decrypts the output of Seal and checks that the chunk is named id.
+func (k *Keyring) Open(id ChunkID, sealed []byte) ([]byte, error) {
+	nonceSize := k.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, &ChunkError{ID: id, Err: ErrChunkAuth}
+	}
+	data, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:],
+		binary.BigEndian.AppendUint64(nil, uint64(id)))
+	if err != nil || k.ChunkID(data) != id {
+		return nil, &ChunkError{ID: id, Err: ErrChunkAuth}
+	}
+	return data, nil
+}
+
+// Returns params with the keyring's polynomial.
+func (k *Keyring) ChunkerParams(params ChunkerParams) ChunkerParams {
+	params.Polynomial = k.polynomial
+	return params
+}
+
+// An io.WriteCloser that cuts its input with a keyed rolling hash and
+// stores each distinct chunk once, encrypted, under its HMAC name (see
+// Keyring.ChunkID): chunks are deduplicated by 64-bit ID alone.  Chunks
+// returns the ordered list that an EncryptedReader needs to read the data
+// back.  The list is secret, since it reveals chunk sizes.
+type EncryptedWriter struct {
+	store   ChunkStore
+	keyring *Keyring
+	w       *ChunkWriter
+	chunks  []ManifestChunk
+}
+
+// Returns a writer that cuts according to params, with the keyring's
+// polynomial, and stores chunks in store.
+func NewEncryptedWriter(store ChunkStore, keyring *Keyring, params ChunkerParams) (*EncryptedWriter, error) {
+	w := &EncryptedWriter{store: store, keyring: keyring, chunks: []ManifestChunk{}}
+	cw, err := NewChunkWriter(ChunkSinkFunc(w.writeChunk), keyring.ChunkerParams(params))
+	if err != nil {
+		return nil, err
+	}
+	w.w = cw
+	return w, nil
+}
+
+func (w *EncryptedWriter) writeChunk(chunk Chunk) error {
+	id := w.keyring.ChunkID(chunk.Data)
+	w.chunks = append(w.chunks, ManifestChunk{ID: id, Length: chunk.Length})
+	if ok, err := w.store.Has(id); err != nil || ok {
+		return err
+	}
+	return w.store.Put(id, w.keyring.Seal(id, chunk.Data))
+}
+
+func (w *EncryptedWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// Stores the final chunks.
+func (w *EncryptedWriter) Close() error {
+	return w.w.Close()
+}
+
+// Returns the chunks written so far, in order.
+func (w *EncryptedWriter) Chunks() []ManifestChunk {
+	return w.chunks
+}
+
+// Reads back the data of an EncryptedWriter, verifying each chunk.
+type EncryptedReader struct {
+	store   ChunkStore
+	keyring *Keyring
+	chunks  []ManifestChunk
+	buff    []byte
+}
+
+// Returns a reader of the data stored as chunks.
+func NewEncryptedReader(store ChunkStore, keyring *Keyring, chunks []ManifestChunk) *EncryptedReader {
+	return &EncryptedReader{store: store, keyring: keyring, chunks: chunks}
+}
+
+func (r *EncryptedReader) Read(p []byte) (int, error) {
+	for len(r.buff) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk := r.chunks[0]
+		sealed, err := r.store.Get(chunk.ID)
+		if err != nil {
+			return 0, err
+		}
+		data, err := r.keyring.Open(chunk.ID, sealed)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) != chunk.Length {
+			return 0, &ChunkError{ID: chunk.ID, Err: ErrChunkCorrupt}
+		}
+		r.buff = data
+		r.chunks = r.chunks[1:]
+	}
+	n := copy(p, r.buff)
+	r.buff = r.buff[n:]
+	return n, nil
+}
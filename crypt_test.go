@@ -0,0 +1,131 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func Test_DeriveIrreducible(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	p := DeriveIrreducible(key, 64)
+	if p.Degree() != 64 || !p.Irreducible() {
+		t.Fatal(fmt.Sprintf("%v is not an irreducible degree 64 polynomial", p))
+	}
+	if DeriveIrreducible(key, 64).Cmp(p) != 0 {
+		t.Error("derivation is not deterministic")
+	}
+	if DeriveIrreducible([]byte("0123456789abcdeF"), 64).Cmp(p) == 0 {
+		t.Error("different keys derived the same polynomial")
+	}
+}
+
+// Writes data through an EncryptedWriter.
+func writeEncrypted(t *testing.T, store ChunkStore, keyring *Keyring, data []byte) []ManifestChunk {
+	w, err := NewEncryptedWriter(store, keyring, DefaultChunkerParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w.Chunks()
+}
+
+func Test_EncryptedStore(t *testing.T) {
+	keyring, err := NewKeyring([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	data := makeRandomData(0, 1<<20)
+	chunks := writeEncrypted(t, store, keyring, data)
+
+	got, err := io.ReadAll(NewEncryptedReader(store, keyring, chunks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("decrypted data differs")
+	}
+
+	// Chunks are stored once, encrypted.
+	stored := len(store.chunks)
+	again := writeEncrypted(t, store, keyring, data)
+	if len(store.chunks) != stored || len(again) != len(chunks) {
+		t.Error(fmt.Sprintf("rewrite stored %d chunks, had %d", len(store.chunks), stored))
+	}
+	for id, chunk := range store.chunks {
+		if bytes.Contains(data, chunk.data[len(chunk.data)/2:][:16]) {
+			t.Error(fmt.Sprintf("chunk %s is stored in the clear", id))
+		}
+	}
+
+	// The boundaries differ from those of the fixed polynomial.
+	plain := chunkAll(t, bytes.NewReader(data), DefaultChunkerParams())
+	same := 0
+	offsets := map[int64]bool{}
+	offset := int64(0)
+	for _, chunk := range chunks {
+		offsets[offset] = true
+		offset += int64(chunk.Length)
+	}
+	for _, chunk := range plain[1:] {
+		if offsets[chunk.Offset] {
+			same++
+		}
+	}
+	if same > len(plain)/10 {
+		t.Error(fmt.Sprintf("%d of %d boundaries match the fixed polynomial", same, len(plain)))
+	}
+}
+
+func Test_EncryptedStoreErrors(t *testing.T) {
+	if _, err := NewKeyring([]byte("short")); err != ErrKeySize {
+		t.Error(fmt.Sprintf("short key: %v", err))
+	}
+
+	keyring, _ := NewKeyring([]byte("0123456789abcdef"))
+	store := NewMemoryStore()
+	chunks := writeEncrypted(t, store, keyring, makeRandomData(1, 100000))
+
+	other, _ := NewKeyring([]byte("fedcba9876543210"))
+	if _, err := io.ReadAll(NewEncryptedReader(store, other, chunks)); !errors.Is(err, ErrChunkAuth) {
+		t.Error(fmt.Sprintf("wrong key: %v", err))
+	}
+
+	// Tampering with a sealed chunk, or moving it to another name.
+	id := chunks[1].ID
+	sealed, _ := store.Get(id)
+	sealed[len(sealed)-1] ^= 1
+	if _, err := keyring.Open(id, sealed); !errors.Is(err, ErrChunkAuth) {
+		t.Error(fmt.Sprintf("tampered chunk: %v", err))
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := keyring.Open(chunks[0].ID, sealed); !errors.Is(err, ErrChunkAuth) {
+		t.Error(fmt.Sprintf("renamed chunk: %v", err))
+	}
+
+	// A manifest with the wrong length for a chunk.
+	wrong := append([]ManifestChunk{}, chunks...)
+	wrong[1].Length++
+	_, err := io.ReadAll(NewEncryptedReader(store, keyring, wrong))
+	var chunkErr *ChunkError
+	if !errors.As(err, &chunkErr) || chunkErr.ID != id || !errors.Is(err, ErrChunkCorrupt) {
+		t.Error(fmt.Sprintf("wrong length: %v", err))
+	}
+
+	store.Delete(id)
+	if _, err := io.ReadAll(NewEncryptedReader(store, keyring, chunks)); !errors.Is(err, ErrChunkNotFound) {
+		t.Error(fmt.Sprintf("missing chunk: %v", err))
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// A range of bytes in a file.
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+type DiffStatus int
+
+const (
+	DiffAdded DiffStatus = iota
+	DiffRemoved
+	DiffModified
+)
+
+func (s DiffStatus) String() string {
+	switch s {
+	case DiffAdded:
+		return "A"
+	case DiffRemoved:
+		return "D"
+	case DiffModified:
+		return "M"
+	}
+	return "?"
+}
+
+// A regular file that differs between two trees.
+type FileDiff struct {
+	Path   string
+	Status DiffStatus
+
+	OldSize int64
+	NewSize int64
+
+	// For modified files, the ranges of the old version that are not in
+	// the new one, and the ranges of the new version that are not in the
+	// old one.  Ranges are unions of whole chunks.
+	Old []ByteRange
+	New []ByteRange
+}
+
+// Returns the ranges of old and new whose chunks do not occur anywhere in
+// the other version.  Adjacent differing chunks are merged into one range.
+// Chunks that merely moved are not reported.
+func DiffManifests(old, new *Manifest) (oldRanges, newRanges []ByteRange) {
+	return diffChunks(old.Chunks, new.Chunks), diffChunks(new.Chunks, old.Chunks)
+}
+
+// Returns the ranges of chunks that are not in other.
+func diffChunks(chunks, other []ManifestChunk) []ByteRange {
+	present := make(map[ChunkID]bool, len(other))
+	for _, chunk := range other {
+		present[chunk.ID] = true
+	}
+	ranges := []ByteRange{}
+	offset := int64(0)
+	for _, chunk := range chunks {
+		if !present[chunk.ID] {
+			last := len(ranges) - 1
+			if last >= 0 && ranges[last].Offset+ranges[last].Length == offset {
+				ranges[last].Length += int64(chunk.Length)
+			} else {
+				ranges = append(ranges, ByteRange{Offset: offset, Length: int64(chunk.Length)})
+			}
+		}
+		offset += int64(chunk.Length)
+	}
+	return ranges
+}
+
+// Chunks two versions of a file according to params and returns their
+// changed ranges, as DiffManifests does.
+func DiffFiles(old, new io.Reader, params ChunkerParams) (oldRanges, newRanges []ByteRange, err error) {
+	oldManifest, err := ChunkFile(old, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	newManifest, err := ChunkFile(new, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	oldRanges, newRanges = DiffManifests(oldManifest, newManifest)
+	return oldRanges, newRanges, nil
+}
+
+// A regular file in one of the trees being compared.
+type diffFile struct {
+	size int64
+	// The ID of the file's manifest, if known, which avoids loading
+	// identical manifests.
+	ref      ChunkID
+	manifest func() (*Manifest, error)
+}
+
+// Returns the differences between two sets of files, sorted by path.
+func diffFileSets(old, new map[string]diffFile) ([]FileDiff, error) {
+	paths := make([]string, 0, len(old)+len(new))
+	for name := range old {
+		paths = append(paths, name)
+	}
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			paths = append(paths, name)
+		}
+	}
+	sort.Strings(paths)
+
+	diffs := []FileDiff{}
+	for _, name := range paths {
+		oldFile, inOld := old[name]
+		newFile, inNew := new[name]
+		diff := FileDiff{Path: name, OldSize: oldFile.size, NewSize: newFile.size}
+		switch {
+		case !inOld:
+			diff.Status = DiffAdded
+		case !inNew:
+			diff.Status = DiffRemoved
+		case oldFile.ref != 0 && oldFile.ref == newFile.ref:
+			continue
+		default:
+			oldManifest, err := oldFile.manifest()
+			if err != nil {
+				return nil, err
+			}
+			newManifest, err := newFile.manifest()
+			if err != nil {
+				return nil, err
+			}
+			diff.Status = DiffModified
+			diff.Old, diff.New = DiffManifests(oldManifest, newManifest)
+			if len(diff.Old) == 0 && len(diff.New) == 0 {
+				// Same chunks, possibly reordered.
+				if oldManifest.Fingerprint == newManifest.Fingerprint {
+					continue
+				}
+			}
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+// Returns the regular files of fsys, which are chunked according to params
+// on demand.
+func fsFiles(fsys fs.FS, params ChunkerParams) (map[string]diffFile, error) {
+	files := map[string]diffFile{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[name] = diffFile{
+			size: info.Size(),
+			manifest: func() (*Manifest, error) {
+				f, err := fsys.Open(name)
+				if err != nil {
+					return nil, err
+				}
+				defer f.Close()
+				return ChunkFile(f, params)
+			},
+		}
+		return nil
+	})
+	return files, err
+}
+
+// Compares the regular files of two trees, chunking files that are in both
+// according to params.
+func DiffFS(old, new fs.FS, params ChunkerParams) ([]FileDiff, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	oldFiles, err := fsFiles(old, params)
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := fsFiles(new, params)
+	if err != nil {
+		return nil, err
+	}
+	return diffFileSets(oldFiles, newFiles)
+}
+
+// Adds the regular files of a stored tree to files.
+func treeFiles(store ChunkStore, id ChunkID, dir string, files map[string]diffFile) error {
+	tree, err := LoadTree(store, id)
+	if err != nil {
+		return err
+	}
+	for _, entry := range tree.Entries {
+		name := path.Join(dir, entry.Name)
+		switch {
+		case entry.Mode.IsDir():
+			if err := treeFiles(store, entry.Ref, name, files); err != nil {
+				return err
+			}
+		case entry.Mode.IsRegular():
+			ref := entry.Ref
+			files[name] = diffFile{
+				size: entry.Size,
+				ref:  ref,
+				manifest: func() (*Manifest, error) {
+					return LoadManifest(store, ref)
+				},
+			}
+		}
+	}
+	return nil
+}
+
+// Compares the regular files of two stored trees.  Only the manifests of
+// files that changed are read.
+func DiffTrees(store ChunkStore, old, new ChunkID) ([]FileDiff, error) {
+	oldFiles := map[string]diffFile{}
+	if err := treeFiles(store, old, "", oldFiles); err != nil {
+		return nil, err
+	}
+	newFiles := map[string]diffFile{}
+	if err := treeFiles(store, new, "", newFiles); err != nil {
+		return nil, err
+	}
+	return diffFileSets(oldFiles, newFiles)
+}
+
+// Compares two snapshots (see Snapshotter).
+func DiffSnapshots(store ChunkStore, old, new ChunkID) ([]FileDiff, error) {
+	oldSnapshot, err := LoadSnapshot(store, old)
+	if err != nil {
+		return nil, err
+	}
+	newSnapshot, err := LoadSnapshot(store, new)
+	if err != nil {
+		return nil, err
+	}
+	return DiffTrees(store, oldSnapshot.Tree, newSnapshot.Tree)
+}
@@ -0,0 +1,135 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// Whether r covers [offset, offset+length).
+func rangesCover(ranges []ByteRange, offset, length int64) bool {
+	for _, r := range ranges {
+		if r.Offset <= offset && offset+length <= r.Offset+r.Length {
+			return true
+		}
+	}
+	return false
+}
+
+func rangesTotal(ranges []ByteRange) int64 {
+	total := int64(0)
+	for _, r := range ranges {
+		total += r.Length
+	}
+	return total
+}
+
+func Test_DiffFiles(t *testing.T) {
+	params := DefaultChunkerParams()
+	old := makeRandomData(0, 1<<20)
+
+	// Overwrite 100 bytes in the middle and insert 50 near the end.
+	edited := append([]byte{}, old...)
+	copy(edited[300000:], makeRandomData(1, 100))
+	edited = append(edited[:900000], append(makeRandomData(2, 50), edited[900000:]...)...)
+
+	oldRanges, newRanges, err := DiffFiles(bytes.NewReader(old), bytes.NewReader(edited), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rangesCover(oldRanges, 300000, 100) || !rangesCover(newRanges, 300000, 100) {
+		t.Error(fmt.Sprintf("overwrite not covered: %v, %v", oldRanges, newRanges))
+	}
+	if !rangesCover(newRanges, 900000, 50) {
+		t.Error(fmt.Sprintf("insertion not covered: %v", newRanges))
+	}
+	if len(newRanges) != 2 || rangesTotal(newRanges) > int64(6*params.AvgSize) {
+		t.Error(fmt.Sprintf("ranges are too coarse: %v", newRanges))
+	}
+
+	oldRanges, newRanges, err = DiffFiles(bytes.NewReader(old), bytes.NewReader(old), params)
+	if err != nil || len(oldRanges) != 0 || len(newRanges) != 0 {
+		t.Error(fmt.Sprintf("identical files: %v, %v, %v", oldRanges, newRanges, err))
+	}
+}
+
+func Test_DiffFS(t *testing.T) {
+	big := makeRandomData(3, 200000)
+	changed := append([]byte{}, big...)
+	changed[100000] ^= 1
+	old := fstest.MapFS{
+		"same":       {Data: big},
+		"d/changed":  {Data: big},
+		"removed":    {Data: []byte("gone")},
+		"d/e/nested": {Data: []byte("nested")},
+	}
+	new := fstest.MapFS{
+		"same":      {Data: big},
+		"d/changed": {Data: changed},
+		"added":     {Data: []byte("new")},
+		"d/e/x":     {Data: []byte("x")},
+	}
+	diffs, err := DiffFS(old, new, DefaultChunkerParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, diff := range diffs {
+		got = append(got, fmt.Sprintf("%v %s", diff.Status, diff.Path))
+	}
+	expected := []string{"A added", "M d/changed", "D d/e/nested", "A d/e/x", "D removed"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatal(fmt.Sprintf("diffs %v, expected %v", got, expected))
+	}
+	modified := diffs[1]
+	if !rangesCover(modified.Old, 100000, 1) || !rangesCover(modified.New, 100000, 1) ||
+		modified.OldSize != 200000 || modified.NewSize != 200000 {
+		t.Error(fmt.Sprintf("modified file: %+v", modified))
+	}
+}
+
+func Test_DiffSnapshots(t *testing.T) {
+	src := t.TempDir()
+	makeTestTree(t, src)
+	store := NewMemoryStore()
+	s, _ := NewSnapshotter(store, DefaultChunkerParams())
+	first, err := s.SnapshotDir(src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(src, "big"))
+	data[5000] ^= 1
+	os.WriteFile(filepath.Join(src, "big"), data, 0644)
+	os.Remove(filepath.Join(src, "small"))
+	os.WriteFile(filepath.Join(src, "a", "b", "added"), []byte("added"), 0644)
+	second, err := s.SnapshotDir(src, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := DiffSnapshots(store, first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, diff := range diffs {
+		got = append(got, fmt.Sprintf("%v %s", diff.Status, diff.Path))
+	}
+	expected := []string{"A a/b/added", "M big", "D small"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatal(fmt.Sprintf("diffs %v, expected %v", got, expected))
+	}
+	if !rangesCover(diffs[1].New, 5000, 1) {
+		t.Error(fmt.Sprintf("modified ranges %v", diffs[1].New))
+	}
+}
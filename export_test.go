@@ -0,0 +1,12 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+// Reference implementations for the external tests.
+var (
+	NaiveBuzhash = naiveBuzhash
+	NaiveGear    = naiveGear
+	NaiveAdler   = naiveAdler
+)
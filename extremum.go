@@ -0,0 +1,122 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// Extremum-based splitters choose boundaries by local maxima of the
+// per-position Rabin fingerprint rather than by mask matches.  The
+// fingerprint at position n is that of the WindowSize bytes preceding n,
+// as in NewRabinSplitter.  ChunkerParams.Mask and Target are unused.
+type extremumSplitter struct {
+	rabin *rabinSplitter
+
+	// The width of the extreme (AE) or maximum (RAM) window in bytes.
+	width int
+
+	// Cuts at the first position past the maximum window whose value is
+	// at least its maximum (RAM) rather than width bytes past a maximum
+	// (AE).
+	ram bool
+}
+
+func newExtremumSplitter(params ChunkerParams, width int, ram bool) (*extremumSplitter, error) {
+	if params.AvgSize <= params.MinSize {
+		return nil, fmt.Errorf("%w: AvgSize %d <= MinSize %d",
+			ErrChunkerParams, params.AvgSize, params.MinSize)
+	}
+	rabin, err := newRabinSplitter(params)
+	if err != nil {
+		return nil, err
+	}
+	if width < 1 {
+		width = 1
+	}
+	return &extremumSplitter{rabin: rabin, width: width, ram: ram}, nil
+}
+
+// Returns an Asymmetric Extremum (AE) splitter (Zhang et al., INFOCOM
+// 2015).  Past MinSize, a chunk is cut once w positions pass without
+// exceeding the largest fingerprint seen so far, where
+// w = (AvgSize - MinSize) / (e - 1) so that chunks average about AvgSize
+// on random data.
+func NewAESplitter(params ChunkerParams) (Splitter, error) {
+	width := int(float64(params.AvgSize-params.MinSize) / (math.E - 1))
+	return newExtremumSplitter(params, width, false)
+}
+
+// Returns a Rapid Asymmetric Maximum (RAM) splitter (Widodo et al., 2017).
+// The maximum fingerprint over the AvgSize - MinSize positions past
+// MinSize is found, and the chunk is cut at the first later position whose
+// fingerprint is at least that maximum.  Chunk sizes have a long tail, so
+// MaxSize matters more than for AE.
+func NewRAMSplitter(params ChunkerParams) (Splitter, error) {
+	return newExtremumSplitter(params, params.AvgSize-params.MinSize, true)
+}
+
+// Returns a Chunker that cuts r with AE.
+func NewAEChunker(r io.Reader, params ChunkerParams) (*Chunker, error) {
+	splitter, err := NewAESplitter(params)
+	if err != nil {
+		return nil, err
+	}
+	return NewChunkerWithSplitter(r, splitter), nil
+}
+
+// Returns a Chunker that cuts r with RAM.
+func NewRAMChunker(r io.Reader, params ChunkerParams) (*Chunker, error) {
+	splitter, err := NewRAMSplitter(params)
+	if err != nil {
+		return nil, err
+	}
+	return NewChunkerWithSplitter(r, splitter), nil
+}
+
+func (s *extremumSplitter) MaxSize() int {
+	return s.rabin.params.MaxSize
+}
+
+func (s *extremumSplitter) Split(data []byte) (int, uint64) {
+	windowSize := s.rabin.params.WindowSize
+	minSize := s.rabin.params.MinSize
+	if len(data) <= minSize {
+		return len(data), s.rabin.fingerprint(data)
+	}
+
+	hash := s.rabin.hash
+	hash.Reset()
+	hash.Write(data[minSize-windowSize : minSize])
+	fp := hash.Sum64()
+
+	maxFp := fp
+	maxPos := minSize
+	for n := minSize + 1; n <= len(data); n++ {
+		fp = hash.rollByte(data[n-1-windowSize], data[n-1])
+
+		if s.ram {
+			if n-minSize < s.width {
+				// Still within the maximum window.
+				if fp > maxFp {
+					maxFp = fp
+				}
+			} else if fp >= maxFp {
+				return n, fp
+			}
+			continue
+		}
+
+		if fp > maxFp {
+			maxFp = fp
+			maxPos = n
+		} else if n-maxPos == s.width {
+			return n, fp
+		}
+	}
+	return len(data), fp
+}
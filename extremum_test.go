@@ -0,0 +1,170 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// Returns the fingerprint of the window preceding each position n in
+// [minSize, len(chunk)], indexed by n - minSize.
+func positionFingerprints(chunk []byte, minSize, windowSize int) []uint64 {
+	hash := NewRolling(windowSize)
+	fps := []uint64{}
+	for n := minSize; n <= len(chunk); n++ {
+		hash.Reset()
+		hash.Write(chunk[n-windowSize : n])
+		fps = append(fps, hash.Sum64())
+	}
+	return fps
+}
+
+func Test_AE(t *testing.T) {
+	params := DefaultChunkerParams()
+	splitter, err := NewAESplitter(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	width := splitter.(*extremumSplitter).width
+
+	data := makeRandomData(0, 1<<20)
+	chunks := chunkAllWithSplitter(t, data, splitter)
+	checkChunks(t, data, chunks, params.MinSize, params.MaxSize)
+
+	for ii, chunk := range chunks[:len(chunks)-1] {
+		if chunk.Length == params.MaxSize {
+			continue
+		}
+		// The maximum must lie exactly width positions before the cut,
+		// and must not be exceeded in between.
+		fps := positionFingerprints(chunk.Data, params.MinSize, params.WindowSize)
+		maxIndex := 0
+		for jj, fp := range fps {
+			if fp > fps[maxIndex] {
+				maxIndex = jj
+			}
+		}
+		if len(fps)-1-maxIndex != width {
+			t.Error(fmt.Sprintf("chunk %d: maximum at %d of %d, width %d",
+				ii, maxIndex, len(fps), width))
+		}
+		if fps[len(fps)-1] != chunk.Fingerprint {
+			t.Error(fmt.Sprintf("chunk %d: fingerprint mismatch", ii))
+		}
+	}
+
+	avg := len(data) / len(chunks)
+	if avg < params.AvgSize/2 || avg > 2*params.AvgSize {
+		t.Error(fmt.Sprintf("unexpected average chunk size %d", avg))
+	}
+}
+
+func Test_RAM(t *testing.T) {
+	params := DefaultChunkerParams()
+	splitter, err := NewRAMSplitter(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	width := splitter.(*extremumSplitter).width
+
+	data := makeRandomData(1, 1<<20)
+	chunks := chunkAllWithSplitter(t, data, splitter)
+	checkChunks(t, data, chunks, params.MinSize, params.MaxSize)
+
+	for ii, chunk := range chunks[:len(chunks)-1] {
+		if chunk.Length == params.MaxSize {
+			continue
+		}
+		// The cut is the first value past the window that reaches the
+		// window's maximum.
+		fps := positionFingerprints(chunk.Data, params.MinSize, params.WindowSize)
+		maxFp := uint64(0)
+		for _, fp := range fps[:width] {
+			if fp > maxFp {
+				maxFp = fp
+			}
+		}
+		for jj := width; jj < len(fps)-1; jj++ {
+			if fps[jj] >= maxFp {
+				t.Fatal(fmt.Sprintf("chunk %d: missed cut at %d", ii, jj))
+			}
+		}
+		if last := fps[len(fps)-1]; last < maxFp || last != chunk.Fingerprint {
+			t.Error(fmt.Sprintf("chunk %d: cut below the maximum", ii))
+		}
+	}
+}
+
+// Runs of zeros are cut at a fixed distance rather than at MaxSize.
+func Test_AEZeros(t *testing.T) {
+	params := DefaultChunkerParams()
+	splitter, err := NewAESplitter(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	width := splitter.(*extremumSplitter).width
+
+	data := make([]byte, 256*1024)
+	chunks := chunkAllWithSplitter(t, data, splitter)
+	for _, chunk := range chunks[:len(chunks)-1] {
+		if chunk.Length != params.MinSize+width {
+			t.Fatal(fmt.Sprintf("zero chunk of length %d", chunk.Length))
+		}
+	}
+}
+
+func Test_ExtremumInsertion(t *testing.T) {
+	params := DefaultChunkerParams()
+	data := makeRandomData(2, 1<<20)
+	edited := append(append(append([]byte{}, data[:1000]...), "inserted bytes"...), data[1000:]...)
+
+	for name, newFn := range map[string]func(ChunkerParams) (Splitter, error){
+		"AE":  NewAESplitter,
+		"RAM": NewRAMSplitter,
+	} {
+		splitter, err := newFn(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ratio, _ := dedupRatio(splitter, [][]byte{data, edited})
+		if ratio < 1.9 {
+			t.Error(fmt.Sprintf("%s: dedup ratio %f after a single insertion", name, ratio))
+		}
+	}
+}
+
+func Test_ExtremumChunkers(t *testing.T) {
+	params := DefaultChunkerParams()
+	data := makeRandomData(3, 256*1024)
+	for name, newFn := range map[string]func(io.Reader, ChunkerParams) (*Chunker, error){
+		"AE":  NewAEChunker,
+		"RAM": NewRAMChunker,
+	} {
+		c, err := newFn(bytes.NewReader(data), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks := readAllChunks(t, c)
+		if len(chunks) < 2 {
+			t.Error(fmt.Sprintf("%s: %d chunks", name, len(chunks)))
+		}
+		checkChunks(t, data, chunks, params.MinSize, params.MaxSize)
+	}
+}
+
+func Test_ExtremumParams(t *testing.T) {
+	params := DefaultChunkerParams()
+	params.AvgSize = params.MinSize
+	if _, err := NewAESplitter(params); !errors.Is(err, ErrChunkerParams) {
+		t.Error(fmt.Sprintf("expected ErrChunkerParams, got %v", err))
+	}
+	if _, err := NewRAMSplitter(params); !errors.Is(err, ErrChunkerParams) {
+		t.Error(fmt.Sprintf("expected ErrChunkerParams, got %v", err))
+	}
+}
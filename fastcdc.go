@@ -0,0 +1,135 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// Parameters for FastCDC chunking (Xia et al., USENIX ATC 2016).
+type FastCDCParams struct {
+	MinSize int
+	// The desired average chunk size.  Cuts before AvgSize use a stricter
+	// mask than cuts after it, which concentrates chunk sizes around
+	// AvgSize.
+	AvgSize int
+	MaxSize int
+
+	// The number of bits by which the two masks differ from the mask for
+	// AvgSize.  0 disables normalization; the paper recommends 2.
+	Normalization int
+}
+
+func DefaultFastCDCParams() FastCDCParams {
+	return FastCDCParams{
+		MinSize:       2 * 1024,
+		AvgSize:       8 * 1024,
+		MaxSize:       64 * 1024,
+		Normalization: 2,
+	}
+}
+
+func (p FastCDCParams) validate() error {
+	if p.MinSize < 0 || p.AvgSize < p.MinSize || p.MaxSize < p.AvgSize || p.MaxSize <= 0 {
+		return fmt.Errorf("%w: need 0 <= MinSize %d <= AvgSize %d <= MaxSize %d",
+			ErrChunkerParams, p.MinSize, p.AvgSize, p.MaxSize)
+	}
+	bits := p.maskBits()
+	if p.Normalization < 0 || p.Normalization >= bits || bits+p.Normalization > 64 {
+		return fmt.Errorf("%w: Normalization %d", ErrChunkerParams, p.Normalization)
+	}
+	return nil
+}
+
+// The number of mask bits for AvgSize.
+func (p FastCDCParams) maskBits() int {
+	return int(math.Round(math.Log2(float64(p.AvgSize))))
+}
+
+// Returns a mask of the given number of bits.  Gear hashes mix the oldest
+// bytes into the high bits, so the mask takes the topmost bits to make
+// the most of the implicit 64 byte window.
+func fastCDCMask(bits int) uint64 {
+	if bits == 0 {
+		return 0
+	}
+	return ^uint64(0) << uint(64-bits)
+}
+
+// Splits where the Gear hash of the bytes past MinSize matches a mask.
+type fastCDCSplitter struct {
+	params FastCDCParams
+	// maskS is used before AvgSize, and maskL after.
+	maskS uint64
+	maskL uint64
+}
+
+// Returns a FastCDC Splitter.  This can be used with
+// NewChunkerWithSplitter in place of NewRabinSplitter.
+func NewFastCDCSplitter(params FastCDCParams) (Splitter, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	bits := params.maskBits()
+	return &fastCDCSplitter{
+		params: params,
+		maskS:  fastCDCMask(bits + params.Normalization),
+		maskL:  fastCDCMask(bits - params.Normalization),
+	}, nil
+}
+
+// Returns a Chunker that cuts r with FastCDC.
+func NewFastCDCChunker(r io.Reader, params FastCDCParams) (*Chunker, error) {
+	splitter, err := NewFastCDCSplitter(params)
+	if err != nil {
+		return nil, err
+	}
+	return NewChunkerWithSplitter(r, splitter), nil
+}
+
+func (s *fastCDCSplitter) MaxSize() int {
+	return s.params.MaxSize
+}
+
+func (s *fastCDCSplitter) Split(data []byte) (int, uint64) {
+	n := len(data)
+	minSize := s.params.MinSize
+	if n <= minSize {
+		return n, gearSum(data)
+	}
+
+	normalSize := s.params.AvgSize
+	if normalSize > n {
+		normalSize = n
+	}
+
+	// Cut-point skipping: nothing before MinSize is hashed.
+	h := uint64(0)
+	ii := minSize
+	for ; ii < normalSize; ii++ {
+		h = (h << 1) + kGearTable[data[ii]]
+		if h&s.maskS == 0 {
+			return ii + 1, h
+		}
+	}
+	for ; ii < n; ii++ {
+		h = (h << 1) + kGearTable[data[ii]]
+		if h&s.maskL == 0 {
+			return ii + 1, h
+		}
+	}
+	return n, h
+}
+
+// Returns the Gear hash of data.
+func gearSum(data []byte) uint64 {
+	h := uint64(0)
+	for _, b := range data {
+		h = (h << 1) + kGearTable[b]
+	}
+	return h
+}
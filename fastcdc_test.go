@@ -0,0 +1,305 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Chunking strategies that are compared by the corpus benchmarks.
+var chunkingStrategies = []struct {
+	name  string
+	newFn func() (Splitter, error)
+}{
+	{"Rabin", func() (Splitter, error) {
+		return NewRabinSplitter(DefaultChunkerParams())
+	}},
+	{"FastCDC", func() (Splitter, error) {
+		return NewFastCDCSplitter(DefaultFastCDCParams())
+	}},
+	{"TTTD", func() (Splitter, error) {
+		params := DefaultChunkerParams()
+		return NewTTTDSplitter(params, params.AvgSize/2)
+	}},
+	{"AE", func() (Splitter, error) {
+		return NewAESplitter(DefaultChunkerParams())
+	}},
+	{"RAM", func() (Splitter, error) {
+		return NewRAMSplitter(DefaultChunkerParams())
+	}},
+}
+
+// A sequence of versions of a data set, as a backup would see it.
+type testCorpus struct {
+	name     string
+	versions [][]byte
+}
+
+// Applies numEdits random insertions, deletions and overwrites of up to
+// 1KB each to a copy of data.
+func mutate(r *rand.Rand, data []byte, numEdits int) []byte {
+	out := append([]byte{}, data...)
+	for ii := 0; ii < numEdits; ii++ {
+		offset := r.Intn(len(out))
+		length := 1 + r.Intn(1024)
+		edit := make([]byte, length)
+		r.Read(edit)
+
+		switch r.Intn(3) {
+		case 0:
+			out = append(out[:offset], append(edit, out[offset:]...)...)
+		case 1:
+			if offset+length > len(out) {
+				length = len(out) - offset
+			}
+			out = append(out[:offset], out[offset+length:]...)
+		case 2:
+			copy(out[offset:], edit)
+		}
+	}
+	return out
+}
+
+// Generates pseudo-text from a small random vocabulary.
+func makeText(r *rand.Rand, size int) []byte {
+	words := make([][]byte, 2000)
+	for ii := range words {
+		word := make([]byte, 2+r.Intn(8))
+		for jj := range word {
+			word[jj] = 'a' + byte(r.Intn(26))
+		}
+		words[ii] = word
+	}
+
+	buff := new(bytes.Buffer)
+	for buff.Len() < size {
+		buff.Write(words[r.Intn(len(words))])
+		if r.Intn(12) == 0 {
+			buff.WriteString(".\n")
+		} else {
+			buff.WriteByte(' ')
+		}
+	}
+	return buff.Bytes()[:size]
+}
+
+// Generates data with long runs of zeros, as in VM images.
+func makeSparse(r *rand.Rand, size int) []byte {
+	data := make([]byte, size)
+	for offset := 0; offset < size; {
+		length := 1024 + r.Intn(256*1024)
+		if offset+length > size {
+			length = size - offset
+		}
+		if r.Intn(2) == 0 {
+			r.Read(data[offset : offset+length])
+		}
+		offset += length
+	}
+	return data
+}
+
+func makeCorpora() []testCorpus {
+	const (
+		size        = 4 << 20
+		numVersions = 4
+		numEdits    = 20
+	)
+	r := rand.New(rand.NewSource(0))
+
+	bases := []testCorpus{
+		{name: "Random", versions: [][]byte{makeRandomData(0, size)}},
+		{name: "Text", versions: [][]byte{makeText(r, size)}},
+		{name: "Sparse", versions: [][]byte{makeSparse(r, size)}},
+	}
+	for ii := range bases {
+		corpus := &bases[ii]
+		for len(corpus.versions) < numVersions {
+			last := corpus.versions[len(corpus.versions)-1]
+			corpus.versions = append(corpus.versions, mutate(r, last, numEdits))
+		}
+	}
+	return bases
+}
+
+// Chunks every version and returns the ratio of total bytes to unique
+// bytes, along with the number of chunks.
+func dedupRatio(splitter Splitter, versions [][]byte) (float64, int) {
+	seen := map[uint64]bool{}
+	total, unique, numChunks := 0, 0, 0
+	for _, version := range versions {
+		c := NewChunkerWithSplitter(bytes.NewReader(version), splitter)
+		for {
+			chunk, err := c.Next()
+			if err != nil {
+				break
+			}
+			numChunks++
+			total += chunk.Length
+			fp := fingerprint64(chunk.Data)
+			if !seen[fp] {
+				seen[fp] = true
+				unique += chunk.Length
+			}
+		}
+	}
+	return float64(total) / float64(unique), numChunks
+}
+
+func chunkAllWithSplitter(t *testing.T, data []byte, splitter Splitter) []Chunk {
+	return readAllChunks(t, NewChunkerWithSplitter(bytes.NewReader(data), splitter))
+}
+
+// Returns the standard deviation of chunk lengths, excluding the last.
+func chunkStddev(chunks []Chunk) float64 {
+	chunks = chunks[:len(chunks)-1]
+	mean := 0.0
+	for _, chunk := range chunks {
+		mean += float64(chunk.Length)
+	}
+	mean /= float64(len(chunks))
+	variance := 0.0
+	for _, chunk := range chunks {
+		variance += (float64(chunk.Length) - mean) * (float64(chunk.Length) - mean)
+	}
+	return math.Sqrt(variance / float64(len(chunks)))
+}
+
+func Test_FastCDC(t *testing.T) {
+	params := DefaultFastCDCParams()
+	splitter, err := NewFastCDCSplitter(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeRandomData(0, 1<<20)
+	chunks := chunkAllWithSplitter(t, data, splitter)
+	checkChunks(t, data, chunks, params.MinSize, params.MaxSize)
+
+	bits := params.maskBits()
+	for ii, chunk := range chunks[:len(chunks)-1] {
+		fp := gearSum(chunk.Data[params.MinSize:])
+		if fp != chunk.Fingerprint {
+			t.Error(fmt.Sprintf("chunk %d: fingerprint 0x%x != 0x%x", ii, chunk.Fingerprint, fp))
+		}
+		mask := fastCDCMask(bits - params.Normalization)
+		if chunk.Length <= params.AvgSize {
+			mask = fastCDCMask(bits + params.Normalization)
+		}
+		if chunk.Length != params.MaxSize && fp&mask != 0 {
+			t.Error(fmt.Sprintf("chunk %d: cut without a match", ii))
+		}
+	}
+
+	avg := len(data) / len(chunks)
+	if avg < params.AvgSize/2 || avg > 2*params.AvgSize {
+		t.Error(fmt.Sprintf("unexpected average chunk size %d", avg))
+	}
+}
+
+// Normalization narrows the distribution of chunk sizes.
+func Test_FastCDCNormalization(t *testing.T) {
+	data := makeRandomData(1, 4<<20)
+
+	params := DefaultFastCDCParams()
+	params.Normalization = 0
+	plain, err := NewFastCDCSplitter(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.Normalization = 2
+	normalized, err := NewFastCDCSplitter(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainStddev := chunkStddev(chunkAllWithSplitter(t, data, plain))
+	normalizedStddev := chunkStddev(chunkAllWithSplitter(t, data, normalized))
+	if normalizedStddev >= plainStddev {
+		t.Error(fmt.Sprintf("normalized stddev %f >= plain stddev %f",
+			normalizedStddev, plainStddev))
+	}
+}
+
+func Test_FastCDCInsertion(t *testing.T) {
+	splitter, err := NewFastCDCSplitter(DefaultFastCDCParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeRandomData(2, 1<<20)
+	edited := append(append(append([]byte{}, data[:1000]...), "inserted bytes"...), data[1000:]...)
+
+	ratio, _ := dedupRatio(splitter, [][]byte{data, edited})
+	if ratio < 1.95 {
+		t.Error(fmt.Sprintf("dedup ratio %f after a single insertion", ratio))
+	}
+}
+
+func Test_FastCDCParams(t *testing.T) {
+	bad := []FastCDCParams{
+		{MinSize: 4096, AvgSize: 2048, MaxSize: 8192, Normalization: 2},
+		{MinSize: 0, AvgSize: 8192, MaxSize: 4096, Normalization: 2},
+		{MinSize: 0, AvgSize: 4, MaxSize: 8, Normalization: 2},
+		{MinSize: 0, AvgSize: 8192, MaxSize: 65536, Normalization: -1},
+	}
+	for ii, params := range bad {
+		if _, err := NewFastCDCChunker(bytes.NewReader(nil), params); err == nil {
+			t.Error(fmt.Sprintf("case %d: expected an error", ii))
+		}
+	}
+}
+
+// Compares the dedup ratio and throughput of each strategy on the same
+// corpora.
+func Benchmark_Dedup(b *testing.B) {
+	for _, corpus := range makeCorpora() {
+		total := 0
+		for _, version := range corpus.versions {
+			total += len(version)
+		}
+		for _, strategy := range chunkingStrategies {
+			b.Run(corpus.name+"/"+strategy.name, func(b *testing.B) {
+				splitter, err := strategy.newFn()
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(total))
+				var ratio float64
+				var numChunks int
+				for ii := 0; ii < b.N; ii++ {
+					ratio, numChunks = dedupRatio(splitter, corpus.versions)
+				}
+				b.ReportMetric(ratio, "dedup-ratio")
+				b.ReportMetric(float64(total)/float64(numChunks), "B/chunk")
+			})
+		}
+	}
+}
+
+// Measures raw chunking throughput without fingerprinting chunks.
+func Benchmark_ChunkingThroughput(b *testing.B) {
+	data := makeRandomData(0, 16<<20)
+	for _, strategy := range chunkingStrategies {
+		b.Run(strategy.name, func(b *testing.B) {
+			splitter, err := strategy.newFn()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(data)))
+			for ii := 0; ii < b.N; ii++ {
+				c := NewChunkerWithSplitter(bytes.NewReader(data), splitter)
+				for {
+					if _, err := c.Next(); err == io.EOF {
+						break
+					}
+				}
+			}
+		})
+	}
+}
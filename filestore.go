@@ -0,0 +1,264 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Each chunk file begins with the magic, a version byte, the big-endian
+// data length and the big-endian 64-bit Rabin fingerprint of the data.
+const (
+	kChunkFileMagic      = "RBCK"
+	kChunkFileVersion    = 1
+	kChunkFileHeaderSize = len(kChunkFileMagic) + 1 + 8 + 8
+
+	kChunkTempPrefix = ".tmp-"
+	kStoreLockName   = "lock"
+)
+
+// A ChunkStore in a directory, which may be shared by several processes.
+// Chunks are sharded into subdirectories by the first byte of their ID.
+// Writes go to a temporary file that is renamed into place, so readers
+// never see partial chunks.  Where supported, operations hold an flock on
+// the store's lock file: shared for Put, Get and Has, and exclusive for
+// Delete, so that a Put that finds a chunk present cannot race with its
+// deletion.
+type FileStore struct {
+	dir string
+	// Serializes locking within the process, since flock locks belong to
+	// open files.
+	mu sync.RWMutex
+}
+
+// Opens the store in dir, creating it if necessary.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Returns the store's directory.
+func (s *FileStore) Dir() string {
+	return s.dir
+}
+
+func (s *FileStore) path(id ChunkID) string {
+	name := id.String()
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+// Locks the store and returns a function that unlocks it.
+func (s *FileStore) lock(exclusive bool) (func(), error) {
+	if exclusive {
+		s.mu.Lock()
+	} else {
+		s.mu.RLock()
+	}
+	unlockMu := func() {
+		if exclusive {
+			s.mu.Unlock()
+		} else {
+			s.mu.RUnlock()
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, kStoreLockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		unlockMu()
+		return nil, err
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		unlockMu()
+		return nil, err
+	}
+	return func() {
+		// Closing the file releases the flock.
+		f.Close()
+		unlockMu()
+	}, nil
+}
+
+// Stores data under id, unless id is already present.  A present chunk is
+// not checked; use Verify to find damaged chunks, and Delete them before
+// storing them again.
+func (s *FileStore) Put(id ChunkID, data []byte) error {
+	unlock, err := s.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := s.path(id)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	shard := filepath.Dir(path)
+	if err := os.MkdirAll(shard, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(shard, kChunkTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tempPath := f.Name()
+	header := make([]byte, 0, kChunkFileHeaderSize)
+	header = append(header, kChunkFileMagic...)
+	header = append(header, kChunkFileVersion)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(data)))
+	header = binary.BigEndian.AppendUint64(header, uint64(ChunkIDOf(data)))
+	if _, err = f.Write(header); err == nil {
+		if _, err = f.Write(data); err == nil {
+			err = f.Sync()
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+	}
+	return err
+}
+
+func (s *FileStore) Get(id ChunkID) ([]byte, error) {
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.read(id)
+}
+
+// Reads and verifies a chunk.  The store must be locked.
+func (s *FileStore) read(id ChunkID) ([]byte, error) {
+	b, err := os.ReadFile(s.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrChunkNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < kChunkFileHeaderSize {
+		return nil, &ChunkError{ID: id, Err: ErrChunkTruncated}
+	}
+	if !bytes.HasPrefix(b, []byte(kChunkFileMagic)) ||
+		b[len(kChunkFileMagic)] != kChunkFileVersion {
+		return nil, &ChunkError{ID: id, Err: ErrChunkCorrupt}
+	}
+	header := b[len(kChunkFileMagic)+1:]
+	length := binary.BigEndian.Uint64(header)
+	fingerprint := binary.BigEndian.Uint64(header[8:])
+	data := b[kChunkFileHeaderSize:]
+	if uint64(len(data)) < length {
+		return nil, &ChunkError{ID: id, Err: ErrChunkTruncated}
+	}
+	if uint64(len(data)) > length || uint64(ChunkIDOf(data)) != fingerprint {
+		return nil, &ChunkError{ID: id, Err: ErrChunkCorrupt}
+	}
+	return data, nil
+}
+
+func (s *FileStore) Has(id ChunkID) (bool, error) {
+	unlock, err := s.lock(false)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	_, err = os.Stat(s.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *FileStore) Delete(id ChunkID) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = os.Remove(s.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Calls fn for each chunk ID, in increasing order, and stops at the first
+// error, which is returned.  Files that are not chunks are ignored.
+func (s *FileStore) Walk(fn func(id ChunkID) error) error {
+	shards, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() || len(shard.Name()) != 2 {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.dir, shard.Name()))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasPrefix(name, kChunkTempPrefix) ||
+				!strings.HasPrefix(name, shard.Name()) {
+				continue
+			}
+			id, err := ParseChunkID(name)
+			if err != nil {
+				continue
+			}
+			if err := fn(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reads every chunk and returns those that are corrupt or truncated.  The
+// returned error reports failures other than damaged chunks.
+func (s *FileStore) Verify() ([]ChunkError, error) {
+	var bad []ChunkError
+	err := s.Walk(func(id ChunkID) error {
+		unlock, err := s.lock(false)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		_, err = s.read(id)
+		var chunkErr *ChunkError
+		switch {
+		case errors.As(err, &chunkErr):
+			bad = append(bad, *chunkErr)
+		case errors.Is(err, ErrChunkNotFound):
+			// Deleted since the walk began.
+		case err != nil:
+			return err
+		}
+		return nil
+	})
+	return bad, err
+}
@@ -0,0 +1,16 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package rabin
+
+import (
+	"os"
+)
+
+// Without flock, a FileStore is only locked within the process.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func Test_FileStore(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testChunkStore(t, store)
+
+	// Each chunk is stored exactly once, with no leftover temporary files.
+	ids := map[ChunkID]bool{}
+	if err := store.Walk(func(id ChunkID) error {
+		ids[id] = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(store.Dir(), "*", "*"))
+	if len(files) != len(ids) {
+		t.Error(fmt.Sprintf("%d files for %d chunks", len(files), len(ids)))
+	}
+	for _, file := range files {
+		if filepath.Base(file)[:2] != filepath.Base(filepath.Dir(file)) {
+			t.Error(fmt.Sprintf("%s is in the wrong shard", file))
+		}
+	}
+
+	bad, err := store.Verify()
+	if err != nil || len(bad) != 0 {
+		t.Error(fmt.Sprintf("Verify = %v, %v", bad, err))
+	}
+}
+
+func Test_FileStoreVerify(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeRandomData(1, 3*1000)
+	good, corrupt, truncated := ChunkIDOf(data[:1000]), ChunkIDOf(data[1000:2000]),
+		ChunkIDOf(data[2000:])
+	store.Put(good, data[:1000])
+	store.Put(corrupt, data[1000:2000])
+	store.Put(truncated, data[2000:])
+
+	// Flip a bit in one chunk and cut another short.
+	path := store.path(corrupt)
+	b, _ := os.ReadFile(path)
+	b[len(b)-1] ^= 1
+	os.WriteFile(path, b, 0644)
+	path = store.path(truncated)
+	b, _ = os.ReadFile(path)
+	os.WriteFile(path, b[:len(b)-1], 0644)
+
+	if _, err := store.Get(good); err != nil {
+		t.Error(err)
+	}
+	if _, err := store.Get(corrupt); !errors.Is(err, ErrChunkCorrupt) {
+		t.Error(fmt.Sprintf("corrupt chunk: %v", err))
+	}
+	if _, err := store.Get(truncated); !errors.Is(err, ErrChunkTruncated) {
+		t.Error(fmt.Sprintf("truncated chunk: %v", err))
+	}
+
+	bad, err := store.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != 2 {
+		t.Fatal(fmt.Sprintf("Verify found %d bad chunks", len(bad)))
+	}
+	for _, chunkErr := range bad {
+		want := ErrChunkCorrupt
+		if chunkErr.ID == truncated {
+			want = ErrChunkTruncated
+		}
+		if !errors.Is(&chunkErr, want) {
+			t.Error(fmt.Sprintf("%v, expected %v", &chunkErr, want))
+		}
+	}
+
+	// A damaged chunk can be replaced.
+	store.Delete(corrupt)
+	store.Put(corrupt, data[1000:2000])
+	if _, err := store.Get(corrupt); err != nil {
+		t.Error(err)
+	}
+}
+
+// Two handles on one directory behave like two processes.
+func Test_FileStoreShared(t *testing.T) {
+	dir := t.TempDir()
+	stores := make([]*FileStore, 2)
+	for ii := range stores {
+		var err error
+		if stores[ii], err = NewFileStore(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := makeRandomData(2, 100*100)
+	var wg sync.WaitGroup
+	for ii, store := range stores {
+		wg.Add(1)
+		go func(ii int, store *FileStore) {
+			defer wg.Done()
+			for jj := 0; jj < 100; jj++ {
+				chunk := data[jj*100 : (jj+1)*100]
+				id := ChunkIDOf(chunk)
+				if err := store.Put(id, chunk); err != nil {
+					t.Error(err)
+				}
+				if ii == 1 && jj%2 == 0 {
+					if err := store.Delete(id); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(ii, store)
+	}
+	wg.Wait()
+
+	bad, err := stores[0].Verify()
+	if err != nil || len(bad) != 0 {
+		t.Error(fmt.Sprintf("Verify = %v, %v", bad, err))
+	}
+}
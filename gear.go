@@ -0,0 +1,76 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+// Byte substitution table for Gear.
+var kGearTable *[256]uint64
+
+func init() {
+	kGearTable = makeRandomTable(0x67656172)
+}
+
+// Gear rolling hash.  For data b_1 ... b_n, the hash is
+//
+//	(G[b_1] << (n-1)) + (G[b_2] << (n-2)) + ... + G[b_n]  (mod 2^64)
+//
+// where G is a fixed substitution table.  Bytes older than 64 positions
+// are shifted out entirely, so windows of at least 64 bytes need no
+// explicit removal.
+type gear struct {
+	h          uint64
+	windowSize int
+}
+
+// Returns a Gear RollingHash over windows of windowSize bytes.
+func NewGear(windowSize int) RollingHash {
+	return &gear{windowSize: windowSize}
+}
+
+func (d *gear) BlockSize() int {
+	return 1
+}
+
+func (d *gear) Reset() {
+	d.h = 0
+}
+
+func (d *gear) Roll(oldData, newData []byte) (int, error) {
+	if len(oldData) != len(newData) {
+		return 0, ErrWindowMismatch
+	}
+
+	h := d.h
+	// Shifts of 64 or more yield 0, which is exactly the contribution of
+	// a byte that has left a large window.
+	shift := uint(d.windowSize)
+	for ii, b := range newData {
+		h = (h << 1) + kGearTable[b] - (kGearTable[oldData[ii]] << shift)
+	}
+	d.h = h
+
+	return len(newData), nil
+}
+
+func (d *gear) Size() int {
+	return kNumBytes
+}
+
+func (d *gear) Sum(b []byte) []byte {
+	return appendUint64(b, d.h)
+}
+
+func (d *gear) Sum64() uint64 {
+	return d.h
+}
+
+func (d *gear) Write(p []byte) (n int, err error) {
+	h := d.h
+	for _, b := range p {
+		h = (h << 1) + kGearTable[b]
+	}
+	d.h = h
+
+	return len(p), nil
+}
@@ -0,0 +1,16 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package rabin
+
+import (
+	"io/fs"
+)
+
+// Inode numbers are not available, so only sizes and times detect changes.
+func fileInode(info fs.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,235 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// Returned (wrapped) when a manifest is malformed.
+	ErrInvalidManifest = errors.New("rabin: invalid manifest")
+	// Returned (wrapped) when reassembled data does not match a manifest.
+	ErrFingerprintMismatch = errors.New("rabin: fingerprint mismatch")
+)
+
+const (
+	kManifestMagic   = "RBMF"
+	kManifestVersion = 1
+)
+
+// The cut parameters that produced a manifest.
+type ManifestParams struct {
+	WindowSize int    `json:"window"`
+	Mask       uint64 `json:"mask,string"`
+	Target     uint64 `json:"target,string"`
+	MinSize    int    `json:"min"`
+	MaxSize    int    `json:"max"`
+	// The coefficients of the degree-64 polynomial, without x^64.
+	Polynomial uint64 `json:"polynomial,string"`
+}
+
+// Returns the ChunkerParams that p describes.
+func (p ManifestParams) ChunkerParams() ChunkerParams {
+	params := ChunkerParams{
+		MinSize:    p.MinSize,
+		AvgSize:    int(p.Mask + 1),
+		MaxSize:    p.MaxSize,
+		WindowSize: p.WindowSize,
+		Target:     p.Target,
+	}
+	if p.Polynomial != kIrreduciblePolyCoeffs {
+		params.Polynomial = NewPolynomialFromUint64(kIrreduciblePolyDegree, p.Polynomial)
+	}
+	return params
+}
+
+type ManifestChunk struct {
+	ID     ChunkID `json:"id"`
+	Length int     `json:"length"`
+}
+
+// Describes a file as a sequence of content-defined chunks.  A Manifest
+// encodes to JSON with encoding/json, and to a compact binary form with
+// MarshalBinary.
+type Manifest struct {
+	Version int            `json:"version"`
+	Params  ManifestParams `json:"params"`
+	Size    int64          `json:"size"`
+	// The New64 fingerprint of the whole file.
+	Fingerprint uint64          `json:"fingerprint,string"`
+	Chunks      []ManifestChunk `json:"chunks"`
+}
+
+// Splits r into chunks according to params and returns its manifest.
+func ChunkFile(r io.Reader, params ChunkerParams) (*Manifest, error) {
+	return ChunkFileFunc(r, params, nil)
+}
+
+// Like ChunkFile, but also calls fn, if non-nil, with each chunk, e.g., to
+// store it.  data is only valid during the call.  An error from fn stops
+// chunking and is returned.
+func ChunkFileFunc(r io.Reader, params ChunkerParams, fn func(id ChunkID, data []byte) error) (*Manifest, error) {
+	c, err := NewChunker(r, params)
+	if err != nil {
+		return nil, err
+	}
+	coeffs := uint64(kIrreduciblePolyCoeffs)
+	if params.Polynomial != nil {
+		// The chunker has already checked the degree.
+		coeffs, _ = polynomialCoeffs(params.Polynomial)
+	}
+	mask := params.Mask()
+	m := &Manifest{
+		Version: kManifestVersion,
+		Params: ManifestParams{
+			WindowSize: params.WindowSize,
+			Mask:       mask,
+			Target:     params.Target & mask,
+			MinSize:    params.MinSize,
+			MaxSize:    params.MaxSize,
+			Polynomial: coeffs,
+		},
+		Chunks: []ManifestChunk{},
+	}
+
+	hash := New64()
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		id := ChunkIDOf(chunk.Data)
+		if fn != nil {
+			if err := fn(id, chunk.Data); err != nil {
+				return nil, err
+			}
+		}
+		hash.Write(chunk.Data)
+		m.Size += int64(chunk.Length)
+		m.Chunks = append(m.Chunks, ManifestChunk{ID: id, Length: chunk.Length})
+	}
+	m.Fingerprint = hash.Sum64()
+	return m, nil
+}
+
+// Writes the file described by m to w, fetching each chunk with fetch.
+// Each chunk is checked against its ID and length, and the whole file
+// against m.Fingerprint, once it has been written.
+func Reassemble(m *Manifest, fetch func(id ChunkID) ([]byte, error), w io.Writer) error {
+	if m.Version != kManifestVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidManifest, m.Version)
+	}
+	hash := New64()
+	size := int64(0)
+	for _, chunk := range m.Chunks {
+		data, err := fetch(chunk.ID)
+		if err != nil {
+			return err
+		}
+		if len(data) != chunk.Length || ChunkIDOf(data) != chunk.ID {
+			return &ChunkError{ID: chunk.ID, Err: ErrChunkCorrupt}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		hash.Write(data)
+		size += int64(len(data))
+	}
+	if size != m.Size || hash.Sum64() != m.Fingerprint {
+		return fmt.Errorf("%w: file of %d bytes", ErrFingerprintMismatch, size)
+	}
+	return nil
+}
+
+func (m *Manifest) MarshalBinary() ([]byte, error) {
+	b := []byte(kManifestMagic)
+	b = append(b, byte(m.Version))
+
+	p := &m.Params
+	b = binary.AppendUvarint(b, uint64(p.WindowSize))
+	b = binary.BigEndian.AppendUint64(b, p.Mask)
+	b = binary.BigEndian.AppendUint64(b, p.Target)
+	b = binary.AppendUvarint(b, uint64(p.MinSize))
+	b = binary.AppendUvarint(b, uint64(p.MaxSize))
+	b = binary.BigEndian.AppendUint64(b, p.Polynomial)
+
+	b = binary.AppendUvarint(b, uint64(m.Size))
+	b = binary.BigEndian.AppendUint64(b, m.Fingerprint)
+	b = binary.AppendUvarint(b, uint64(len(m.Chunks)))
+	for _, chunk := range m.Chunks {
+		b = binary.BigEndian.AppendUint64(b, uint64(chunk.ID))
+		b = binary.AppendUvarint(b, uint64(chunk.Length))
+	}
+	return b, nil
+}
+
+func (m *Manifest) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(kManifestMagic)+1)
+	if _, err := io.ReadFull(r, magic); err != nil ||
+		string(magic[:len(kManifestMagic)]) != kManifestMagic {
+		return fmt.Errorf("%w: bad magic", ErrInvalidManifest)
+	}
+	if version := magic[len(kManifestMagic)]; version != kManifestVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidManifest, version)
+	}
+
+	var err error
+	readUvarint := func() uint64 {
+		var v uint64
+		if err == nil {
+			v, err = binary.ReadUvarint(r)
+		}
+		return v
+	}
+	readUint64 := func() uint64 {
+		var v uint64
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, &v)
+		}
+		return v
+	}
+
+	manifest := Manifest{Version: kManifestVersion}
+	p := &manifest.Params
+	p.WindowSize = int(readUvarint())
+	p.Mask = readUint64()
+	p.Target = readUint64()
+	p.MinSize = int(readUvarint())
+	p.MaxSize = int(readUvarint())
+	p.Polynomial = readUint64()
+	manifest.Size = int64(readUvarint())
+	manifest.Fingerprint = readUint64()
+
+	count := readUvarint()
+	// Each chunk takes at least 9 bytes.
+	if err == nil && count > uint64(r.Len()/9) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		manifest.Chunks = make([]ManifestChunk, count)
+		for ii := range manifest.Chunks {
+			manifest.Chunks[ii].ID = ChunkID(readUint64())
+			manifest.Chunks[ii].Length = int(readUvarint())
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: trailing data", ErrInvalidManifest)
+	}
+
+	*m = manifest
+	return nil
+}
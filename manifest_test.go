@@ -0,0 +1,163 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func Test_ChunkFile(t *testing.T) {
+	data := makeRandomData(0, 1<<20)
+	store := NewMemoryStore()
+	params := DefaultChunkerParams()
+	m, err := ChunkFileFunc(bytes.NewReader(data), params, store.Put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != int64(len(data)) || m.Fingerprint != fingerprint64(data) {
+		t.Error(fmt.Sprintf("size %d, fingerprint 0x%x", m.Size, m.Fingerprint))
+	}
+
+	chunks := chunkAll(t, bytes.NewReader(data), params)
+	if len(chunks) != len(m.Chunks) {
+		t.Fatal(fmt.Sprintf("%d chunks, expected %d", len(m.Chunks), len(chunks)))
+	}
+	for ii, chunk := range chunks {
+		if m.Chunks[ii].ID != ChunkIDOf(chunk.Data) || m.Chunks[ii].Length != chunk.Length {
+			t.Error(fmt.Sprintf("chunk %d: %+v", ii, m.Chunks[ii]))
+		}
+	}
+	// Only the masked target is recorded.
+	cmp := params
+	cmp.Target &= params.Mask()
+	if !reflect.DeepEqual(m.Params.ChunkerParams(), cmp) {
+		t.Error(fmt.Sprintf("params %+v", m.Params.ChunkerParams()))
+	}
+
+	out := new(bytes.Buffer)
+	if err := Reassemble(m, store.Get, out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("reassembled data differs")
+	}
+
+	// Without fn.
+	m2, err := ChunkFile(bytes.NewReader(data), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Error("ChunkFile and ChunkFileFunc differ")
+	}
+
+	// Empty files.
+	m, err = ChunkFile(bytes.NewReader(nil), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := Reassemble(m, store.Get, out); err != nil || out.Len() != 0 {
+		t.Error(fmt.Sprintf("empty file: %d bytes, %v", out.Len(), err))
+	}
+}
+
+func Test_ManifestEncoding(t *testing.T) {
+	params := DefaultChunkerParams()
+	params.Polynomial = FindIrreducible(64)
+	data := makeRandomData(1, 256*1024)
+	m, err := ChunkFile(bytes.NewReader(data), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromBinary Manifest
+	if err := fromBinary.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&fromBinary, m) {
+		t.Error("binary round trip differs")
+	}
+
+	b, err = json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON Manifest
+	if err := json.Unmarshal(b, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&fromJSON, m) {
+		t.Error("JSON round trip differs")
+	}
+
+	// The recorded parameters reproduce the chunks.
+	m2, err := ChunkFile(bytes.NewReader(data), fromJSON.Params.ChunkerParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m2, m) {
+		t.Error("rechunking with recorded params differs")
+	}
+
+	b, _ = m.MarshalBinary()
+	for _, bad := range [][]byte{nil, []byte("RBMF"), b[:len(b)-1], append(b, 0)} {
+		if err := new(Manifest).UnmarshalBinary(bad); !errors.Is(err, ErrInvalidManifest) {
+			t.Error(fmt.Sprintf("%d bytes: %v", len(bad), err))
+		}
+	}
+}
+
+func Test_ReassembleErrors(t *testing.T) {
+	data := makeRandomData(2, 100000)
+	store := NewMemoryStore()
+	m, err := ChunkFileFunc(bytes.NewReader(data), DefaultChunkerParams(), store.Put)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A chunk that does not match its ID.
+	bad := m.Chunks[1].ID
+	fetch := func(id ChunkID) ([]byte, error) {
+		data, err := store.Get(id)
+		if id == bad {
+			data[0] ^= 1
+		}
+		return data, err
+	}
+	if err := Reassemble(m, fetch, new(bytes.Buffer)); !errors.Is(err, ErrChunkCorrupt) {
+		t.Error(fmt.Sprintf("corrupt chunk: %v", err))
+	}
+
+	// A missing chunk.
+	store.Delete(bad)
+	if err := Reassemble(m, store.Get, new(bytes.Buffer)); !errors.Is(err, ErrChunkNotFound) {
+		t.Error(fmt.Sprintf("missing chunk: %v", err))
+	}
+
+	// A wrong file fingerprint.
+	m, _ = ChunkFileFunc(bytes.NewReader(data), DefaultChunkerParams(), store.Put)
+	m.Fingerprint ^= 1
+	if err := Reassemble(m, store.Get, new(bytes.Buffer)); !errors.Is(err, ErrFingerprintMismatch) {
+		t.Error(fmt.Sprintf("wrong fingerprint: %v", err))
+	}
+
+	// Errors from fn stop chunking.
+	errStop := errors.New("stop")
+	_, err = ChunkFileFunc(bytes.NewReader(data), DefaultChunkerParams(),
+		func(id ChunkID, data []byte) error { return errStop })
+	if err != errStop {
+		t.Error(fmt.Sprintf("fn error: %v", err))
+	}
+}
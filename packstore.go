@@ -0,0 +1,497 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Returned (wrapped) when a pack file is malformed.
+var ErrInvalidPack = errors.New("rabin: invalid pack")
+
+// A pack file holds blobs back to back, followed by a flate-compressed
+// index and a fixed-size footer:
+//
+//	blobs | index | index length (8) | version (1) | flags (1) | magic (4)
+//
+// The index holds a uvarint count and, for each blob, its ID, offset,
+// stored length, length and 64-bit Rabin fingerprint.
+const (
+	kPackMagic      = "RBPK"
+	kPackVersion    = 1
+	kPackFooterSize = 8 + 1 + 1 + len(kPackMagic)
+	kPackExt        = ".pack"
+	kPackTempExt    = ".tmp"
+
+	// Blobs are flate-compressed.
+	kPackFlagCompressed = 1
+
+	kDefaultPackSize = 16 << 20
+)
+
+// Options for NewPackStore.
+type PackParams struct {
+	// A pack is finished once it holds at least this many bytes.
+	// Defaults to 16MB.
+	PackSize int64
+
+	// Whether to compress blobs with compress/flate.
+	Compress bool
+}
+
+type packEntry struct {
+	id          ChunkID
+	offset      int64
+	storedLen   int64
+	length      int64
+	fingerprint uint64
+}
+
+type packLocation struct {
+	pack  int
+	entry packEntry
+}
+
+type packFile struct {
+	f          *os.File
+	compressed bool
+	entries    []packEntry
+}
+
+// A ChunkStore that appends blobs to pack files in a directory, which
+// suits many small chunks better than a FileStore.  Each pack carries its
+// own index, from which the in-memory index is rebuilt when the store is
+// opened.  Blobs become durable once their pack is finished, either by
+// filling up or by Flush or Close; unfinished packs are discarded when a
+// store is opened.  Deleted blobs are only reclaimed by Repack.
+//
+// A PackStore is safe for concurrent use, but a directory must only be
+// opened by one PackStore at a time.
+type PackStore struct {
+	dir    string
+	params PackParams
+
+	mu    sync.Mutex
+	index map[ChunkID]packLocation
+	packs map[int]*packFile
+
+	// The pack being written, or nil.
+	current     *packFile
+	currentID   int
+	currentSize int64
+	nextID      int
+}
+
+// Opens the pack store in dir, creating it if necessary, and rebuilds its
+// index from the pack trailers.
+func NewPackStore(dir string, params PackParams) (*PackStore, error) {
+	if params.PackSize <= 0 {
+		params.PackSize = kDefaultPackSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &PackStore{
+		dir:    dir,
+		params: params,
+		index:  make(map[ChunkID]packLocation),
+		packs:  make(map[int]*packFile),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, kPackTempExt) {
+			// Unfinished.
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, kPackExt))
+		if err != nil || !strings.HasSuffix(name, kPackExt) {
+			continue
+		}
+		pack, err := openPack(filepath.Join(dir, name))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.packs[id] = pack
+		for _, e := range pack.entries {
+			s.index[e.id] = packLocation{pack: id, entry: e}
+		}
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	return s, nil
+}
+
+func (s *PackStore) packPath(id int, ext string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d%s", id, ext))
+}
+
+// Opens a finished pack and reads its index.
+func openPack(path string) (*packFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	pack, err := readPackIndex(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return pack, nil
+}
+
+func readPackIndex(f *os.File) (*packFile, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < int64(kPackFooterSize) {
+		return nil, fmt.Errorf("%w: short file", ErrInvalidPack)
+	}
+	footer := make([]byte, kPackFooterSize)
+	if _, err := f.ReadAt(footer, size-int64(kPackFooterSize)); err != nil {
+		return nil, err
+	}
+	if string(footer[10:]) != kPackMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidPack)
+	}
+	if footer[8] != kPackVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidPack, footer[8])
+	}
+	indexLen := binary.BigEndian.Uint64(footer)
+	indexEnd := size - int64(kPackFooterSize)
+	if indexLen > uint64(indexEnd) {
+		return nil, fmt.Errorf("%w: index length %d", ErrInvalidPack, indexLen)
+	}
+	indexStart := indexEnd - int64(indexLen)
+
+	zr := flate.NewReader(io.NewSectionReader(f, indexStart, int64(indexLen)))
+	defer zr.Close()
+	index, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPack, err)
+	}
+
+	r := bytes.NewReader(index)
+	readUvarint := func() int64 {
+		var v uint64
+		if err == nil {
+			v, err = binary.ReadUvarint(r)
+		}
+		return int64(v)
+	}
+	readUint64 := func() uint64 {
+		var v uint64
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, &v)
+		}
+		return v
+	}
+	count := readUvarint()
+	pack := &packFile{f: f, compressed: footer[9]&kPackFlagCompressed != 0}
+	for ii := int64(0); ii < count && err == nil; ii++ {
+		e := packEntry{id: ChunkID(readUint64())}
+		e.offset = readUvarint()
+		e.storedLen = readUvarint()
+		e.length = readUvarint()
+		e.fingerprint = readUint64()
+		if err == nil && (e.offset+e.storedLen > indexStart || e.storedLen < 0) {
+			err = fmt.Errorf("blob %s out of range", e.id)
+		}
+		pack.entries = append(pack.entries, e)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPack, err)
+	}
+	return pack, nil
+}
+
+func (s *PackStore) Put(id ChunkID, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.index[id]; ok {
+		return nil
+	}
+	return s.put(id, data)
+}
+
+// Appends a blob to the current pack.  s.mu must be held.
+func (s *PackStore) put(id ChunkID, data []byte) error {
+	if s.current == nil {
+		f, err := os.OpenFile(s.packPath(s.nextID, kPackTempExt),
+			os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		s.current = &packFile{f: f, compressed: s.params.Compress}
+		s.currentID = s.nextID
+		s.currentSize = 0
+		s.nextID++
+		s.packs[s.currentID] = s.current
+	}
+
+	stored := data
+	if s.params.Compress {
+		buff := new(bytes.Buffer)
+		zw, _ := flate.NewWriter(buff, flate.DefaultCompression)
+		zw.Write(data)
+		zw.Close()
+		stored = buff.Bytes()
+	}
+	if _, err := s.current.f.WriteAt(stored, s.currentSize); err != nil {
+		return err
+	}
+	e := packEntry{
+		id:          id,
+		offset:      s.currentSize,
+		storedLen:   int64(len(stored)),
+		length:      int64(len(data)),
+		fingerprint: uint64(ChunkIDOf(data)),
+	}
+	s.current.entries = append(s.current.entries, e)
+	s.index[id] = packLocation{pack: s.currentID, entry: e}
+	s.currentSize += e.storedLen
+
+	if s.currentSize >= s.params.PackSize {
+		return s.finish()
+	}
+	return nil
+}
+
+// Writes the index of the current pack and renames it into place.  s.mu
+// must be held.
+func (s *PackStore) finish() error {
+	pack := s.current
+	if pack == nil {
+		return nil
+	}
+	s.current = nil
+
+	var index []byte
+	index = binary.AppendUvarint(index, uint64(len(pack.entries)))
+	for _, e := range pack.entries {
+		index = binary.BigEndian.AppendUint64(index, uint64(e.id))
+		index = binary.AppendUvarint(index, uint64(e.offset))
+		index = binary.AppendUvarint(index, uint64(e.storedLen))
+		index = binary.AppendUvarint(index, uint64(e.length))
+		index = binary.BigEndian.AppendUint64(index, e.fingerprint)
+	}
+	trailer := new(bytes.Buffer)
+	zw, _ := flate.NewWriter(trailer, flate.BestCompression)
+	zw.Write(index)
+	zw.Close()
+	indexLen := trailer.Len()
+
+	var flags byte
+	if pack.compressed {
+		flags |= kPackFlagCompressed
+	}
+	footer := binary.BigEndian.AppendUint64(nil, uint64(indexLen))
+	footer = append(footer, kPackVersion, flags)
+	footer = append(footer, kPackMagic...)
+	trailer.Write(footer)
+
+	_, err := pack.f.WriteAt(trailer.Bytes(), s.currentSize)
+	if err == nil {
+		err = pack.f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(s.packPath(s.currentID, kPackTempExt),
+			s.packPath(s.currentID, kPackExt))
+	}
+	if err != nil {
+		// Forget the pack's blobs.
+		s.dropPack(s.currentID)
+		os.Remove(s.packPath(s.currentID, kPackTempExt))
+	}
+	return err
+}
+
+// Whether the index refers to pack for id.  s.mu must be held.
+func (s *PackStore) indexed(pack int, id ChunkID) bool {
+	loc, ok := s.index[id]
+	return ok && loc.pack == pack
+}
+
+// Closes a pack and removes its blobs from the index.  s.mu must be held.
+func (s *PackStore) dropPack(id int) {
+	pack := s.packs[id]
+	pack.f.Close()
+	delete(s.packs, id)
+	for _, e := range pack.entries {
+		if s.indexed(id, e.id) {
+			delete(s.index, e.id)
+		}
+	}
+}
+
+// Finishes the current pack, if any, so that its blobs are durable.
+func (s *PackStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.finish()
+}
+
+// Flushes the store and closes its packs.
+func (s *PackStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.finish()
+	for id, pack := range s.packs {
+		pack.f.Close()
+		delete(s.packs, id)
+	}
+	s.index = make(map[ChunkID]packLocation)
+	return err
+}
+
+func (s *PackStore) Get(id ChunkID) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loc, ok := s.index[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrChunkNotFound, id)
+	}
+	return s.read(s.packs[loc.pack], loc.entry)
+}
+
+// Reads and verifies a blob.  s.mu must be held.
+func (s *PackStore) read(pack *packFile, e packEntry) ([]byte, error) {
+	stored := make([]byte, e.storedLen)
+	if _, err := pack.f.ReadAt(stored, e.offset); err != nil {
+		return nil, err
+	}
+	data := stored
+	if pack.compressed {
+		zr := flate.NewReader(bytes.NewReader(stored))
+		var err error
+		data, err = io.ReadAll(io.LimitReader(zr, e.length+1))
+		zr.Close()
+		if err != nil {
+			return nil, &ChunkError{ID: e.id, Err: ErrChunkCorrupt}
+		}
+	}
+	if int64(len(data)) < e.length {
+		return nil, &ChunkError{ID: e.id, Err: ErrChunkTruncated}
+	}
+	if int64(len(data)) != e.length || uint64(ChunkIDOf(data)) != e.fingerprint {
+		return nil, &ChunkError{ID: e.id, Err: ErrChunkCorrupt}
+	}
+	return data, nil
+}
+
+func (s *PackStore) Has(id ChunkID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.index[id]
+	return ok, nil
+}
+
+// Deletes a blob by repacking the pack that holds it.
+func (s *PackStore) Delete(id ChunkID) error {
+	if ok, _ := s.Has(id); !ok {
+		return nil
+	}
+	return s.Repack(func(other ChunkID) bool {
+		return other == id
+	})
+}
+
+// Calls fn for each blob ID in increasing order and stops at the first
+// error, which is returned.
+func (s *PackStore) Walk(fn func(id ChunkID) error) error {
+	s.mu.Lock()
+	ids := make([]ChunkID, 0, len(s.index))
+	for id := range s.index {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(ids, func(ii, jj int) bool { return ids[ii] < ids[jj] })
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrites every pack that holds a blob for which unreferenced returns
+// true, keeping only the other blobs, and finishes the current pack.
+// Blobs that are stored more than once are also reduced to one copy.
+func (s *PackStore) Repack(unreferenced func(id ChunkID) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.finish(); err != nil {
+		return err
+	}
+
+	ids := make([]int, 0, len(s.packs))
+	for id := range s.packs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var stale []int
+	for _, id := range ids {
+		pack := s.packs[id]
+		for _, e := range pack.entries {
+			if !s.indexed(id, e.id) || unreferenced(e.id) {
+				stale = append(stale, id)
+				break
+			}
+		}
+	}
+
+	for _, id := range stale {
+		pack := s.packs[id]
+		for _, e := range pack.entries {
+			if !s.indexed(id, e.id) {
+				continue
+			}
+			if unreferenced(e.id) {
+				delete(s.index, e.id)
+				continue
+			}
+			data, err := s.read(pack, e)
+			if err != nil {
+				return err
+			}
+			if err := s.put(e.id, data); err != nil {
+				return err
+			}
+		}
+	}
+	// The copies must be durable before the originals are removed.
+	if err := s.finish(); err != nil {
+		return err
+	}
+	for _, id := range stale {
+		s.dropPack(id)
+		if err := os.Remove(s.packPath(id, kPackExt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
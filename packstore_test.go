@@ -0,0 +1,201 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns the total size of the packs in dir.
+func packBytes(t *testing.T, dir string) int64 {
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+kPackExt))
+	total := int64(0)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+	}
+	return total
+}
+
+func Test_PackStore(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		params := PackParams{PackSize: 256 * 1024, Compress: compress}
+		store, err := NewPackStore(dir, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testChunkStore(t, store)
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The index is rebuilt from the pack trailers.
+		data := makeRandomData(0, 1<<20)
+		chunks := chunkAll(t, bytes.NewReader(data), DefaultChunkerParams())
+		store, err = NewPackStore(dir, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ii, chunk := range chunks {
+			got, err := store.Get(ChunkIDOf(chunk.Data))
+			if ii == 0 {
+				// Deleted by testChunkStore.
+				if !errors.Is(err, ErrChunkNotFound) {
+					t.Error(fmt.Sprintf("compress %v: deleted chunk: %v", compress, err))
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(got, chunk.Data) {
+				t.Error(fmt.Sprintf("compress %v: chunk %d: %v", compress, ii, err))
+			}
+		}
+		store.Close()
+	}
+}
+
+func Test_PackStoreCompression(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	text := makeText(r, 1<<20)
+	sizes := make([]int64, 2)
+	for ii, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		store, err := NewPackStore(dir, PackParams{Compress: compress})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for offset := 0; offset < len(text); offset += 8192 {
+			blob := text[offset : offset+8192]
+			store.Put(ChunkIDOf(blob), blob)
+		}
+		store.Close()
+		sizes[ii] = packBytes(t, dir)
+	}
+	if sizes[1] >= sizes[0]*3/4 {
+		t.Error(fmt.Sprintf("compressed %d bytes to %d", sizes[0], sizes[1]))
+	}
+}
+
+func Test_PackStoreUnfinished(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewPackStore(dir, PackParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushed, unflushed := []byte("flushed"), []byte("unflushed")
+	store.Put(ChunkIDOf(flushed), flushed)
+	store.Flush()
+	store.Put(ChunkIDOf(unflushed), unflushed)
+	if ok, _ := store.Has(ChunkIDOf(unflushed)); !ok {
+		t.Error("unflushed blob missing before restart")
+	}
+
+	// Reopening without Close simulates a crash.
+	restarted, err := NewPackStore(dir, PackParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if ok, _ := restarted.Has(ChunkIDOf(flushed)); !ok {
+		t.Error("flushed blob lost")
+	}
+	if ok, _ := restarted.Has(ChunkIDOf(unflushed)); ok {
+		t.Error("unflushed blob survived")
+	}
+	store.Close()
+}
+
+func Test_PackStoreRepack(t *testing.T) {
+	dir := t.TempDir()
+	params := PackParams{PackSize: 64 * 1024}
+	store, err := NewPackStore(dir, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeRandomData(2, 1<<20)
+	var ids []ChunkID
+	for offset := 0; offset < len(data); offset += 4096 {
+		blob := data[offset : offset+4096]
+		ids = append(ids, ChunkIDOf(blob))
+		store.Put(ids[len(ids)-1], blob)
+	}
+	store.Flush()
+	before := packBytes(t, dir)
+
+	dropped := map[ChunkID]bool{}
+	for ii := 0; ii < len(ids); ii += 2 {
+		dropped[ids[ii]] = true
+	}
+	if err := store.Repack(func(id ChunkID) bool { return dropped[id] }); err != nil {
+		t.Fatal(err)
+	}
+	after := packBytes(t, dir)
+	if after > before/2+before/10 {
+		t.Error(fmt.Sprintf("repack shrank %d bytes to %d", before, after))
+	}
+	store.Close()
+
+	store, err = NewPackStore(dir, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for ii, id := range ids {
+		got, err := store.Get(id)
+		if dropped[id] {
+			if !errors.Is(err, ErrChunkNotFound) {
+				t.Error(fmt.Sprintf("dropped blob %d: %v", ii, err))
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, data[ii*4096:(ii+1)*4096]) {
+			t.Error(fmt.Sprintf("blob %d: %v", ii, err))
+		}
+	}
+}
+
+func Test_PackStoreCorruption(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewPackStore(dir, PackParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := makeRandomData(3, 1000)
+	id := ChunkIDOf(blob)
+	store.Put(id, blob)
+	store.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+kPackExt))
+	if len(files) != 1 {
+		t.Fatal(fmt.Sprintf("%d packs", len(files)))
+	}
+	b, _ := os.ReadFile(files[0])
+	b[10] ^= 1
+	os.WriteFile(files[0], b, 0644)
+
+	store, err = NewPackStore(dir, PackParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(id); !errors.Is(err, ErrChunkCorrupt) {
+		t.Error(fmt.Sprintf("corrupt blob: %v", err))
+	}
+	store.Close()
+
+	// A damaged trailer.
+	os.WriteFile(files[0], b[:len(b)-1], 0644)
+	if _, err := NewPackStore(dir, PackParams{}); !errors.Is(err, ErrInvalidPack) {
+		t.Error(fmt.Sprintf("damaged trailer: %v", err))
+	}
+}
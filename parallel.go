@@ -0,0 +1,154 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"io"
+	"runtime"
+	"sync"
+)
+
+// The default segment size for ChunkParallel.
+const kDefaultSegmentSize = 16 << 20
+
+// Options for ChunkParallel.
+type ParallelParams struct {
+	// The input is split into segments of this many bytes, which are
+	// chunked concurrently.  This should be much larger than the maximum
+	// chunk size.  Defaults to 16MB.
+	SegmentSize int64
+
+	// The number of concurrent goroutines.  Defaults to GOMAXPROCS.
+	Workers int
+}
+
+// Chunks the first size bytes of r concurrently and returns the same chunks
+// (without Data) as a sequential Chunker would.
+//
+// Each segment is chunked speculatively, on its own goroutine, as if a
+// chunk began at the segment's start.  The segments are then stitched
+// together in order: starting from the last sequential boundary before a
+// seam, chunks are recomputed until one begins where a speculative chunk
+// of the next segment begins.  Since a Splitter only looks at data from
+// the start of a chunk, the sequential and speculative chunkings agree
+// from there on.  On typical data, this happens within a few chunks of
+// the seam.
+//
+// newSplitter is called once per goroutine.
+func ChunkParallel(r io.ReaderAt, size int64, newSplitter func() (Splitter, error), params ParallelParams) ([]Chunk, error) {
+	segmentSize := params.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = kDefaultSegmentSize
+	}
+	workers := params.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	numSegments := int((size + segmentSize - 1) / segmentSize)
+	speculative := make([][]Chunk, numSegments)
+	errs := make([]error, numSegments)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for ii := 0; ii < numSegments; ii++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ii int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := int64(ii) * segmentSize
+			speculative[ii], errs[ii] = chunkSegment(r, size, start,
+				start+segmentSize, newSplitter)
+		}(ii)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if numSegments == 0 {
+		return []Chunk{}, nil
+	}
+
+	splitter, err := newSplitter()
+	if err != nil {
+		return nil, err
+	}
+	buff := make([]byte, splitter.MaxSize())
+
+	// The first segment begins at a real boundary.
+	chunks := speculative[0]
+	for ii := 1; ii < numSegments; ii++ {
+		last := chunks[len(chunks)-1]
+		next := last.Offset + int64(last.Length)
+		segmentEnd := int64(ii+1) * segmentSize
+
+		starts := make(map[int64]int, len(speculative[ii]))
+		for jj, chunk := range speculative[ii] {
+			starts[chunk.Offset] = jj
+		}
+
+		for next < size && next < segmentEnd {
+			if jj, ok := starts[next]; ok {
+				chunks = append(chunks, speculative[ii][jj:]...)
+				break
+			}
+
+			// Recompute one chunk sequentially.
+			chunk, err := chunkAt(r, size, next, splitter, buff)
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, chunk)
+			next += int64(chunk.Length)
+		}
+	}
+	return chunks, nil
+}
+
+// Chunks r as if a chunk began at start, until a chunk ends at or beyond
+// end.  r holds size bytes.
+func chunkSegment(r io.ReaderAt, size, start, end int64, newSplitter func() (Splitter, error)) ([]Chunk, error) {
+	splitter, err := newSplitter()
+	if err != nil {
+		return nil, err
+	}
+	c := NewChunkerWithSplitter(io.NewSectionReader(r, start, size-start), splitter)
+
+	chunks := []Chunk{}
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk.Offset += start
+		chunk.Data = nil
+		chunks = append(chunks, chunk)
+		if chunk.Offset+int64(chunk.Length) >= end {
+			return chunks, nil
+		}
+	}
+}
+
+// Returns the chunk (without Data) that begins at offset.  buff must hold
+// at least the maximum chunk size.
+func chunkAt(r io.ReaderAt, size, offset int64, splitter Splitter, buff []byte) (Chunk, error) {
+	avail := int64(splitter.MaxSize())
+	if offset+avail > size {
+		avail = size - offset
+	}
+	data := buff[:avail]
+	if _, err := r.ReadAt(data, offset); err != nil && err != io.EOF {
+		return Chunk{}, err
+	}
+	n, fp := splitter.Split(data)
+	return Chunk{Offset: offset, Length: n, Fingerprint: fp}, nil
+}
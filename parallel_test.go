@@ -0,0 +1,102 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func Test_ChunkParallel(t *testing.T) {
+	data := makeRandomData(0, 2<<20)
+	for _, strategy := range chunkingStrategies {
+		splitter, err := strategy.newFn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmp := chunkAllWithSplitter(t, data, splitter)
+		for ii := range cmp {
+			cmp[ii].Data = nil
+		}
+
+		for _, segmentSize := range []int64{5000, 100000, 1 << 20, 4 << 20} {
+			for _, workers := range []int{1, 4} {
+				chunks, err := ChunkParallel(bytes.NewReader(data), int64(len(data)),
+					strategy.newFn, ParallelParams{SegmentSize: segmentSize, Workers: workers})
+				if err != nil {
+					t.Fatal(err)
+				}
+				compareChunks(t, fmt.Sprintf("%s segment %d workers %d",
+					strategy.name, segmentSize, workers), chunks, cmp)
+			}
+		}
+	}
+}
+
+func Test_ChunkParallelSmall(t *testing.T) {
+	newSplitter := func() (Splitter, error) {
+		return NewRabinSplitter(DefaultChunkerParams())
+	}
+	for _, size := range []int{0, 1, 5000} {
+		data := makeRandomData(1, size)
+		chunks, err := ChunkParallel(bytes.NewReader(data), int64(size), newSplitter,
+			ParallelParams{SegmentSize: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for _, chunk := range chunks {
+			total += chunk.Length
+		}
+		if total != size {
+			t.Error(fmt.Sprintf("size %d: chunks cover %d bytes", size, total))
+		}
+	}
+}
+
+// Fails reads past a given offset.
+type failingReaderAt struct {
+	r      io.ReaderAt
+	offset int64
+	err    error
+}
+
+func (r *failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.offset {
+		return 0, r.err
+	}
+	return r.r.ReadAt(p, off)
+}
+
+func Test_ChunkParallelError(t *testing.T) {
+	errRead := errors.New("read failed")
+	data := makeRandomData(2, 1<<20)
+	r := &failingReaderAt{bytes.NewReader(data), 600000, errRead}
+	_, err := ChunkParallel(r, int64(len(data)), func() (Splitter, error) {
+		return NewRabinSplitter(DefaultChunkerParams())
+	}, ParallelParams{SegmentSize: 256 * 1024})
+	if err != errRead {
+		t.Error(fmt.Sprintf("expected read error, got %v", err))
+	}
+}
+
+func Benchmark_ChunkParallel(b *testing.B) {
+	data := makeRandomData(0, 64<<20)
+	newSplitter := func() (Splitter, error) {
+		return NewRabinSplitter(DefaultChunkerParams())
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Workers%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for ii := 0; ii < b.N; ii++ {
+				ChunkParallel(bytes.NewReader(data), int64(len(data)), newSplitter,
+					ParallelParams{SegmentSize: 4 << 20, Workers: workers})
+			}
+		})
+	}
+}
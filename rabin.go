@@ -7,6 +7,7 @@
 package rabin
 
 import (
+	"errors"
 	"fmt"
 	"hash"
 )
@@ -17,11 +18,33 @@ type RollingHash interface {
 	// Drains the oldest bytes oldData from the hash and appends newData.
 	// This is used for rolling windows.
 	//
-	// len(oldData) MUST equal len(newData).  This may not be checked,
-	// and errant behavior may result if this does not hold.
+	// len(oldData) must equal len(newData), or ErrWindowMismatch is
+	// returned and the hash is left unchanged.  oldData must be the
+	// oldest bytes in a full window; this is only verified by hashes that
+	// are constructed in checked mode (see NewRollingChecked).
 	Roll(oldData, newData []byte) (int, error)
 }
 
+var (
+	// Returned by Roll when len(oldData) != len(newData).
+	ErrWindowMismatch = errors.New("rabin: len(oldData) != len(newData)")
+
+	// Returned by Roll when the hash was not constructed with a rolling
+	// window (e.g., by New).
+	ErrNotRolling = errors.New("rabin: hash has no rolling window")
+
+	// Returned by checked rolling hashes when a Write would hold more
+	// bytes than the window, or a Roll drains more bytes than the window.
+	ErrWindowOverflow = errors.New("rabin: data exceeds window size")
+
+	// Returned by checked rolling hashes when a Roll is attempted before
+	// windowSize bytes have been written since the last Reset.
+	ErrWindowNotFull = errors.New("rabin: window is not full")
+
+	// Returned when a custom polynomial is not of degree 64.
+	ErrPolynomialDegree = errors.New("rabin: polynomial must have degree 64")
+)
+
 const (
 	// 64-bit fingerprints
 	kNumBytes = 8
@@ -46,17 +69,26 @@ type digest struct {
 	f1 uint32
 	f2 uint32
 
+	// Tables derived from the irreducible polynomial.
+	tables *rabinTables32
+
 	// The following are only defined if a rolling window is specified.
 	windowSize    int
 	rollingTables *rabinRollingTables32
+
+	// In checked mode, count tracks the number of bytes in the window so
+	// that overflows can be reported.
+	checked bool
+	count   int
 }
 
 func init() {
-	kTables = makeRabinTables32()
+	kTables = makeRabinTables32(kIrreduciblePolyCoeffs)
 }
 
 func New() hash.Hash64 {
 	hash := new(digest)
+	hash.tables = kTables
 	return hash
 }
 
@@ -64,8 +96,61 @@ func New() hash.Hash64 {
 // cost occurs for each rolling hash construction.
 func NewRolling(windowSize int) RollingHash {
 	hash := new(digest)
+	hash.tables = kTables
 	hash.windowSize = windowSize
-	hash.rollingTables = makeRabinRollingTables32(windowSize)
+	hash.rollingTables = makeRabinRollingTables32(windowSize,
+		kIrreduciblePolyCoeffs)
+	return hash
+}
+
+// Like NewRolling, but fingerprints are taken modulo p rather than the
+// fixed polynomial.  p must have degree 64 and should be irreducible (see
+// FindIrreducible); ErrPolynomialDegree is returned otherwise.  All tables
+// are derived from p, so the setup cost is higher than that of NewRolling.
+func NewRollingWithPolynomial(p *Polynomial, windowSize int) (RollingHash, error) {
+	hash, err := newRollingDigest(p, windowSize)
+	if err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+// Returns a rolling digest for the given polynomial, which may be nil to
+// select the fixed polynomial.
+func newRollingDigest(p *Polynomial, windowSize int) (*digest, error) {
+	if p == nil {
+		return NewRolling(windowSize).(*digest), nil
+	}
+
+	coeffs, err := polynomialCoeffs(p)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := new(digest)
+	hash.tables = makeRabinTables32(coeffs)
+	hash.windowSize = windowSize
+	hash.rollingTables = makeRabinRollingTables32(windowSize, coeffs)
+	return hash, nil
+}
+
+// Returns the coefficients of p of degree < 64 if p has degree 64.
+func polynomialCoeffs(p *Polynomial) (uint64, error) {
+	if p.Degree() != kIrreduciblePolyDegree {
+		return 0, ErrPolynomialDegree
+	}
+	_, coeffs := p.Uint64()
+	return coeffs, nil
+}
+
+// Like NewRolling, but the returned hash also verifies that the window is
+// never overfilled.  Write returns ErrWindowOverflow if the bytes written
+// since the last Reset would exceed windowSize, and Roll returns
+// ErrWindowOverflow if it would drain more than windowSize bytes or
+// ErrWindowNotFull if fewer than windowSize bytes have been written.
+func NewRollingChecked(windowSize int) RollingHash {
+	hash := NewRolling(windowSize).(*digest)
+	hash.checked = true
 	return hash
 }
 
@@ -76,13 +161,26 @@ func (d *digest) BlockSize() int {
 func (d *digest) Reset() {
 	d.f1 = 0
 	d.f2 = 0
+	d.count = 0
 }
 
 // Rolling is similar to writing new bytes.  For each step, we need only
 // subtract out a corresponding amount of oldData.  (See rabin.tex.)
 func (d *digest) Roll(oldData, newData []byte) (int, error) {
+	if d.rollingTables == nil {
+		return 0, ErrNotRolling
+	}
 	if len(oldData) != len(newData) {
-		panic("len(oldData) != len(newData)")
+		return 0, ErrWindowMismatch
+	}
+	if d.checked {
+		if len(oldData) > d.windowSize {
+			return 0, ErrWindowOverflow
+		}
+		// The old bytes are only removed correctly from a full window.
+		if d.count < d.windowSize {
+			return 0, ErrWindowNotFull
+		}
 	}
 
 	// Number of 32-bit words
@@ -91,6 +189,7 @@ func (d *digest) Roll(oldData, newData []byte) (int, error) {
 	// f = f1 f2  // f1 is the high word
 	f1 := d.f1
 	f2 := d.f2
+	tables := d.tables
 	for ii := 0; ii < numWords; ii++ {
 		offset := 4 * ii
 		inWord := (uint32(newData[offset]) << 24) |
@@ -98,10 +197,10 @@ func (d *digest) Roll(oldData, newData []byte) (int, error) {
 			(uint32(newData[offset+2]) << 8) |
 			(uint32(newData[offset+3]))
 
-		ta := kTables.t88[uint8(f1>>24)]
-		tb := kTables.t80[uint8(f1>>16)]
-		tc := kTables.t72[uint8(f1>>8)]
-		td := kTables.t64[uint8(f1)]
+		ta := tables.t88[uint8(f1>>24)]
+		tb := tables.t80[uint8(f1>>16)]
+		tc := tables.t72[uint8(f1>>8)]
+		td := tables.t64[uint8(f1)]
 
 		f1 = uint32(ta>>32) ^ uint32(tb>>32) ^
 			uint32(tc>>32) ^ uint32(td>>32) ^ f2
@@ -121,7 +220,7 @@ func (d *digest) Roll(oldData, newData []byte) (int, error) {
 
 	// Process the remainder.
 	offset := numWords * 4
-	f1, f2 = updateSubword(f1, f2, newData[offset:])
+	f1, f2 = updateSubword(tables, f1, f2, newData[offset:])
 
 	// Fix up the remainder.
 	switch len(oldData) - offset {
@@ -156,6 +255,24 @@ func (d *digest) Roll(oldData, newData []byte) (int, error) {
 	return len(newData), nil
 }
 
+// Rolls a single byte out of the window and another in, and returns the
+// new fingerprint.  This is equivalent to Roll followed by Sum64, but it
+// avoids the overhead of slices for byte-at-a-time scanning.
+func (d *digest) rollByte(oldByte, newByte byte) uint64 {
+	f1, f2 := d.f1, d.f2
+
+	j1 := (f1 << 8) | (f2 >> 24)
+	j2 := f2 << 8
+	td := d.tables.t64[uint8(f1>>24)]
+	t8m0 := d.rollingTables.t8m0[oldByte]
+
+	f1 = uint32(td>>32) ^ j1 ^ uint32(t8m0>>32)
+	f2 = uint32(td) ^ j2 ^ uint32(newByte) ^ uint32(t8m0)
+
+	d.f1, d.f2 = f1, f2
+	return (uint64(f1) << 32) | uint64(f2)
+}
+
 func (d *digest) Size() int {
 	return kNumBytes
 }
@@ -210,7 +327,7 @@ func update32Generic(f1, f2 uint32, rawTables *[4][256]uint64, p []byte, numWord
 // len(p) must be < 4.  This updates the fingerprint based on p.  It is used
 // to finish up processing when word-sized updates can no longer be performed.
 // Returns (f1, f2)
-func updateSubword(f1, f2 uint32, p []byte) (uint32, uint32) {
+func updateSubword(tables *rabinTables32, f1, f2 uint32, p []byte) (uint32, uint32) {
 	switch len(p) {
 	case 3:
 		j1 := (f1 << 24) | (f2 >> 8)
@@ -218,9 +335,9 @@ func updateSubword(f1, f2 uint32, p []byte) (uint32, uint32) {
 		bytes := (uint32(p[0]) << 16) |
 			(uint32(p[1]) << 8) |
 			uint32(p[2])
-		tb := kTables.t80[uint8(f1>>24)]
-		tc := kTables.t72[uint8(f1>>16)]
-		td := kTables.t64[uint8(f1>>8)]
+		tb := tables.t80[uint8(f1>>24)]
+		tc := tables.t72[uint8(f1>>16)]
+		td := tables.t64[uint8(f1>>8)]
 
 		f1 = uint32(tb>>32) ^ uint32(tc>>32) ^
 			uint32(td>>32) ^ j1
@@ -230,8 +347,8 @@ func updateSubword(f1, f2 uint32, p []byte) (uint32, uint32) {
 		j1 := (f1 << 16) | (f2 >> 16)
 		j2 := f2 << 16
 		bytes := (uint32(p[0]) << 8) | uint32(p[1])
-		tc := kTables.t72[uint8(f1>>24)]
-		td := kTables.t64[uint8(f1>>16)]
+		tc := tables.t72[uint8(f1>>24)]
+		td := tables.t64[uint8(f1>>16)]
 
 		f1 = uint32(tc>>32) ^ uint32(td>>32) ^ j1
 		f2 = uint32(tc) ^ uint32(td) ^ j2 ^ bytes
@@ -239,7 +356,7 @@ func updateSubword(f1, f2 uint32, p []byte) (uint32, uint32) {
 	case 1:
 		j1 := (f1 << 8) | (f2 >> 24)
 		j2 := f2 << 8
-		td := kTables.t64[uint8(f1>>24)]
+		td := tables.t64[uint8(f1>>24)]
 
 		f1 = uint32(td>>32) ^ j1
 		f2 = uint32(td) ^ j2 ^ uint32(p[0])
@@ -253,19 +370,26 @@ func updateSubword(f1, f2 uint32, p []byte) (uint32, uint32) {
 }
 
 func (d *digest) Write(p []byte) (n int, err error) {
+	if d.checked {
+		if d.count+len(p) > d.windowSize {
+			return 0, ErrWindowOverflow
+		}
+		d.count += len(p)
+	}
+
 	// Number of 32-bit words
 	numWords := len(p) >> 2
 
 	// f = f1 f2  // f1 is the high word
 	f1 := d.f1
 	f2 := d.f2
-	f1, f2 = update32(f1, f2, kTables.raw, p, numWords)
+	f1, f2 = update32(f1, f2, d.tables.raw, p, numWords)
 
 	// Process the remainder.
 	offset := numWords * 4
 
 	// Store the result.
-	d.f1, d.f2 = updateSubword(f1, f2, p[offset:])
+	d.f1, d.f2 = updateSubword(d.tables, f1, f2, p[offset:])
 
 	return len(p), nil
 }
@@ -278,13 +402,13 @@ func (d *digest) writeGeneric(p []byte) (n int, err error) {
 	// f = f1 f2  // f1 is the high word
 	f1 := d.f1
 	f2 := d.f2
-	f1, f2 = update32Generic(f1, f2, kTables.raw, p, numWords)
+	f1, f2 = update32Generic(f1, f2, d.tables.raw, p, numWords)
 
 	// Process the remainder.
 	offset := numWords * 4
 
 	// Store the result.
-	d.f1, d.f2 = updateSubword(f1, f2, p[offset:])
+	d.f1, d.f2 = updateSubword(d.tables, f1, f2, p[offset:])
 
 	return len(p), nil
 }
@@ -16,17 +16,50 @@ var kTables64 *rabinTables64
 
 type digest64 struct {
 	fingerprint uint64
+
+	// Tables derived from the irreducible polynomial.
+	tables *rabinTables64
+
+	// The following are only defined if a rolling window is specified.
+	windowSize    int
+	rollingTables *rabinRollingTables64
 }
 
 func init() {
-	kTables64 = makeRabinTables64()
+	kTables64 = makeRabinTables64(kIrreduciblePolyCoeffs)
 }
 
 func New64() hash.Hash64 {
 	hash := new(digest64)
+	hash.tables = kTables64
+	return hash
+}
+
+// The 64-bit analogue of NewRolling.  windowSize is in bytes.
+func NewRolling64(windowSize int) RollingHash {
+	hash := new(digest64)
+	hash.tables = kTables64
+	hash.windowSize = windowSize
+	hash.rollingTables = makeRabinRollingTables64(windowSize,
+		kIrreduciblePolyCoeffs)
 	return hash
 }
 
+// The 64-bit analogue of NewRollingWithPolynomial.  p must have degree 64;
+// ErrPolynomialDegree is returned otherwise.
+func NewRolling64WithPolynomial(p *Polynomial, windowSize int) (RollingHash, error) {
+	coeffs, err := polynomialCoeffs(p)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := new(digest64)
+	hash.tables = makeRabinTables64(coeffs)
+	hash.windowSize = windowSize
+	hash.rollingTables = makeRabinRollingTables64(windowSize, coeffs)
+	return hash, nil
+}
+
 func (d *digest64) BlockSize() int {
 	return 8
 }
@@ -35,6 +68,46 @@ func (d *digest64) Reset() {
 	d.fingerprint = 0
 }
 
+// See digest.Roll.  This consumes 64-bit words at a time.
+func (d *digest64) Roll(oldData, newData []byte) (int, error) {
+	if d.rollingTables == nil {
+		return 0, ErrNotRolling
+	}
+	if len(oldData) != len(newData) {
+		return 0, ErrWindowMismatch
+	}
+
+	// Number of 64-bit words
+	numWords := len(newData) >> 3
+
+	fp := d.fingerprint
+	tables := d.tables.raw
+	rolling := d.rollingTables.raw
+	for ii := 0; ii < numWords; ii++ {
+		offset := 8 * ii
+		fp = update64Generic(fp, tables, newData[offset:offset+8], 1)
+
+		// Subtract the old data.  Maintain big-endian order.
+		for kk := 0; kk < 8; kk++ {
+			fp ^= rolling[kk][oldData[offset+7-kk]]
+		}
+	}
+
+	// Process the remainder.
+	offset := numWords * 8
+	fp = updateSubword64(d.tables, fp, newData[offset:])
+
+	// Fix up the remainder.
+	remainder := len(oldData) - offset
+	for kk := 0; kk < remainder; kk++ {
+		fp ^= rolling[kk][oldData[offset+remainder-1-kk]]
+	}
+
+	d.fingerprint = fp
+
+	return len(newData), nil
+}
+
 func (d *digest64) Size() int {
 	return kNumBytes
 }
@@ -59,7 +132,7 @@ func (d *digest64) Sum64() uint64 {
 // len(p) must be < 4.  This updates the fingerprint based on p.  It is used
 // to finish up processing when word-sized updates can no longer be performed.
 // Returns (f1, f2)
-func updateSubword64(fp uint64, p []byte) uint64 {
+func updateSubword64(tables *rabinTables64, fp uint64, p []byte) uint64 {
 	switch len(p) {
 	case 7:
 		bytes := (uint64(p[0]) << 48) |
@@ -70,13 +143,13 @@ func updateSubword64(fp uint64, p []byte) uint64 {
 			(uint64(p[5]) << 8) |
 			(uint64(p[6]))
 		fp0 := fp << 56
-		t112 := kTables64.t112[uint8(fp>>56)]
-		t104 := kTables64.t104[uint8(fp>>48)]
-		t96 := kTables64.t96[uint8(fp>>40)]
-		t88 := kTables64.t88[uint8(fp>>32)]
-		t80 := kTables64.t80[uint8(fp>>24)]
-		t72 := kTables64.t72[uint8(fp>>16)]
-		t64 := kTables64.t64[uint8(fp>>8)]
+		t112 := tables.t112[uint8(fp>>56)]
+		t104 := tables.t104[uint8(fp>>48)]
+		t96 := tables.t96[uint8(fp>>40)]
+		t88 := tables.t88[uint8(fp>>32)]
+		t80 := tables.t80[uint8(fp>>24)]
+		t72 := tables.t72[uint8(fp>>16)]
+		t64 := tables.t64[uint8(fp>>8)]
 		fp = t112 ^ t104 ^ t96 ^ t88 ^ t80 ^ t72 ^ t64 ^ fp0 ^ bytes
 		break
 	case 6:
@@ -87,12 +160,12 @@ func updateSubword64(fp uint64, p []byte) uint64 {
 			(uint64(p[4]) << 8) |
 			(uint64(p[5]))
 		fp0 := fp << 48
-		t104 := kTables64.t104[uint8(fp>>56)]
-		t96 := kTables64.t96[uint8(fp>>48)]
-		t88 := kTables64.t88[uint8(fp>>40)]
-		t80 := kTables64.t80[uint8(fp>>32)]
-		t72 := kTables64.t72[uint8(fp>>24)]
-		t64 := kTables64.t64[uint8(fp>>16)]
+		t104 := tables.t104[uint8(fp>>56)]
+		t96 := tables.t96[uint8(fp>>48)]
+		t88 := tables.t88[uint8(fp>>40)]
+		t80 := tables.t80[uint8(fp>>32)]
+		t72 := tables.t72[uint8(fp>>24)]
+		t64 := tables.t64[uint8(fp>>16)]
 		fp = t104 ^ t96 ^ t88 ^ t80 ^ t72 ^ t64 ^ fp0 ^ bytes
 		break
 	case 5:
@@ -102,11 +175,11 @@ func updateSubword64(fp uint64, p []byte) uint64 {
 			(uint64(p[3]) << 8) |
 			(uint64(p[4]))
 		fp0 := fp << 40
-		t96 := kTables64.t96[uint8(fp>>56)]
-		t88 := kTables64.t88[uint8(fp>>48)]
-		t80 := kTables64.t80[uint8(fp>>40)]
-		t72 := kTables64.t72[uint8(fp>>32)]
-		t64 := kTables64.t64[uint8(fp>>24)]
+		t96 := tables.t96[uint8(fp>>56)]
+		t88 := tables.t88[uint8(fp>>48)]
+		t80 := tables.t80[uint8(fp>>40)]
+		t72 := tables.t72[uint8(fp>>32)]
+		t64 := tables.t64[uint8(fp>>24)]
 		fp = t96 ^ t88 ^ t80 ^ t72 ^ t64 ^ fp0 ^ bytes
 		break
 	case 4:
@@ -115,10 +188,10 @@ func updateSubword64(fp uint64, p []byte) uint64 {
 			(uint64(p[2]) << 8) |
 			(uint64(p[3]))
 		fp0 := fp << 32
-		t88 := kTables64.t88[uint8(fp>>56)]
-		t80 := kTables64.t80[uint8(fp>>48)]
-		t72 := kTables64.t72[uint8(fp>>40)]
-		t64 := kTables64.t64[uint8(fp>>32)]
+		t88 := tables.t88[uint8(fp>>56)]
+		t80 := tables.t80[uint8(fp>>48)]
+		t72 := tables.t72[uint8(fp>>40)]
+		t64 := tables.t64[uint8(fp>>32)]
 		fp = t88 ^ t80 ^ t72 ^ t64 ^ fp0 ^ bytes
 		break
 	case 3:
@@ -126,21 +199,21 @@ func updateSubword64(fp uint64, p []byte) uint64 {
 			(uint64(p[1]) << 8) |
 			uint64(p[2])
 		fp0 := fp << 24
-		t80 := kTables64.t80[uint8(fp>>56)]
-		t72 := kTables64.t72[uint8(fp>>48)]
-		t64 := kTables64.t64[uint8(fp>>40)]
+		t80 := tables.t80[uint8(fp>>56)]
+		t72 := tables.t72[uint8(fp>>48)]
+		t64 := tables.t64[uint8(fp>>40)]
 		fp = t80 ^ t72 ^ t64 ^ fp0 ^ bytes
 		break
 	case 2:
 		bytes := (uint64(p[0]) << 8) | uint64(p[1])
 		fp0 := fp << 16
-		t72 := kTables64.t72[uint8(fp>>56)]
-		t64 := kTables64.t64[uint8(fp>>48)]
+		t72 := tables.t72[uint8(fp>>56)]
+		t64 := tables.t64[uint8(fp>>48)]
 		fp = t72 ^ t64 ^ fp0 ^ bytes
 		break
 	case 1:
 		fp0 := fp << 8
-		t64 := kTables64.t64[uint8(fp>>56)]
+		t64 := tables.t64[uint8(fp>>56)]
 		fp = t64 ^ fp0 ^ uint64(p[0])
 		break
 	case 0:
@@ -190,13 +263,13 @@ func (d *digest64) Write(p []byte) (n int, err error) {
 	// Number of 64-bit words
 	numWords := len(p) >> 3
 
-	fp := update64(d.fingerprint, kTables64.raw, p, numWords)
+	fp := update64(d.fingerprint, d.tables.raw, p, numWords)
 
 	// Process the remainder.
 	offset := numWords * 8
 
 	// Store the result.
-	d.fingerprint = updateSubword64(fp, p[offset:])
+	d.fingerprint = updateSubword64(d.tables, fp, p[offset:])
 
 	return len(p), nil
 }
@@ -206,13 +279,13 @@ func (d *digest64) writeGeneric(p []byte) (n int, err error) {
 	// Number of 64-bit words
 	numWords := len(p) >> 3
 
-	fp := update64Generic(d.fingerprint, kTables64.raw, p, numWords)
+	fp := update64Generic(d.fingerprint, d.tables.raw, p, numWords)
 
 	// Process the remainder.
 	offset := numWords * 8
 
 	// Store the result.
-	d.fingerprint = updateSubword64(fp, p[offset:])
+	d.fingerprint = updateSubword64(d.tables, fp, p[offset:])
 
 	return len(p), nil
 }
@@ -126,7 +126,7 @@ func Benchmark_Rabin(b *testing.B) {
 func Benchmark_RabinGeneric(b *testing.B) {
 	b.StopTimer()
 	buff := makeSequence(32)
-	hash := new(digest)
+	hash := New().(*digest)
 
 	b.StartTimer()
 	for ii := 0; ii < b.N; ii++ {
@@ -204,7 +204,7 @@ func Benchmark_RabinGenericLong(b *testing.B) {
 	b.StopTimer()
 	testData := makeTestData()
 
-	hash := new(digest)
+	hash := New().(*digest)
 
 	b.StartTimer()
 	for ii := 0; ii < b.N; ii++ {
@@ -236,7 +236,7 @@ func Benchmark_Rabin64GenericLong(b *testing.B) {
 	b.StopTimer()
 	testData := makeTestData()
 
-	hash := new(digest64)
+	hash := New64().(*digest64)
 
 	b.StartTimer()
 	for ii := 0; ii < b.N; ii++ {
@@ -348,7 +348,7 @@ func Benchmark_Rabin32GenericBlock(b *testing.B) {
 	b.StopTimer()
 
 	buff := makeBlock(256 * 1024)
-	hash := new(digest)
+	hash := New().(*digest)
 
 	b.StartTimer()
 	for ii := 0; ii < b.N; ii++ {
@@ -376,7 +376,7 @@ func Benchmark_Rabin64GenericBlock(b *testing.B) {
 	b.StopTimer()
 
 	buff := makeBlock(256 * 1024)
-	hash := new(digest64)
+	hash := New64().(*digest64)
 
 	b.StartTimer()
 	for ii := 0; ii < b.N; ii++ {
@@ -435,3 +435,175 @@ func Test_Roll(t *testing.T) {
 		t.Error("mismatch")
 	}
 }
+
+func Test_RollMismatch(t *testing.T) {
+	hash := NewRolling(16)
+	buff := makeSequence(32)
+	hash.Write(buff[:16])
+	sum := hash.Sum64()
+
+	n, err := hash.Roll(buff[:1], buff[16:18])
+	if err != ErrWindowMismatch || n != 0 {
+		t.Error(fmt.Sprintf("expected ErrWindowMismatch, got (%d, %v)", n, err))
+	}
+	if hash.Sum64() != sum {
+		t.Error("hash modified by failed Roll")
+	}
+}
+
+func Test_RollNotRolling(t *testing.T) {
+	hash := New().(RollingHash)
+	buff := makeSequence(8)
+	hash.Write(buff[:4])
+
+	n, err := hash.Roll(buff[:1], buff[4:5])
+	if err != ErrNotRolling || n != 0 {
+		t.Error(fmt.Sprintf("expected ErrNotRolling, got (%d, %v)", n, err))
+	}
+}
+
+func Test_RollChecked(t *testing.T) {
+	hash := NewRollingChecked(16)
+	buff := makeSequence(64)
+
+	// Rolling out of a partially filled window is an error.
+	hash.Write(buff[:4])
+	if n, err := hash.Roll(buff[:4], buff[4:8]); err != ErrWindowNotFull || n != 0 {
+		t.Error(fmt.Sprintf("expected ErrWindowNotFull, got (%d, %v)", n, err))
+	}
+	hash.Reset()
+
+	if _, err := hash.Write(buff[:10]); err != nil {
+		t.Error(err)
+	}
+	// The window only has room for 6 more bytes.
+	if n, err := hash.Write(buff[10:17]); err != ErrWindowOverflow || n != 0 {
+		t.Error(fmt.Sprintf("expected ErrWindowOverflow, got (%d, %v)", n, err))
+	}
+	if _, err := hash.Write(buff[10:16]); err != nil {
+		t.Error(err)
+	}
+	if hash.Sum64() != RabinFingerprintFixed(buff[:16]) {
+		t.Error("mismatch after checked write")
+	}
+
+	// Rolling more than the window is an error.
+	if n, err := hash.Roll(buff[:17], buff[16:33]); err != ErrWindowOverflow || n != 0 {
+		t.Error(fmt.Sprintf("expected ErrWindowOverflow, got (%d, %v)", n, err))
+	}
+	if n, err := hash.Roll(buff[:1], buff[16:18]); err != ErrWindowMismatch || n != 0 {
+		t.Error(fmt.Sprintf("expected ErrWindowMismatch, got (%d, %v)", n, err))
+	}
+
+	// A full window roll is fine.
+	if _, err := hash.Roll(buff[:16], buff[16:32]); err != nil {
+		t.Error(err)
+	}
+	if hash.Sum64() != RabinFingerprintFixed(buff[16:32]) {
+		t.Error("mismatch after checked roll")
+	}
+
+	// Writes are still bounded after rolling.
+	if _, err := hash.Write(buff[32:33]); err != ErrWindowOverflow {
+		t.Error(fmt.Sprintf("expected ErrWindowOverflow, got %v", err))
+	}
+
+	// Reset empties the window.
+	hash.Reset()
+	if _, err := hash.Write(buff[:16]); err != nil {
+		t.Error(err)
+	}
+}
+
+// Rolls hash across data using the given window size and stride and
+// compares each window against RabinFingerprint modulo p.
+func checkRollingWindows(t *testing.T, name string, hash RollingHash, p *Polynomial, data []byte, windowSize, stride int) {
+	fingerprint := func(b []byte) uint64 {
+		_, fp := RabinFingerprint(p, b).Uint64()
+		return fp
+	}
+
+	hash.Reset()
+	hash.Write(data[:windowSize])
+	if sum, cmp := hash.Sum64(), fingerprint(data[:windowSize]); sum != cmp {
+		t.Error(fmt.Sprintf("%s window %d: mismatch 0x%x != 0x%x", name, windowSize, sum, cmp))
+	}
+
+	for start := 0; start+windowSize+stride <= len(data); start += stride {
+		end := start + windowSize
+		n, err := hash.Roll(data[start:start+stride], data[end:end+stride])
+		if err != nil || n != stride {
+			t.Error(fmt.Sprintf("%s window %d: Roll (%d, %v)", name, windowSize, n, err))
+			return
+		}
+		sum := hash.Sum64()
+		cmp := fingerprint(data[start+stride : end+stride])
+		if sum != cmp {
+			t.Error(fmt.Sprintf("%s window %d stride %d offset %d: mismatch 0x%x != 0x%x",
+				name, windowSize, stride, start+stride, sum, cmp))
+			return
+		}
+	}
+}
+
+func Test_Roll64(t *testing.T) {
+	p := NewPolynomialFromUint64(kIrreduciblePolyDegree, kIrreduciblePolyCoeffs)
+	buff := makeSequence(512)
+	for _, windowSize := range []int{1, 3, 8, 13, 64, 128} {
+		for stride := 1; stride <= 9 && stride <= windowSize; stride++ {
+			checkRollingWindows(t, "Roll64", NewRolling64(windowSize), p,
+				buff, windowSize, stride)
+			checkRollingWindows(t, "Roll", NewRolling(windowSize), p,
+				buff, windowSize, stride)
+		}
+	}
+}
+
+func Test_RollWithPolynomial(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	buff := make([]byte, 512)
+	r.Read(buff)
+
+	p := FindIrreducible(64)
+	for _, windowSize := range []int{1, 5, 16, 31, 100} {
+		hash, err := NewRollingWithPolynomial(p, windowSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash64, err := NewRolling64WithPolynomial(p, windowSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for stride := 1; stride <= 9 && stride <= windowSize; stride++ {
+			checkRollingWindows(t, "RollWithPolynomial", hash, p,
+				buff, windowSize, stride)
+			checkRollingWindows(t, "Roll64WithPolynomial", hash64, p,
+				buff, windowSize, stride)
+		}
+	}
+}
+
+func Test_RollWithPolynomialDegree(t *testing.T) {
+	p := FindIrreducible(32)
+	if _, err := NewRollingWithPolynomial(p, 16); err != ErrPolynomialDegree {
+		t.Error(fmt.Sprintf("expected ErrPolynomialDegree, got %v", err))
+	}
+	if _, err := NewRolling64WithPolynomial(p, 16); err != ErrPolynomialDegree {
+		t.Error(fmt.Sprintf("expected ErrPolynomialDegree, got %v", err))
+	}
+}
+
+func Test_Roll64Errors(t *testing.T) {
+	buff := makeSequence(32)
+
+	hash := NewRolling64(16)
+	hash.Write(buff[:16])
+	if _, err := hash.Roll(buff[:1], buff[16:18]); err != ErrWindowMismatch {
+		t.Error(fmt.Sprintf("expected ErrWindowMismatch, got %v", err))
+	}
+
+	hash = New64().(RollingHash)
+	if _, err := hash.Roll(buff[:1], buff[16:17]); err != ErrNotRolling {
+		t.Error(fmt.Sprintf("expected ErrNotRolling, got %v", err))
+	}
+}
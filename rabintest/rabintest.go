@@ -0,0 +1,219 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package rabintest implements a conformance suite for rabin.RollingHash
+// implementations.
+package rabintest
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/kevinko/rabin"
+)
+
+// Constructs a rolling hash over windows of windowSize bytes.
+type NewFunc func(windowSize int) rabin.RollingHash
+
+// Computes the expected Sum64 of the given window from scratch, e.g.,
+// rabin.RabinFingerprintFixed.
+type ReferenceFunc func(window []byte) uint64
+
+// Window sizes that are always tested, since they straddle the word sizes
+// used by the table-driven implementations.
+var kFixedWindowSizes = []int{1, 2, 3, 4, 5, 7, 8, 9, 15, 16, 17, 31, 32, 33, 48, 64, 65}
+
+// The number of additional randomly drawn window sizes.
+const kNumRandomWindowSizes = 8
+
+// The maximum window size that is drawn at random.
+const kMaxRandomWindowSize = 300
+
+// The largest stride that is always tested.  Strides of 1 through 9 cover
+// every remainder modulo 4 and 8.
+const kMaxFixedStride = 9
+
+// Exercises the rolling hash returned by newFn against reference.  For each
+// of a set of fixed and random window sizes, it checks that:
+//
+//   - Write over a window matches reference,
+//   - Roll matches reference for strides of every remainder length,
+//   - Reset after rolling restores the initial state,
+//   - Write and Roll may be interleaved by re-priming the window with
+//     writes of random lengths, and
+//   - Roll rejects mismatched lengths without modifying the hash.
+//
+// Failures are reported with the window size, stride and offset so that
+// they can be reproduced.
+func TestRollingHash(t *testing.T, newFn NewFunc, reference ReferenceFunc) {
+	r := rand.New(rand.NewSource(1))
+
+	windowSizes := append([]int{}, kFixedWindowSizes...)
+	for ii := 0; ii < kNumRandomWindowSizes; ii++ {
+		windowSizes = append(windowSizes, 1+r.Intn(kMaxRandomWindowSize))
+	}
+
+	data := make([]byte, 4*kMaxRandomWindowSize)
+	r.Read(data)
+
+	t.Run("Sum", func(t *testing.T) {
+		testSum(t, newFn, reference, data)
+	})
+	t.Run("Strides", func(t *testing.T) {
+		for _, windowSize := range windowSizes {
+			testStrides(t, newFn, reference, data, windowSize, r)
+		}
+	})
+	t.Run("Reset", func(t *testing.T) {
+		for _, windowSize := range windowSizes {
+			testReset(t, newFn, reference, data, windowSize)
+		}
+	})
+	t.Run("Interleaved", func(t *testing.T) {
+		for _, windowSize := range windowSizes {
+			testInterleaved(t, newFn, reference, data, windowSize, r)
+		}
+	})
+	t.Run("Mismatch", func(t *testing.T) {
+		testMismatch(t, newFn, data)
+	})
+}
+
+func testSum(t *testing.T, newFn NewFunc, reference ReferenceFunc, data []byte) {
+	hash := newFn(16)
+	hash.Write(data[:16])
+	if sum, cmp := hash.Sum64(), reference(data[:16]); sum != cmp {
+		t.Fatalf("Sum64 0x%x != reference 0x%x", sum, cmp)
+	}
+
+	prefix := []byte("prefix")
+	sum := hash.Sum(append([]byte{}, prefix...))
+	if !bytes.HasPrefix(sum, prefix) {
+		t.Errorf("Sum did not append to its argument: %q", sum)
+	}
+	if len(sum)-len(prefix) != hash.Size() {
+		t.Errorf("Sum appended %d bytes, but Size() = %d",
+			len(sum)-len(prefix), hash.Size())
+	}
+}
+
+// Rolls across data with every stride from 1 to kMaxFixedStride, as well as
+// a random stride up to the window size.
+func testStrides(t *testing.T, newFn NewFunc, reference ReferenceFunc, data []byte, windowSize int, r *rand.Rand) {
+	strides := []int{}
+	for stride := 1; stride <= kMaxFixedStride && stride <= windowSize; stride++ {
+		strides = append(strides, stride)
+	}
+	strides = append(strides, 1+r.Intn(windowSize))
+
+	for _, stride := range strides {
+		hash := newFn(windowSize)
+		hash.Write(data[:windowSize])
+		if sum, cmp := hash.Sum64(), reference(data[:windowSize]); sum != cmp {
+			t.Fatalf("window %d: Write 0x%x != reference 0x%x",
+				windowSize, sum, cmp)
+		}
+
+		for start := 0; start+windowSize+stride <= len(data); start += stride {
+			if !checkRoll(t, hash, reference, data, start, windowSize, stride) {
+				return
+			}
+		}
+	}
+}
+
+// Rolls the window at data[start:] forward by stride bytes and compares
+// the result with reference.  Returns false on failure.
+func checkRoll(t *testing.T, hash rabin.RollingHash, reference ReferenceFunc, data []byte, start, windowSize, stride int) bool {
+	end := start + windowSize
+	n, err := hash.Roll(data[start:start+stride], data[end:end+stride])
+	if err != nil || n != stride {
+		t.Errorf("window %d stride %d offset %d: Roll returned (%d, %v)",
+			windowSize, stride, start, n, err)
+		return false
+	}
+
+	sum := hash.Sum64()
+	cmp := reference(data[start+stride : end+stride])
+	if sum != cmp {
+		t.Errorf("window %d stride %d offset %d: Roll 0x%x != reference 0x%x",
+			windowSize, stride, start+stride, sum, cmp)
+		return false
+	}
+	return true
+}
+
+func testReset(t *testing.T, newFn NewFunc, reference ReferenceFunc, data []byte, windowSize int) {
+	empty := newFn(windowSize).Sum64()
+
+	hash := newFn(windowSize)
+	hash.Write(data[:windowSize])
+	for start := 0; start < windowSize && start+windowSize+1 <= len(data); start++ {
+		if !checkRoll(t, hash, reference, data, start, windowSize, 1) {
+			return
+		}
+	}
+
+	hash.Reset()
+	if sum := hash.Sum64(); sum != empty {
+		t.Fatalf("window %d: Reset 0x%x != new 0x%x", windowSize, sum, empty)
+	}
+
+	// The hash must behave as if it were new.
+	offset := len(data) - windowSize - 1
+	hash.Write(data[offset : offset+windowSize])
+	if sum, cmp := hash.Sum64(), reference(data[offset:offset+windowSize]); sum != cmp {
+		t.Fatalf("window %d: Write after Reset 0x%x != reference 0x%x",
+			windowSize, sum, cmp)
+	}
+	checkRoll(t, hash, reference, data, offset, windowSize, 1)
+}
+
+// Primes the window with a random sequence of writes, comparing each
+// prefix, then rolls a random distance before resetting and re-priming
+// from the current position.
+func testInterleaved(t *testing.T, newFn NewFunc, reference ReferenceFunc, data []byte, windowSize int, r *rand.Rand) {
+	hash := newFn(windowSize)
+
+	start := 0
+	for start+windowSize < len(data) {
+		hash.Reset()
+		for written := 0; written < windowSize; {
+			n := 1 + r.Intn(windowSize-written)
+			hash.Write(data[start+written : start+written+n])
+			written += n
+
+			if sum, cmp := hash.Sum64(), reference(data[start:start+written]); sum != cmp {
+				t.Fatalf("window %d offset %d: partial Write of %d bytes 0x%x != reference 0x%x",
+					windowSize, start, written, sum, cmp)
+			}
+		}
+
+		numRolls := 1 + r.Intn(8)
+		for ii := 0; ii < numRolls; ii++ {
+			stride := 1 + r.Intn(windowSize)
+			if start+windowSize+stride > len(data) {
+				return
+			}
+			if !checkRoll(t, hash, reference, data, start, windowSize, stride) {
+				return
+			}
+			start += stride
+		}
+	}
+}
+
+func testMismatch(t *testing.T, newFn NewFunc, data []byte) {
+	hash := newFn(16)
+	hash.Write(data[:16])
+	sum := hash.Sum64()
+
+	if _, err := hash.Roll(data[:1], data[16:18]); err == nil {
+		t.Error("Roll accepted len(oldData) != len(newData)")
+	}
+	if hash.Sum64() != sum {
+		t.Error("failed Roll modified the hash")
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabintest
+
+import (
+	"testing"
+
+	"github.com/kevinko/rabin"
+)
+
+func Test_Rolling(t *testing.T) {
+	TestRollingHash(t, rabin.NewRolling, rabin.RabinFingerprintFixed)
+}
+
+func Test_RollingChecked(t *testing.T) {
+	TestRollingHash(t, rabin.NewRollingChecked, rabin.RabinFingerprintFixed)
+}
+
+func Test_Rolling64(t *testing.T) {
+	TestRollingHash(t, rabin.NewRolling64, rabin.RabinFingerprintFixed)
+}
+
+func Test_RollingWithPolynomial(t *testing.T) {
+	p := rabin.FindIrreducible(64)
+	reference := func(window []byte) uint64 {
+		_, fp := rabin.RabinFingerprint(p, window).Uint64()
+		return fp
+	}
+
+	TestRollingHash(t, func(windowSize int) rabin.RollingHash {
+		hash, err := rabin.NewRollingWithPolynomial(p, windowSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}, reference)
+
+	TestRollingHash(t, func(windowSize int) rabin.RollingHash {
+		hash, err := rabin.NewRolling64WithPolynomial(p, windowSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}, reference)
+}
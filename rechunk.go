@@ -0,0 +1,90 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Returned (wrapped) when an Edit does not fit the chunked input.
+var ErrEditRange = errors.New("rabin: edit out of range")
+
+// An in-place modification: OldLength bytes at Offset were replaced by
+// NewLength bytes.  Insertions have OldLength 0 and deletions NewLength 0.
+type Edit struct {
+	Offset    int64
+	OldLength int64
+	NewLength int64
+}
+
+// Rechunks r, which holds the size bytes of an input after edit, given the
+// chunks old of the input before edit.  old must be the complete chunking
+// produced with an equivalent splitter.
+//
+// The result replaces old[first:last] with chunks, which lack Data.  The
+// chunks old[last:] are unchanged except that their offsets shift by
+// edit.NewLength - edit.OldLength.
+//
+// Rescanning begins at the earliest chunk that starts less than MaxSize
+// bytes before the edit.  A Splitter is handed MaxSize bytes from the
+// start of a chunk and may cut based on any of them, so every such chunk
+// could have looked at the edited bytes, and up to MaxSize bytes before
+// the edit are rescanned.  Rescanning stops as soon as a new chunk begins
+// where a (shifted) old chunk past the edit begins, since the boundaries
+// from there on depend only on unchanged content.
+func Rechunk(r io.ReaderAt, size int64, old []Chunk, edit Edit, splitter Splitter) (first, last int, chunks []Chunk, err error) {
+	oldSize := int64(0)
+	if len(old) > 0 {
+		oldSize = old[len(old)-1].Offset + int64(old[len(old)-1].Length)
+	}
+	editEnd := edit.Offset + edit.OldLength
+	delta := edit.NewLength - edit.OldLength
+	if edit.Offset < 0 || edit.OldLength < 0 || edit.NewLength < 0 ||
+		editEnd > oldSize || oldSize+delta != size {
+		return 0, 0, nil, fmt.Errorf("%w: %+v of %d bytes into %d",
+			ErrEditRange, edit, oldSize, size)
+	}
+
+	// A Splitter sees up to MaxSize bytes from the start of a chunk.
+	maxSize := int64(splitter.MaxSize())
+	for first < len(old) && old[first].Offset+maxSize <= edit.Offset {
+		first++
+	}
+
+	next := int64(0)
+	if first < len(old) {
+		next = old[first].Offset
+	} else if len(old) > 0 {
+		next = oldSize
+	}
+
+	// Old chunks that begin past the edit are candidates for
+	// resynchronization.
+	last = first
+	for last < len(old) && old[last].Offset < editEnd {
+		last++
+	}
+
+	buff := make([]byte, maxSize)
+	chunks = []Chunk{}
+	for next < size {
+		for last < len(old) && old[last].Offset+delta < next {
+			last++
+		}
+		if last < len(old) && old[last].Offset+delta == next {
+			return first, last, chunks, nil
+		}
+
+		chunk, err := chunkAt(r, size, next, splitter, buff)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		chunks = append(chunks, chunk)
+		next += int64(chunk.Length)
+	}
+	return first, len(old), chunks, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Chunks data without retaining Data.
+func chunkList(t *testing.T, data []byte, splitter Splitter) []Chunk {
+	chunks := chunkAllWithSplitter(t, data, splitter)
+	for ii := range chunks {
+		chunks[ii].Data = nil
+	}
+	return chunks
+}
+
+// Applies a Rechunk result to old.
+func splice(old []Chunk, first, last int, chunks []Chunk, edit Edit) []Chunk {
+	out := append([]Chunk{}, old[:first]...)
+	out = append(out, chunks...)
+	for _, chunk := range old[last:] {
+		chunk.Offset += edit.NewLength - edit.OldLength
+		out = append(out, chunk)
+	}
+	return out
+}
+
+func Test_Rechunk(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := makeRandomData(0, 1<<20)
+	for _, strategy := range chunkingStrategies {
+		splitter, err := strategy.newFn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := chunkList(t, data, splitter)
+
+		for ii := 0; ii < 20; ii++ {
+			edit := Edit{Offset: int64(r.Intn(len(data)))}
+			switch ii % 3 {
+			case 0:
+				edit.NewLength = int64(1 + r.Intn(1000))
+			case 1:
+				edit.OldLength = int64(1 + r.Intn(1000))
+			case 2:
+				edit.OldLength = int64(1 + r.Intn(1000))
+				edit.NewLength = int64(1 + r.Intn(1000))
+			}
+			if edit.Offset+edit.OldLength > int64(len(data)) {
+				edit.OldLength = int64(len(data)) - edit.Offset
+			}
+			insert := make([]byte, edit.NewLength)
+			r.Read(insert)
+			edited := append(append(append([]byte{}, data[:edit.Offset]...), insert...),
+				data[edit.Offset+edit.OldLength:]...)
+
+			first, last, chunks, err := Rechunk(bytes.NewReader(edited),
+				int64(len(edited)), old, edit, splitter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := fmt.Sprintf("%s %+v", strategy.name, edit)
+			compareChunks(t, name, splice(old, first, last, chunks, edit),
+				chunkList(t, edited, splitter))
+			if last-first > 20 {
+				t.Error(fmt.Sprintf("%s: replaced %d chunks", name, last-first))
+			}
+		}
+	}
+}
+
+// Records the range of offsets read through an io.ReaderAt.
+type rangeReaderAt struct {
+	r        *bytes.Reader
+	min, max int64
+}
+
+func (r *rangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	if off < r.min {
+		r.min = off
+	}
+	if off+int64(n) > r.max {
+		r.max = off + int64(n)
+	}
+	return n, err
+}
+
+// Rescanning backs up less than MaxSize bytes before the edit and stops
+// soon after it.
+func Test_RechunkRescan(t *testing.T) {
+	splitter, err := NewRabinSplitter(DefaultChunkerParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxSize := int64(splitter.MaxSize())
+	data := makeRandomData(3, 1<<20)
+	old := chunkList(t, data, splitter)
+
+	edited := append([]byte{}, data...)
+	for _, offset := range []int64{1000, 300000, 500000, 1<<20 - 1} {
+		edited[offset] ^= 1
+		edit := Edit{Offset: offset, OldLength: 1, NewLength: 1}
+		r := &rangeReaderAt{r: bytes.NewReader(edited), min: int64(len(data))}
+		first, last, chunks, err := Rechunk(r, int64(len(edited)), old, edit, splitter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edited[offset] ^= 1
+
+		start := old[first].Offset
+		if start > offset || start+maxSize <= offset {
+			t.Error(fmt.Sprintf("offset %d: rescan starts at %d", offset, start))
+		}
+		if first > 0 && old[first-1].Offset+maxSize > offset {
+			t.Error(fmt.Sprintf("offset %d: chunk %d was not rescanned", offset, first-1))
+		}
+		if r.min != start {
+			t.Error(fmt.Sprintf("offset %d: read from %d, expected %d", offset, r.min, start))
+		}
+		// Each new chunk reads up to MaxSize bytes from its start.
+		end := int64(len(data))
+		if last < len(old) {
+			end = old[last].Offset
+		}
+		if end > offset+2*maxSize || r.max > end+maxSize {
+			t.Error(fmt.Sprintf("offset %d: rescanned [%d, %d), read up to %d with %d chunks",
+				offset, start, end, r.max, len(chunks)))
+		}
+	}
+}
+
+func Test_RechunkEnds(t *testing.T) {
+	splitter, err := NewRabinSplitter(DefaultChunkerParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeRandomData(1, 200000)
+	old := chunkList(t, data, splitter)
+	size := int64(len(data))
+
+	edits := []Edit{
+		{Offset: 0, NewLength: 100},
+		{Offset: 0, OldLength: 100},
+		{Offset: size, NewLength: 5000},
+		{Offset: size - 100, OldLength: 100},
+		{Offset: 0, OldLength: size},
+		{Offset: 0, OldLength: size, NewLength: 100},
+	}
+	for _, edit := range edits {
+		insert := makeRandomData(2, int(edit.NewLength))
+		edited := append(append(append([]byte{}, data[:edit.Offset]...), insert...),
+			data[edit.Offset+edit.OldLength:]...)
+		first, last, chunks, err := Rechunk(bytes.NewReader(edited),
+			int64(len(edited)), old, edit, splitter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareChunks(t, fmt.Sprintf("%+v", edit),
+			splice(old, first, last, chunks, edit), chunkList(t, edited, splitter))
+	}
+
+	// Chunking from nothing.
+	first, last, chunks, err := Rechunk(bytes.NewReader(data), size, nil,
+		Edit{NewLength: size}, splitter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 0 || last != 0 {
+		t.Error(fmt.Sprintf("empty input replaced [%d, %d)", first, last))
+	}
+	compareChunks(t, "empty", chunks, old)
+
+	// Edits that do not fit.
+	bad := []struct {
+		edit Edit
+		size int64
+	}{
+		{Edit{Offset: -1}, size},
+		{Edit{Offset: size + 1}, size + 1},
+		{Edit{Offset: size - 10, OldLength: 20}, size - 20},
+		{Edit{Offset: 10, NewLength: 5}, size},
+	}
+	for _, test := range bad {
+		_, _, _, err := Rechunk(bytes.NewReader(data), test.size, old, test.edit, splitter)
+		if !errors.Is(err, ErrEditRange) {
+			t.Error(fmt.Sprintf("%+v: got %v", test.edit, err))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+// Reports whether a chunk may end after data[:n], i.e., whether n is a
+// record boundary.  data begins at a chunk boundary, which is always a
+// record boundary.  For each chunk, n is passed in increasing order.
+type BoundaryFunc func(data []byte, n int) bool
+
+// Cuts only at record boundaries.  See NewRecordSplitter.
+type recordSplitter struct {
+	rabin      *rabinSplitter
+	isBoundary BoundaryFunc
+}
+
+// Returns a Splitter that only cuts at record boundaries, so that no
+// record is split across chunks.  A chunk ends at the first boundary at or
+// after the point where a Rabin splitter with params would cut.  If
+// MaxSize is reached first, the chunk ends at the last boundary seen,
+// which may be before MinSize.  If there is none, a single record exceeds
+// MaxSize and must be cut at MaxSize.
+func NewRecordSplitter(params ChunkerParams, isBoundary BoundaryFunc) (Splitter, error) {
+	rabin, err := newRabinSplitter(params)
+	if err != nil {
+		return nil, err
+	}
+	return &recordSplitter{rabin: rabin, isBoundary: isBoundary}, nil
+}
+
+// Returns a record splitter for records that end with delim, such as
+// newline-delimited logs or CSV.  See NewRecordSplitter.
+func NewDelimiterSplitter(params ChunkerParams, delim byte) (Splitter, error) {
+	return NewRecordSplitter(params, func(data []byte, n int) bool {
+		return data[n-1] == delim
+	})
+}
+
+func (s *recordSplitter) MaxSize() int {
+	return s.rabin.params.MaxSize
+}
+
+func (s *recordSplitter) Split(data []byte) (int, uint64) {
+	windowSize := s.rabin.params.WindowSize
+	minSize := s.rabin.params.MinSize
+	hash := s.rabin.hash
+
+	// Whether the Rabin condition has been met.
+	fired := false
+	lastBoundary := 0
+	fp := uint64(0)
+	for n := 1; n <= len(data); n++ {
+		if !fired && n >= minSize {
+			if n == minSize {
+				hash.Reset()
+				hash.Write(data[minSize-windowSize : minSize])
+				fp = hash.Sum64()
+			} else {
+				fp = hash.rollByte(data[n-1-windowSize], data[n-1])
+			}
+			fired = fp&s.rabin.mask == s.rabin.target
+		}
+
+		if s.isBoundary(data, n) {
+			if fired {
+				return n, s.rabin.fingerprint(data[:n])
+			}
+			lastBoundary = n
+		}
+	}
+
+	if len(data) == s.rabin.params.MaxSize && lastBoundary > 0 {
+		return lastBoundary, s.rabin.fingerprint(data[:lastBoundary])
+	}
+	// Either the stream ended or a record exceeds MaxSize.
+	return len(data), s.rabin.fingerprint(data)
+}
@@ -0,0 +1,150 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Generates newline-delimited records of up to maxRecord bytes.
+func makeLines(r *rand.Rand, size, maxRecord int) []byte {
+	buff := new(bytes.Buffer)
+	for buff.Len() < size {
+		line := make([]byte, r.Intn(maxRecord))
+		for ii := range line {
+			line[ii] = 'a' + byte(r.Intn(26))
+		}
+		buff.Write(line)
+		buff.WriteByte('\n')
+	}
+	return buff.Bytes()
+}
+
+func Test_DelimiterSplitter(t *testing.T) {
+	params := DefaultChunkerParams()
+	splitter, err := NewDelimiterSplitter(params, '\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(0))
+	data := makeLines(r, 1<<20, 200)
+	chunks := chunkAllWithSplitter(t, data, splitter)
+	checkChunks(t, data, chunks, 0, params.MaxSize)
+
+	mask := params.Mask()
+	for ii, chunk := range chunks {
+		if chunk.Data[chunk.Length-1] != '\n' {
+			t.Fatal(fmt.Sprintf("chunk %d splits a record", ii))
+		}
+		if chunk.Length < params.MinSize {
+			t.Error(fmt.Sprintf("chunk %d: length %d < min", ii, chunk.Length))
+		}
+		fp := RabinFingerprintFixed(chunk.Data[chunk.Length-params.WindowSize:])
+		if fp != chunk.Fingerprint {
+			t.Error(fmt.Sprintf("chunk %d: fingerprint mismatch", ii))
+		}
+
+		// The cut must be at the first newline after the Rabin condition.
+		fired := -1
+		for n := params.MinSize; n <= chunk.Length; n++ {
+			hash := New()
+			hash.Write(chunk.Data[n-params.WindowSize : n])
+			if hash.Sum64()&mask == mask {
+				fired = n
+				break
+			}
+		}
+		if fired < 0 {
+			if ii != len(chunks)-1 {
+				t.Error(fmt.Sprintf("chunk %d: cut without a match", ii))
+			}
+			continue
+		}
+		if nl := bytes.IndexByte(chunk.Data[fired-1:], '\n'); fired+nl != chunk.Length {
+			t.Error(fmt.Sprintf("chunk %d: cut at %d, not at the newline after %d",
+				ii, chunk.Length, fired))
+		}
+	}
+}
+
+// Without a Rabin match before MaxSize, chunks end at the last record.
+func Test_DelimiterSplitterFallback(t *testing.T) {
+	params := DefaultChunkerParams()
+	params.AvgSize = 1 << 30
+	splitter, err := NewDelimiterSplitter(params, '\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	data := makeLines(r, 1<<20, 5000)
+	chunks := chunkAllWithSplitter(t, data, splitter)
+	checkChunks(t, data, chunks, 0, params.MaxSize)
+
+	for ii, chunk := range chunks {
+		if chunk.Data[chunk.Length-1] != '\n' {
+			t.Fatal(fmt.Sprintf("chunk %d splits a record", ii))
+		}
+		// No newline may remain in the next MaxSize - Length bytes.
+		if ii == len(chunks)-1 {
+			continue
+		}
+		end := chunk.Offset + int64(params.MaxSize)
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		next := data[chunk.Offset+int64(chunk.Length) : end]
+		if bytes.IndexByte(next, '\n') >= 0 {
+			t.Error(fmt.Sprintf("chunk %d does not end at the last newline", ii))
+		}
+	}
+
+	// A record longer than MaxSize must be cut.
+	long := append(bytes.Repeat([]byte{'x'}, 3*params.MaxSize), '\n')
+	chunks = chunkAllWithSplitter(t, long, splitter)
+	checkChunks(t, long, chunks, 0, params.MaxSize)
+	if len(chunks) != 4 {
+		t.Error(fmt.Sprintf("%d chunks for an oversized record", len(chunks)))
+	}
+}
+
+// Length-prefixed records with a 4 byte big-endian length.
+func Test_RecordSplitterLengthPrefixed(t *testing.T) {
+	params := DefaultChunkerParams()
+	isBoundary := func(data []byte, n int) bool {
+		offset := 0
+		for offset+4 <= n {
+			offset += 4 + int(binary.BigEndian.Uint32(data[offset:]))
+		}
+		return offset == n
+	}
+	splitter, err := NewRecordSplitter(params, isBoundary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(2))
+	buff := new(bytes.Buffer)
+	records := map[int]bool{0: true}
+	for buff.Len() < 256*1024 {
+		record := make([]byte, r.Intn(1000))
+		r.Read(record)
+		binary.Write(buff, binary.BigEndian, uint32(len(record)))
+		buff.Write(record)
+		records[buff.Len()] = true
+	}
+	data := buff.Bytes()
+
+	chunks := chunkAllWithSplitter(t, data, splitter)
+	checkChunks(t, data, chunks, 0, params.MaxSize)
+	for ii, chunk := range chunks {
+		if !records[int(chunk.Offset)+chunk.Length] {
+			t.Error(fmt.Sprintf("chunk %d splits a record", ii))
+		}
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// Returned (wrapped) when redundancy elimination parameters are
+	// inconsistent.
+	ErrRedundancyParams = errors.New("rabin: invalid redundancy elimination parameters")
+	// Returned (wrapped) when a redundancy-eliminated stream is malformed
+	// or was encoded with different parameters.
+	ErrRedundancyStream = errors.New("rabin: invalid redundancy elimination stream")
+)
+
+// Packet-level redundancy elimination, after Spring and Wetherall, "A
+// Protocol-Independent Technique for Eliminating Redundant Network
+// Traffic" (SIGCOMM 2000).
+//
+// The stream begins with the magic, a version byte and the parameters.
+// Each Write is then sent as one or more messages of at most
+// kRedundancyMaxMessage payload bytes: a uvarint length followed by ops.
+// A literal op is kRedundancyLiteral, a uvarint length and the bytes.  A
+// copy op is kRedundancyCopy, the uvarint distance back from the end of
+// the cache and a uvarint length.  After each message, both sides append
+// its payload to their caches.
+const (
+	kRedundancyMagic   = "RBRE"
+	kRedundancyVersion = 1
+
+	kRedundancyLiteral = 1
+	kRedundancyCopy    = 2
+
+	kRedundancyMaxMessage = 64 * 1024
+)
+
+// Parameters for redundancy elimination, which must match on both ends.
+type RedundancyParams struct {
+	// The bytes of past payloads that are cached.  Defaults to 16MB.
+	CacheSize int
+
+	// The window of the fingerprints that locate repeated regions, and
+	// so the shortest region that is eliminated.  Defaults to 64.
+	WindowSize int
+
+	// Representative fingerprints are those f with f & SampleMask == 0,
+	// so about one window in SampleMask+1 is indexed.  SampleMask must be
+	// one less than a power of two and less than CacheSize.  Defaults to
+	// 31.
+	SampleMask uint64
+}
+
+func (p RedundancyParams) withDefaults() (RedundancyParams, error) {
+	if p.CacheSize == 0 {
+		p.CacheSize = 16 << 20
+	}
+	if p.WindowSize == 0 {
+		p.WindowSize = 64
+	}
+	if p.SampleMask == 0 {
+		p.SampleMask = 31
+	}
+	if p.WindowSize < 0 || p.CacheSize < p.WindowSize ||
+		p.SampleMask+1 == 0 || p.SampleMask&(p.SampleMask+1) != 0 ||
+		p.SampleMask >= uint64(p.CacheSize) {
+		return p, fmt.Errorf("%w: %+v", ErrRedundancyParams, p)
+	}
+	return p, nil
+}
+
+func (p RedundancyParams) header() []byte {
+	b := []byte(kRedundancyMagic)
+	b = append(b, kRedundancyVersion)
+	b = binary.AppendUvarint(b, uint64(p.CacheSize))
+	b = binary.AppendUvarint(b, uint64(p.WindowSize))
+	return binary.BigEndian.AppendUint64(b, p.SampleMask)
+}
+
+// Counts the payload bytes passed through an encoder and the bytes it
+// sent for them.
+type RedundancyStats struct {
+	Payload int64
+	Encoded int64
+	// The number of copy ops.
+	Copies int
+}
+
+// The last CacheSize bytes of a stream.
+type byteCache struct {
+	data []byte
+	// The number of bytes ever appended.
+	total int64
+}
+
+// Whether the cache holds [pos, pos+n) of the stream.
+func (c *byteCache) holds(pos, n int64) bool {
+	return pos >= 0 && pos >= c.total-int64(len(c.data)) && pos+n <= c.total
+}
+
+func (c *byteCache) at(pos int64) byte {
+	return c.data[pos%int64(len(c.data))]
+}
+
+func (c *byteCache) append(p []byte) {
+	size := int64(len(c.data))
+	if int64(len(p)) > size {
+		c.total += int64(len(p)) - size
+		p = p[int64(len(p))-size:]
+	}
+	offset := int(c.total % size)
+	n := copy(c.data[offset:], p)
+	copy(c.data, p[n:])
+	c.total += int64(len(p))
+}
+
+// Appends [pos, pos+n) of the stream, which the cache must hold, to b.
+func (c *byteCache) appendRange(b []byte, pos, n int64) []byte {
+	for n > 0 {
+		offset := pos % int64(len(c.data))
+		piece := c.data[offset:]
+		if int64(len(piece)) > n {
+			piece = piece[:n]
+		}
+		b = append(b, piece...)
+		pos += int64(len(piece))
+		n -= int64(len(piece))
+	}
+	return b
+}
+
+// Encodes writes for a RedundancyDecoder with the same parameters.
+// Writes are not safe for concurrent use.
+type RedundancyEncoder struct {
+	w      io.Writer
+	params RedundancyParams
+	hash   *digest
+	cache  byteCache
+
+	// Maps representative fingerprints to their stream positions plus
+	// one.  Collisions overwrite older entries, and entries are verified
+	// against the cache before use.
+	table     []int64
+	tableMask uint64
+
+	wroteHeader bool
+	stats       RedundancyStats
+}
+
+// Returns an encoder that writes to w.
+func NewRedundancyEncoder(w io.Writer, params RedundancyParams) (*RedundancyEncoder, error) {
+	params, err := params.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := newRollingDigest(nil, params.WindowSize)
+	if err != nil {
+		return nil, err
+	}
+	// Size the table for about two slots per representative window.
+	// SampleMask+1 is a power of two no larger than CacheSize.
+	tableSize := 1
+	for uint64(tableSize)*(params.SampleMask+1) < 2*uint64(params.CacheSize) {
+		tableSize <<= 1
+	}
+	return &RedundancyEncoder{
+		w:         w,
+		params:    params,
+		hash:      hash,
+		cache:     byteCache{data: make([]byte, params.CacheSize)},
+		table:     make([]int64, tableSize),
+		tableMask: uint64(tableSize - 1),
+	}, nil
+}
+
+func (e *RedundancyEncoder) Stats() RedundancyStats {
+	return e.stats
+}
+
+// Encodes p and writes it to the underlying writer, as one message per
+// kRedundancyMaxMessage bytes.
+func (e *RedundancyEncoder) Write(p []byte) (int, error) {
+	var b []byte
+	if !e.wroteHeader {
+		b = e.params.header()
+		e.wroteHeader = true
+	}
+	written := 0
+	for len(p) > 0 {
+		payload := p
+		if len(payload) > kRedundancyMaxMessage {
+			payload = payload[:kRedundancyMaxMessage]
+		}
+		body := e.encode(payload)
+		b = binary.AppendUvarint(b, uint64(len(body)))
+		b = append(b, body...)
+		if _, err := e.w.Write(b); err != nil {
+			return written, err
+		}
+		e.stats.Payload += int64(len(payload))
+		e.stats.Encoded += int64(len(b))
+
+		e.index(payload)
+		e.cache.append(payload)
+		written += len(payload)
+		p = p[len(payload):]
+		b = b[:0]
+	}
+	return written, nil
+}
+
+// Returns the ops that encode payload against the cache.
+func (e *RedundancyEncoder) encode(payload []byte) []byte {
+	window := e.params.WindowSize
+	body := []byte{}
+	emitted := 0
+	for start := 0; start+window <= len(payload); {
+		e.hash.Reset()
+		e.hash.Write(payload[start : start+window])
+		fp := e.hash.Sum64()
+
+		// Slide the window until it is found in the cache.
+		matched := false
+		for {
+			if fp&e.params.SampleMask == 0 {
+				if from, to, pos, ok := e.match(payload, start, emitted, fp); ok {
+					if from > emitted {
+						body = appendLiteral(body, payload[emitted:from])
+					}
+					body = append(body, kRedundancyCopy)
+					body = binary.AppendUvarint(body, uint64(e.cache.total-pos))
+					body = binary.AppendUvarint(body, uint64(to-from))
+					e.stats.Copies++
+					emitted, start, matched = to, to, true
+					break
+				}
+			}
+			if start+window >= len(payload) {
+				break
+			}
+			fp = e.hash.rollByte(payload[start], payload[start+window])
+			start++
+		}
+		if !matched {
+			break
+		}
+	}
+	if emitted < len(payload) {
+		body = appendLiteral(body, payload[emitted:])
+	}
+	return body
+}
+
+func appendLiteral(body, data []byte) []byte {
+	body = append(body, kRedundancyLiteral)
+	body = binary.AppendUvarint(body, uint64(len(data)))
+	return append(body, data...)
+}
+
+// Looks up the window of payload at start, whose fingerprint is fp, and
+// expands a match in both directions, but not before emitted.  Returns
+// the matching range of payload and the stream position of its copy.
+func (e *RedundancyEncoder) match(payload []byte, start, emitted int, fp uint64) (int, int, int64, bool) {
+	window := e.params.WindowSize
+	pos := e.table[fp&e.tableMask] - 1
+	if pos < 0 || !e.cache.holds(pos, int64(window)) {
+		return 0, 0, 0, false
+	}
+	for ii := 0; ii < window; ii++ {
+		if e.cache.at(pos+int64(ii)) != payload[start+ii] {
+			return 0, 0, 0, false
+		}
+	}
+
+	from := start
+	for from > emitted && e.cache.holds(pos-1, 1) && e.cache.at(pos-1) == payload[from-1] {
+		from--
+		pos--
+	}
+	to := start + window
+	for to < len(payload) && pos+int64(to-from) < e.cache.total &&
+		e.cache.at(pos+int64(to-from)) == payload[to] {
+		to++
+	}
+	return from, to, pos, true
+}
+
+// Adds the representative fingerprints of payload, which is about to be
+// appended to the cache, to the table.
+func (e *RedundancyEncoder) index(payload []byte) {
+	window := e.params.WindowSize
+	if len(payload) < window {
+		return
+	}
+	e.hash.Reset()
+	e.hash.Write(payload[:window])
+	fp := e.hash.Sum64()
+	for ii := window; ; ii++ {
+		if fp&e.params.SampleMask == 0 {
+			e.table[fp&e.tableMask] = e.cache.total + int64(ii-window) + 1
+		}
+		if ii == len(payload) {
+			break
+		}
+		fp = e.hash.rollByte(payload[ii-window], payload[ii])
+	}
+}
+
+// Decodes the stream of a RedundancyEncoder with the same parameters.
+type RedundancyDecoder struct {
+	r      *bufio.Reader
+	params RedundancyParams
+	cache  byteCache
+
+	readHeader bool
+	// Decoded data that has not been read.
+	pending []byte
+	buff    []byte
+	err     error
+}
+
+// Returns a decoder that reads from r.
+func NewRedundancyDecoder(r io.Reader, params RedundancyParams) (*RedundancyDecoder, error) {
+	params, err := params.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &RedundancyDecoder{
+		r:      bufio.NewReader(r),
+		params: params,
+		cache:  byteCache{data: make([]byte, params.CacheSize)},
+	}, nil
+}
+
+// Reads decoded data.  Errors are sticky.
+func (d *RedundancyDecoder) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 && len(p) > 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.readMessage()
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *RedundancyDecoder) readMessage() error {
+	if !d.readHeader {
+		header := d.params.header()
+		got := make([]byte, len(header))
+		if _, err := io.ReadFull(d.r, got); err != nil {
+			return err
+		}
+		if !bytes.Equal(got, header) {
+			return fmt.Errorf("%w: bad header or parameters", ErrRedundancyStream)
+		}
+		d.readHeader = true
+	}
+
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return err
+	}
+	// Literals cost at most a few bytes more than their payload.
+	if size > 2*kRedundancyMaxMessage {
+		return fmt.Errorf("%w: message of %d bytes", ErrRedundancyStream, size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(d.r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	out := d.buff[:0]
+	for len(body) > 0 && err == nil {
+		op := body[0]
+		body = body[1:]
+		switch op {
+		case kRedundancyLiteral:
+			var n uint64
+			if n, body, err = readRedundancyUvarint(body); err == nil {
+				if n > uint64(len(body)) {
+					err = fmt.Errorf("%w: truncated literal", ErrRedundancyStream)
+					break
+				}
+				out = append(out, body[:n]...)
+				body = body[n:]
+			}
+		case kRedundancyCopy:
+			var distance, n uint64
+			if distance, body, err = readRedundancyUvarint(body); err == nil {
+				n, body, err = readRedundancyUvarint(body)
+			}
+			if err != nil {
+				break
+			}
+			pos := d.cache.total - int64(distance)
+			if distance > uint64(d.cache.total) || n > kRedundancyMaxMessage ||
+				!d.cache.holds(pos, int64(n)) {
+				err = fmt.Errorf("%w: copy of %d bytes at distance %d",
+					ErrRedundancyStream, n, distance)
+				break
+			}
+			out = d.cache.appendRange(out, pos, int64(n))
+		default:
+			err = fmt.Errorf("%w: op %d", ErrRedundancyStream, op)
+		}
+		if err == nil && len(out) > kRedundancyMaxMessage {
+			err = fmt.Errorf("%w: message exceeds %d bytes", ErrRedundancyStream, kRedundancyMaxMessage)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(out) == 0 {
+		return fmt.Errorf("%w: empty message", ErrRedundancyStream)
+	}
+
+	d.cache.append(out)
+	d.buff = out
+	d.pending = out
+	return nil
+}
+
+func readRedundancyUvarint(b []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("%w: bad uvarint", ErrRedundancyStream)
+	}
+	return v, b[n:], nil
+}
+
+// Wraps a connection so that writes are encoded and reads are decoded,
+// with a cache for each direction.  Both ends must use the same
+// parameters.  Stats describes the writes.
+type RedundancyConn struct {
+	*RedundancyEncoder
+	decoder *RedundancyDecoder
+}
+
+func NewRedundancyConn(rw io.ReadWriter, params RedundancyParams) (*RedundancyConn, error) {
+	encoder, err := NewRedundancyEncoder(rw, params)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := NewRedundancyDecoder(rw, params)
+	if err != nil {
+		return nil, err
+	}
+	return &RedundancyConn{RedundancyEncoder: encoder, decoder: decoder}, nil
+}
+
+func (c *RedundancyConn) Read(p []byte) (int, error) {
+	return c.decoder.Read(p)
+}
@@ -0,0 +1,215 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// Returns packets that resemble responses built from a few templates with
+// small per-packet changes.
+func makePackets(r *rand.Rand, numPackets int) [][]byte {
+	templates := make([][]byte, 8)
+	for ii := range templates {
+		templates[ii] = make([]byte, 500+r.Intn(8000))
+		r.Read(templates[ii])
+	}
+	packets := make([][]byte, numPackets)
+	for ii := range packets {
+		packet := append([]byte{}, templates[r.Intn(len(templates))]...)
+		// A unique header and an edit in the body.
+		header := []byte(fmt.Sprintf("packet %d %d\r\n", ii, r.Int63()))
+		packet = append(header, packet...)
+		copy(packet[r.Intn(len(packet)):], fmt.Sprintf("%x", r.Int63()))
+		packets[ii] = packet
+	}
+	return packets
+}
+
+// Writes packets to one end of a pipe and checks that they are decoded at
+// the other.
+func testRedundancy(t *testing.T, params RedundancyParams, packets [][]byte) RedundancyStats {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	encoder, err := NewRedundancyEncoder(client, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		for _, packet := range packets {
+			if _, err := encoder.Write(packet); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	decoder, err := NewRedundancyDecoder(server, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ii, packet := range packets {
+		got := make([]byte, len(packet))
+		if _, err := io.ReadFull(decoder, got); err != nil {
+			t.Fatal(fmt.Sprintf("packet %d: %v", ii, err))
+		}
+		if !bytes.Equal(got, packet) {
+			t.Fatal(fmt.Sprintf("packet %d differs", ii))
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return encoder.Stats()
+}
+
+func Test_Redundancy(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	packets := makePackets(r, 300)
+	total := int64(0)
+	for _, packet := range packets {
+		total += int64(len(packet))
+	}
+
+	stats := testRedundancy(t, RedundancyParams{CacheSize: 1 << 20}, packets)
+	if stats.Payload != total {
+		t.Error(fmt.Sprintf("payload %d != %d", stats.Payload, total))
+	}
+	if stats.Encoded > total/5 || stats.Copies < len(packets) {
+		t.Error(fmt.Sprintf("%d bytes encoded as %d with %d copies",
+			total, stats.Encoded, stats.Copies))
+	}
+
+	// A cache smaller than a template still round trips, with less
+	// savings.
+	small := RedundancyParams{CacheSize: 4096, WindowSize: 32, SampleMask: 7}
+	stats = testRedundancy(t, small, packets)
+	if stats.Payload != total {
+		t.Error(fmt.Sprintf("small cache: payload %d != %d", stats.Payload, total))
+	}
+
+	// Unique data is sent nearly as is, and writes larger than a message
+	// are split.
+	unique := make([]byte, 3*kRedundancyMaxMessage+10)
+	r.Read(unique)
+	stats = testRedundancy(t, RedundancyParams{}, [][]byte{unique, []byte("x"), unique})
+	if stats.Encoded > int64(len(unique))+1000 {
+		t.Error(fmt.Sprintf("unique data encoded as %d bytes", stats.Encoded))
+	}
+}
+
+// Both directions of one connection.
+func Test_RedundancyConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	params := RedundancyParams{CacheSize: 1 << 20}
+	connA, err := NewRedundancyConn(a, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connB, err := NewRedundancyConn(b, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each side echoes back what it receives, in turn.
+	packets := makePackets(rand.New(rand.NewSource(1)), 50)
+	go func() {
+		for _, packet := range packets {
+			connA.Write(packet)
+			io.CopyN(io.Discard, connA, int64(len(packet)))
+		}
+	}()
+	for ii, packet := range packets {
+		got := make([]byte, len(packet))
+		if _, err := io.ReadFull(connB, got); err != nil || !bytes.Equal(got, packet) {
+			t.Fatal(fmt.Sprintf("packet %d: %v", ii, err))
+		}
+		if _, err := connB.Write(got); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := connB.Stats(); stats.Copies == 0 || stats.Encoded >= stats.Payload/2 {
+		t.Error(fmt.Sprintf("echo stats %+v", stats))
+	}
+}
+
+func Test_RedundancyErrors(t *testing.T) {
+	badParams := []RedundancyParams{
+		{SampleMask: 6},
+		{SampleMask: ^uint64(0)},
+		{CacheSize: 1024, SampleMask: 2047},
+	}
+	for _, params := range badParams {
+		if _, err := NewRedundancyEncoder(io.Discard, params); !errors.Is(err, ErrRedundancyParams) {
+			t.Error(fmt.Sprintf("%+v: %v", params, err))
+		}
+		if _, err := NewRedundancyDecoder(bytes.NewReader(nil), params); !errors.Is(err, ErrRedundancyParams) {
+			t.Error(fmt.Sprintf("decoder %+v: %v", params, err))
+		}
+	}
+
+	params := RedundancyParams{CacheSize: 1 << 16}
+	packet := make([]byte, 1000)
+	rand.New(rand.NewSource(2)).Read(packet)
+	buff := new(bytes.Buffer)
+	encoder, _ := NewRedundancyEncoder(buff, params)
+	encoder.Write(packet)
+	encoder.Write(packet)
+	stream := buff.Bytes()
+
+	decode := func(stream []byte, params RedundancyParams) error {
+		decoder, _ := NewRedundancyDecoder(bytes.NewReader(stream), params)
+		_, err := io.ReadAll(decoder)
+		return err
+	}
+	if err := decode(stream, params); err != nil {
+		t.Fatal(err)
+	}
+	if err := decode(stream, RedundancyParams{CacheSize: 1 << 17}); !errors.Is(err, ErrRedundancyStream) {
+		t.Error(fmt.Sprintf("mismatched parameters: %v", err))
+	}
+	if err := decode(stream[:len(stream)-1], params); err != io.ErrUnexpectedEOF {
+		t.Error(fmt.Sprintf("truncated: %v", err))
+	}
+
+	// The second packet is a single copy; point it before the stream.
+	if encoder.Stats().Copies != 1 {
+		t.Fatal(fmt.Sprintf("%d copies", encoder.Stats().Copies))
+	}
+	corrupt := append([]byte{}, stream...)
+	corrupt[len(corrupt)-4] = 0xff
+	corrupt[len(corrupt)-3] = 0x7f
+	if err := decode(corrupt, params); !errors.Is(err, ErrRedundancyStream) {
+		t.Error(fmt.Sprintf("bad copy: %v", err))
+	}
+}
+
+func Benchmark_RedundancyEncoder(b *testing.B) {
+	packets := makePackets(rand.New(rand.NewSource(3)), 1000)
+	encoder, _ := NewRedundancyEncoder(io.Discard, RedundancyParams{})
+	total := 0
+	for _, packet := range packets {
+		total += len(packet)
+	}
+	b.SetBytes(int64(total))
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		for _, packet := range packets {
+			encoder.Write(packet)
+		}
+	}
+}
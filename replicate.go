@@ -0,0 +1,275 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Returned (wrapped) when a replication peer misbehaves.
+var ErrProtocol = errors.New("rabin: replication protocol error")
+
+// The replication protocol begins with the magic and a version byte from
+// the sender.  Then the sender repeatedly advertises a batch of IDs in a
+// have message, and the receiver answers with a want message listing the
+// IDs it lacks, which the sender follows with one blob message for each.
+// A done message from the sender, acknowledged by a done message from the
+// receiver, ends the exchange.
+//
+// Messages consist of a type byte, a uvarint payload length and the
+// payload.  Have and want payloads are big-endian IDs.  A blob payload is
+// the big-endian ID followed by the data.  Chunks are identified by
+// ChunkIDOf, so the receiver verifies each blob against its ID.
+const (
+	kReplicationMagic   = "RBRP"
+	kReplicationVersion = 1
+
+	kMsgHave = 1
+	kMsgWant = 2
+	kMsgBlob = 3
+	kMsgDone = 4
+
+	kMaxMessageSize = 64 << 20
+
+	kDefaultBatchSize = 1024
+)
+
+// A ChunkStore whose chunks can be listed, such as a FileStore.
+type WalkableStore interface {
+	ChunkStore
+	Walk(fn func(id ChunkID) error) error
+}
+
+// Counts what a replication exchange did.
+type ReplicationStats struct {
+	// IDs advertised by the sender.
+	Advertised int
+	// Blobs transferred.
+	Transferred int
+	Bytes       int64
+}
+
+func writeMessage(w *bufio.Writer, msgType byte, payload []byte) error {
+	w.WriteByte(msgType)
+	w.Write(binary.AppendUvarint(nil, uint64(len(payload))))
+	_, err := w.Write(payload)
+	return err
+}
+
+func readMessage(r *bufio.Reader) (byte, []byte, error) {
+	msgType, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > kMaxMessageSize {
+		return 0, nil, fmt.Errorf("%w: message of %d bytes", ErrProtocol, size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return msgType, payload, nil
+}
+
+// Reads a message of the given type.
+func expectMessage(r *bufio.Reader, msgType byte) ([]byte, error) {
+	got, payload, err := readMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if got != msgType {
+		return nil, fmt.Errorf("%w: message type %d, expected %d", ErrProtocol, got, msgType)
+	}
+	return payload, nil
+}
+
+func encodeIDs(ids []ChunkID) []byte {
+	b := make([]byte, 0, 8*len(ids))
+	for _, id := range ids {
+		b = binary.BigEndian.AppendUint64(b, uint64(id))
+	}
+	return b
+}
+
+func decodeIDs(b []byte) ([]ChunkID, error) {
+	if len(b)%8 != 0 {
+		return nil, fmt.Errorf("%w: ID list of %d bytes", ErrProtocol, len(b))
+	}
+	ids := make([]ChunkID, len(b)/8)
+	for ii := range ids {
+		ids[ii] = ChunkID(binary.BigEndian.Uint64(b[8*ii:]))
+	}
+	return ids, nil
+}
+
+// Sends the chunks of src that the receiver at the other end of conn (see
+// ReceiveChunks) lacks, advertising IDs in batches of batchSize (1024 if
+// batchSize <= 0).  conn is typically a net.Conn.
+//
+// The receiver stores each chunk as soon as it arrives, so after a
+// disconnect, repeating the exchange transfers only the chunks that are
+// still missing.
+func SendChunks(conn io.ReadWriter, src WalkableStore, batchSize int) (ReplicationStats, error) {
+	if batchSize <= 0 {
+		batchSize = kDefaultBatchSize
+	}
+	var stats ReplicationStats
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	w.WriteString(kReplicationMagic)
+	w.WriteByte(kReplicationVersion)
+
+	batch := make([]ChunkID, 0, batchSize)
+	sendBatch := func() error {
+		stats.Advertised += len(batch)
+		if err := writeMessage(w, kMsgHave, encodeIDs(batch)); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		payload, err := expectMessage(r, kMsgWant)
+		if err != nil {
+			return err
+		}
+		wanted, err := decodeIDs(payload)
+		if err != nil {
+			return err
+		}
+
+		advertised := make(map[ChunkID]bool, len(batch))
+		for _, id := range batch {
+			advertised[id] = true
+		}
+		for _, id := range wanted {
+			if !advertised[id] {
+				return fmt.Errorf("%w: unadvertised chunk %s wanted", ErrProtocol, id)
+			}
+			data, err := src.Get(id)
+			if err != nil {
+				return err
+			}
+			blob := make([]byte, 0, 8+len(data))
+			blob = binary.BigEndian.AppendUint64(blob, uint64(id))
+			blob = append(blob, data...)
+			if err := writeMessage(w, kMsgBlob, blob); err != nil {
+				return err
+			}
+			stats.Transferred++
+			stats.Bytes += int64(len(data))
+		}
+		batch = batch[:0]
+		return w.Flush()
+	}
+
+	err := src.Walk(func(id ChunkID) error {
+		batch = append(batch, id)
+		if len(batch) == batchSize {
+			return sendBatch()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = sendBatch()
+	}
+	if err == nil {
+		err = writeMessage(w, kMsgDone, nil)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		_, err = expectMessage(r, kMsgDone)
+	}
+	return stats, err
+}
+
+// Receives chunks from a sender at the other end of conn (see SendChunks)
+// into dst.  Each chunk is verified against its ID, which must be its
+// ChunkIDOf, before it is stored.  Stores with other IDs, such as those
+// holding the sealed chunks of an EncryptedWriter, cannot be verified
+// without their keys and so cannot be replicated; their chunks fail with a
+// ChunkError.
+func ReceiveChunks(conn io.ReadWriter, dst ChunkStore) (ReplicationStats, error) {
+	var stats ReplicationStats
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	header := make([]byte, len(kReplicationMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return stats, err
+	}
+	if string(header[:len(kReplicationMagic)]) != kReplicationMagic ||
+		header[len(kReplicationMagic)] != kReplicationVersion {
+		return stats, fmt.Errorf("%w: bad header", ErrProtocol)
+	}
+
+	for {
+		msgType, payload, err := readMessage(r)
+		if err != nil {
+			return stats, err
+		}
+		switch msgType {
+		case kMsgDone:
+			if err := writeMessage(w, kMsgDone, nil); err != nil {
+				return stats, err
+			}
+			return stats, w.Flush()
+
+		case kMsgHave:
+			ids, err := decodeIDs(payload)
+			if err != nil {
+				return stats, err
+			}
+			stats.Advertised += len(ids)
+			wanted := []ChunkID{}
+			for _, id := range ids {
+				ok, err := dst.Has(id)
+				if err != nil {
+					return stats, err
+				}
+				if !ok {
+					wanted = append(wanted, id)
+				}
+			}
+			if err := writeMessage(w, kMsgWant, encodeIDs(wanted)); err != nil {
+				return stats, err
+			}
+			if err := w.Flush(); err != nil {
+				return stats, err
+			}
+
+			for _, id := range wanted {
+				blob, err := expectMessage(r, kMsgBlob)
+				if err != nil {
+					return stats, err
+				}
+				if len(blob) < 8 || ChunkID(binary.BigEndian.Uint64(blob)) != id {
+					return stats, fmt.Errorf("%w: expected chunk %s", ErrProtocol, id)
+				}
+				data := blob[8:]
+				if ChunkIDOf(data) != id {
+					return stats, &ChunkError{ID: id, Err: ErrChunkCorrupt}
+				}
+				if err := dst.Put(id, data); err != nil {
+					return stats, err
+				}
+				stats.Transferred++
+				stats.Bytes += int64(len(data))
+			}
+
+		default:
+			return stats, fmt.Errorf("%w: unexpected message type %d", ErrProtocol, msgType)
+		}
+	}
+}
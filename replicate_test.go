@@ -0,0 +1,185 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// Fills a store with numChunks chunks of random data and returns their IDs.
+func fillStore(t *testing.T, store ChunkStore, seed int64, numChunks int) []ChunkID {
+	data := makeRandomData(seed, numChunks*1000)
+	ids := make([]ChunkID, numChunks)
+	for ii := range ids {
+		chunk := data[ii*1000 : (ii+1)*1000]
+		ids[ii] = ChunkIDOf(chunk)
+		if err := store.Put(ids[ii], chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+// Runs a sender and receiver over the two ends of a connection.
+func replicate(sendConn, recvConn net.Conn, src WalkableStore, dst ChunkStore, batchSize int) (sent, received ReplicationStats, sendErr, recvErr error) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		received, recvErr = ReceiveChunks(recvConn, dst)
+		recvConn.Close()
+	}()
+	sent, sendErr = SendChunks(sendConn, src, batchSize)
+	sendConn.Close()
+	<-done
+	return
+}
+
+// Checks that dst holds every chunk of src.
+func checkReplica(t *testing.T, src WalkableStore, dst ChunkStore) {
+	src.Walk(func(id ChunkID) error {
+		want, _ := src.Get(id)
+		got, err := dst.Get(id)
+		if err != nil || string(got) != string(want) {
+			t.Error(fmt.Sprintf("chunk %s: %v", id, err))
+		}
+		return nil
+	})
+}
+
+func Test_Replicate(t *testing.T) {
+	src, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := fillStore(t, src, 0, 500)
+	// The receiver already has some chunks.
+	for _, id := range ids[:100] {
+		data, _ := src.Get(id)
+		dst.Put(id, data)
+	}
+
+	sendConn, recvConn := net.Pipe()
+	sent, received, sendErr, recvErr := replicate(sendConn, recvConn, src, dst, 64)
+	if sendErr != nil || recvErr != nil {
+		t.Fatal(fmt.Sprintf("send: %v, receive: %v", sendErr, recvErr))
+	}
+	if sent.Advertised != 500 || sent.Transferred != 400 || sent.Bytes != 400*1000 {
+		t.Error(fmt.Sprintf("sent %+v", sent))
+	}
+	if received != sent {
+		t.Error(fmt.Sprintf("received %+v, sent %+v", received, sent))
+	}
+	checkReplica(t, src, dst)
+
+	// Nothing is transferred a second time, here over loopback.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	sendConn, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, _, sendErr, recvErr = replicate(sendConn, <-accepted, src, dst, 0)
+	if sendErr != nil || recvErr != nil {
+		t.Fatal(fmt.Sprintf("send: %v, receive: %v", sendErr, recvErr))
+	}
+	if sent.Transferred != 0 {
+		t.Error(fmt.Sprintf("resent %d chunks", sent.Transferred))
+	}
+}
+
+// A connection that fails after writing limit bytes.
+type cutConn struct {
+	net.Conn
+	limit int
+}
+
+func (c *cutConn) Write(p []byte) (int, error) {
+	if len(p) > c.limit {
+		n, _ := c.Conn.Write(p[:c.limit])
+		c.limit = 0
+		c.Conn.Close()
+		return n, errors.New("disconnected")
+	}
+	c.limit -= len(p)
+	return c.Conn.Write(p)
+}
+
+func Test_ReplicateResume(t *testing.T) {
+	src := NewMemoryStore()
+	dst := NewMemoryStore()
+	fillStore(t, src, 1, 300)
+
+	sendConn, recvConn := net.Pipe()
+	sent, received, sendErr, recvErr := replicate(&cutConn{Conn: sendConn, limit: 150000},
+		recvConn, src, dst, 32)
+	if sendErr == nil || recvErr == nil {
+		t.Fatal(fmt.Sprintf("send: %v, receive: %v", sendErr, recvErr))
+	}
+	if received.Transferred == 0 || received.Transferred >= 300 {
+		t.Fatal(fmt.Sprintf("received %d chunks before disconnecting", received.Transferred))
+	}
+	first := received.Transferred
+
+	sendConn, recvConn = net.Pipe()
+	sent, _, sendErr, recvErr = replicate(sendConn, recvConn, src, dst, 32)
+	if sendErr != nil || recvErr != nil {
+		t.Fatal(fmt.Sprintf("send: %v, receive: %v", sendErr, recvErr))
+	}
+	if sent.Transferred != 300-first {
+		t.Error(fmt.Sprintf("resumed with %d chunks after %d", sent.Transferred, first))
+	}
+	checkReplica(t, src, dst)
+}
+
+func Test_ReplicateCorrupt(t *testing.T) {
+	sendConn, recvConn := net.Pipe()
+	dst := NewMemoryStore()
+	errs := make(chan error)
+	go func() {
+		_, err := ReceiveChunks(recvConn, dst)
+		recvConn.Close()
+		errs <- err
+	}()
+
+	// A blob whose data does not match its ID.
+	r := bufio.NewReader(sendConn)
+	w := bufio.NewWriter(sendConn)
+	w.WriteString(kReplicationMagic)
+	w.WriteByte(kReplicationVersion)
+	writeMessage(w, kMsgHave, encodeIDs([]ChunkID{7}))
+	w.Flush()
+	if _, err := expectMessage(r, kMsgWant); err != nil {
+		t.Fatal(err)
+	}
+	blob := binary.BigEndian.AppendUint64(nil, 7)
+	blob = append(blob, "data"...)
+	writeMessage(w, kMsgBlob, blob)
+	w.Flush()
+
+	if err := <-errs; !errors.Is(err, ErrChunkCorrupt) {
+		t.Error(fmt.Sprintf("corrupt blob: %v", err))
+	}
+	if ok, _ := dst.Has(7); ok {
+		t.Error("corrupt blob was stored")
+	}
+	sendConn.Close()
+}
@@ -0,0 +1,330 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Returned when a serialized ChunkerState is malformed or inconsistent.
+var ErrInvalidState = errors.New("rabin: invalid chunker state")
+
+const (
+	kChunkerStateMagic   = "RBCS"
+	kChunkerStateVersion = 1
+)
+
+// The scan state of a ResumableChunker between two bytes of the stream.
+type ChunkerState struct {
+	Params ChunkerParams
+
+	// The stream offset of the next byte to scan.  A resumed chunker
+	// must read from this offset.
+	Offset int64
+
+	// The fingerprint of Window.  This is only meaningful once
+	// len(Pending) >= Params.MinSize, since no window is hashed before
+	// then.
+	Digest uint64
+
+	// The last Params.WindowSize bytes of Pending, or all of Pending if it
+	// is shorter.
+	Window []byte
+
+	// The bytes since the last cut.
+	Pending []byte
+}
+
+// Serializes the state, including the polynomial, if any.
+func (s *ChunkerState) MarshalBinary() ([]byte, error) {
+	b := []byte(kChunkerStateMagic)
+	b = append(b, kChunkerStateVersion)
+
+	p := &s.Params
+	b = binary.AppendUvarint(b, uint64(p.MinSize))
+	b = binary.AppendUvarint(b, uint64(p.AvgSize))
+	b = binary.AppendUvarint(b, uint64(p.MaxSize))
+	b = binary.AppendUvarint(b, uint64(p.WindowSize))
+	b = binary.BigEndian.AppendUint64(b, p.Target)
+	if p.Polynomial == nil {
+		b = append(b, 0)
+	} else {
+		coeffs, err := polynomialCoeffs(p.Polynomial)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, 1)
+		b = binary.BigEndian.AppendUint64(b, coeffs)
+	}
+
+	b = binary.AppendVarint(b, s.Offset)
+	b = binary.BigEndian.AppendUint64(b, s.Digest)
+	b = binary.AppendUvarint(b, uint64(len(s.Window)))
+	b = append(b, s.Window...)
+	b = binary.AppendUvarint(b, uint64(len(s.Pending)))
+	b = append(b, s.Pending...)
+	return b, nil
+}
+
+// Parses the output of MarshalBinary.  The result is not checked for
+// consistency until it is passed to ResumeChunker.
+func (s *ChunkerState) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(kChunkerStateMagic)+1)
+	if _, err := io.ReadFull(r, magic); err != nil ||
+		string(magic[:len(kChunkerStateMagic)]) != kChunkerStateMagic {
+		return fmt.Errorf("%w: bad magic", ErrInvalidState)
+	}
+	if version := magic[len(kChunkerStateMagic)]; version != kChunkerStateVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidState, version)
+	}
+
+	var err error
+	readUvarint := func() int {
+		var v uint64
+		if err == nil {
+			v, err = binary.ReadUvarint(r)
+		}
+		if err == nil && v > math.MaxInt {
+			err = fmt.Errorf("value %d out of range", v)
+			return 0
+		}
+		return int(v)
+	}
+	readUint64 := func() uint64 {
+		var v uint64
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, &v)
+		}
+		return v
+	}
+	readBytes := func() []byte {
+		n := readUvarint()
+		if err != nil {
+			return nil
+		}
+		if n > r.Len() {
+			err = io.ErrUnexpectedEOF
+			return nil
+		}
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+
+	var state ChunkerState
+	p := &state.Params
+	p.MinSize = readUvarint()
+	p.AvgSize = readUvarint()
+	p.MaxSize = readUvarint()
+	p.WindowSize = readUvarint()
+	p.Target = readUint64()
+	if err == nil {
+		var hasPoly byte
+		if hasPoly, err = r.ReadByte(); err == nil && hasPoly != 0 {
+			p.Polynomial = NewPolynomialFromUint64(kIrreduciblePolyDegree, readUint64())
+		}
+	}
+	if err == nil {
+		state.Offset, err = binary.ReadVarint(r)
+	}
+	state.Digest = readUint64()
+	state.Window = readBytes()
+	state.Pending = readBytes()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: trailing data", ErrInvalidState)
+	}
+
+	*s = state
+	return nil
+}
+
+// ResumableChunker cuts the same chunks as a Chunker with a Rabin
+// splitter, but scans incrementally so that its state can be checkpointed
+// at any point with State or MarshalBinary and later restored with
+// ResumeChunker.  A resumed chunker produces exactly the boundaries that
+// an uninterrupted one would have.
+type ResumableChunker struct {
+	r      io.Reader
+	params ChunkerParams
+	mask   uint64
+	target uint64
+	hash   *digest
+
+	// Bytes since the last cut.  If cut is set, pending holds the chunk
+	// that was last returned and is discarded by the next call to Next.
+	pending []byte
+	cut     bool
+
+	// Stream offset of pending[0].
+	offset int64
+
+	// Read but unscanned data, which is not part of the state.
+	readBuff []byte
+	unread   []byte
+
+	err error
+}
+
+// Returns a chunker that cuts r, from its start, according to params.
+func NewResumableChunker(r io.Reader, params ChunkerParams) (*ResumableChunker, error) {
+	return ResumeChunker(r, &ChunkerState{Params: params})
+}
+
+// Returns a chunker that continues from state.  r must be positioned at
+// state.Offset.
+func ResumeChunker(r io.Reader, state *ChunkerState) (*ResumableChunker, error) {
+	params := state.Params
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	hash, err := newRollingDigest(params.Polynomial, params.WindowSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify that the state is self-consistent.
+	pending := state.Pending
+	if len(pending) >= params.MaxSize || int64(len(pending)) > state.Offset {
+		return nil, fmt.Errorf("%w: %d pending bytes at offset %d",
+			ErrInvalidState, len(pending), state.Offset)
+	}
+	window := pending
+	if len(window) > params.WindowSize {
+		window = window[len(window)-params.WindowSize:]
+	}
+	if !bytes.Equal(window, state.Window) {
+		return nil, fmt.Errorf("%w: window does not match pending data", ErrInvalidState)
+	}
+	if len(pending) >= params.MinSize {
+		hash.Write(window)
+		if hash.Sum64() != state.Digest {
+			return nil, fmt.Errorf("%w: digest does not match window", ErrInvalidState)
+		}
+	}
+
+	mask := params.Mask()
+	c := &ResumableChunker{
+		r:        r,
+		params:   params,
+		mask:     mask,
+		target:   params.Target & mask,
+		hash:     hash,
+		pending:  make([]byte, len(pending), params.MaxSize),
+		offset:   state.Offset - int64(len(pending)),
+		readBuff: make([]byte, kScanBufferSize),
+	}
+	copy(c.pending, pending)
+	return c, nil
+}
+
+// Returns a copy of the current scan state.
+func (c *ResumableChunker) State() *ChunkerState {
+	pending := c.pending
+	offset := c.offset
+	if c.cut {
+		offset += int64(len(pending))
+		pending = nil
+	}
+	window := pending
+	if len(window) > c.params.WindowSize {
+		window = window[len(window)-c.params.WindowSize:]
+	}
+
+	state := &ChunkerState{
+		Params:  c.params,
+		Offset:  offset + int64(len(pending)),
+		Pending: append([]byte{}, pending...),
+		Window:  append([]byte{}, window...),
+	}
+	if len(pending) >= c.params.MinSize {
+		state.Digest = c.hash.Sum64()
+	}
+	return state
+}
+
+// Serializes the current scan state.  See ChunkerState.MarshalBinary.
+func (c *ResumableChunker) MarshalBinary() ([]byte, error) {
+	return c.State().MarshalBinary()
+}
+
+// Returns the next chunk, or io.EOF once the stream is exhausted.  The
+// returned Data is only valid until the next call to Next.
+func (c *ResumableChunker) Next() (Chunk, error) {
+	if c.cut {
+		c.offset += int64(len(c.pending))
+		c.pending = c.pending[:0]
+		c.cut = false
+	}
+
+	windowSize := c.params.WindowSize
+	minSize := c.params.MinSize
+	for {
+		if len(c.unread) == 0 {
+			if c.err != nil {
+				if c.err == io.EOF && len(c.pending) > 0 {
+					return c.emit(c.finalFingerprint()), nil
+				}
+				return Chunk{}, c.err
+			}
+			var n int
+			n, c.err = c.r.Read(c.readBuff)
+			c.unread = c.readBuff[:n]
+			continue
+		}
+
+		b := c.unread[0]
+		c.unread = c.unread[1:]
+		c.pending = append(c.pending, b)
+
+		n := len(c.pending)
+		if n < minSize {
+			continue
+		}
+		var fp uint64
+		if n == minSize {
+			c.hash.Reset()
+			c.hash.Write(c.pending[minSize-windowSize:])
+			fp = c.hash.Sum64()
+		} else {
+			fp = c.hash.rollByte(c.pending[n-1-windowSize], b)
+		}
+		if fp&c.mask == c.target || n == c.params.MaxSize {
+			return c.emit(fp), nil
+		}
+	}
+}
+
+// Returns the fingerprint of the window at the end of the final chunk.
+func (c *ResumableChunker) finalFingerprint() uint64 {
+	if len(c.pending) >= c.params.MinSize {
+		return c.hash.Sum64()
+	}
+	window := c.pending
+	if len(window) > c.params.WindowSize {
+		window = window[len(window)-c.params.WindowSize:]
+	}
+	c.hash.Reset()
+	c.hash.Write(window)
+	return c.hash.Sum64()
+}
+
+func (c *ResumableChunker) emit(fp uint64) Chunk {
+	c.cut = true
+	return Chunk{
+		Offset:      c.offset,
+		Length:      len(c.pending),
+		Fingerprint: fp,
+		Data:        c.pending,
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// Returns the chunks from c, copying their data, until it returns stop.
+// Any other error is fatal.
+func readResumableUntil(t *testing.T, c *ResumableChunker, stop error) []Chunk {
+	chunks := []Chunk{}
+	for {
+		chunk, err := c.Next()
+		if err == stop {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk.Data = append([]byte{}, chunk.Data...)
+		chunks = append(chunks, chunk)
+	}
+}
+
+// The incremental scan must agree with the Rabin splitter.
+func Test_ResumableChunker(t *testing.T) {
+	params := DefaultChunkerParams()
+	params.Polynomial = FindIrreducible(64)
+	for _, size := range []int{0, 100, params.MinSize, 1 << 20} {
+		data := makeRandomData(0, size)
+		cmp := chunkAll(t, bytes.NewReader(data), params)
+
+		c, err := NewResumableChunker(bytes.NewReader(data), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareChunks(t, fmt.Sprintf("size %d", size), readResumableUntil(t, c, io.EOF), cmp)
+	}
+}
+
+// Serializes c's state and resumes from the corresponding offset of data.
+func resumeFromCheckpoint(t *testing.T, c *ResumableChunker, data []byte) *ResumableChunker {
+	checkpoint, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := new(ChunkerState)
+	if err := state.UnmarshalBinary(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := ResumeChunker(bytes.NewReader(data[state.Offset:]), state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resumed
+}
+
+// Interrupts the stream mid-chunk and resumes from the serialized state.
+func Test_ResumableChunkerInterrupted(t *testing.T) {
+	errInterrupted := errors.New("interrupted")
+	params := DefaultChunkerParams()
+	params.Polynomial = FindIrreducible(64)
+	data := makeRandomData(1, 1<<20)
+	cmp := chunkAll(t, bytes.NewReader(data), params)
+
+	for _, limit := range []int64{1, 1000, int64(params.MinSize), 100000, 500001} {
+		r := io.MultiReader(io.LimitReader(bytes.NewReader(data), limit),
+			iotest.ErrReader(errInterrupted))
+		c, err := NewResumableChunker(r, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunks := readResumableUntil(t, c, errInterrupted)
+		if state := c.State(); state.Offset != limit {
+			t.Fatal(fmt.Sprintf("limit %d: state offset %d", limit, state.Offset))
+		}
+
+		chunks = append(chunks, readResumableUntil(t, resumeFromCheckpoint(t, c, data), io.EOF)...)
+		compareChunks(t, fmt.Sprintf("limit %d", limit), chunks, cmp)
+	}
+}
+
+// Checkpoints between chunks, after the chunker has read ahead.
+func Test_ResumableChunkerBetweenChunks(t *testing.T) {
+	params := DefaultChunkerParams()
+	data := makeRandomData(2, 1<<20)
+	cmp := chunkAll(t, bytes.NewReader(data), params)
+
+	c, err := NewResumableChunker(bytes.NewReader(data), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := []Chunk{}
+	for ii := 0; ii < 10; ii++ {
+		chunk, err := c.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk.Data = append([]byte{}, chunk.Data...)
+		chunks = append(chunks, chunk)
+	}
+
+	chunks = append(chunks, readResumableUntil(t, resumeFromCheckpoint(t, c, data), io.EOF)...)
+	compareChunks(t, "between chunks", chunks, cmp)
+}
+
+func Test_ChunkerStateInvalid(t *testing.T) {
+	errInterrupted := errors.New("interrupted")
+	params := DefaultChunkerParams()
+	data := makeRandomData(3, 10000)
+	r := io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errInterrupted))
+	c, err := NewResumableChunker(r, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := c.Next(); err != nil {
+			break
+		}
+	}
+	checkpoint, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := new(ChunkerState)
+	if err := state.UnmarshalBinary(checkpoint[:len(checkpoint)-1]); !errors.Is(err, ErrInvalidState) {
+		t.Error(fmt.Sprintf("truncated: expected ErrInvalidState, got %v", err))
+	}
+	if err := state.UnmarshalBinary(append(checkpoint, 0)); !errors.Is(err, ErrInvalidState) {
+		t.Error(fmt.Sprintf("trailing: expected ErrInvalidState, got %v", err))
+	}
+
+	// Sizes and lengths that do not fit in an int.
+	negative := ChunkerState{Params: params}
+	negative.Params.MinSize = -1
+	b, _ := negative.MarshalBinary()
+	if err := state.UnmarshalBinary(b); !errors.Is(err, ErrInvalidState) {
+		t.Error(fmt.Sprintf("negative size: expected ErrInvalidState, got %v", err))
+	}
+	b, _ = (&ChunkerState{Params: params}).MarshalBinary()
+	b = binary.AppendUvarint(b[:len(b)-2], 1<<63)
+	b = append(b, 0)
+	if err := state.UnmarshalBinary(b); !errors.Is(err, ErrInvalidState) {
+		t.Error(fmt.Sprintf("huge window: expected ErrInvalidState, got %v", err))
+	}
+
+	// Corrupt the last pending byte, which is also part of the window.
+	corrupt := append([]byte{}, checkpoint...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if err := state.UnmarshalBinary(corrupt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResumeChunker(bytes.NewReader(nil), state); !errors.Is(err, ErrInvalidState) {
+		t.Error(fmt.Sprintf("corrupt: expected ErrInvalidState, got %v", err))
+	}
+
+	// A corrupt digest is also detected.
+	if err := state.UnmarshalBinary(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	state.Digest ^= 1
+	if _, err := ResumeChunker(bytes.NewReader(nil), state); !errors.Is(err, ErrInvalidState) {
+		t.Error(fmt.Sprintf("digest: expected ErrInvalidState, got %v", err))
+	}
+}
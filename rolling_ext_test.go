@@ -0,0 +1,24 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin_test
+
+import (
+	"testing"
+
+	"github.com/kevinko/rabin"
+	"github.com/kevinko/rabin/rabintest"
+)
+
+func Test_Buzhash(t *testing.T) {
+	rabintest.TestRollingHash(t, rabin.NewBuzhash, rabin.NaiveBuzhash)
+}
+
+func Test_Gear(t *testing.T) {
+	rabintest.TestRollingHash(t, rabin.NewGear, rabin.NaiveGear)
+}
+
+func Test_Adler(t *testing.T) {
+	rabintest.TestRollingHash(t, rabin.NewAdler, rabin.NaiveAdler)
+}
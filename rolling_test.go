@@ -0,0 +1,129 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"math"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+// Rolling hash families that can be swapped for one another.
+var rollingFamilies = []struct {
+	name  string
+	newFn func(windowSize int) RollingHash
+	// Recomputes the hash of a window from scratch.
+	naive func(window []byte) uint64
+}{
+	{"Rabin", NewRolling, RabinFingerprintFixed},
+	{"Rabin64", NewRolling64, RabinFingerprintFixed},
+	{"Buzhash", NewBuzhash, naiveBuzhash},
+	{"Gear", NewGear, naiveGear},
+	{"Adler", NewAdler, naiveAdler},
+}
+
+func naiveBuzhash(window []byte) uint64 {
+	h := uint64(0)
+	n := len(window)
+	for ii, b := range window {
+		h ^= bits.RotateLeft64(kBuzhashTable[b], (n-1-ii)&63)
+	}
+	return h
+}
+
+func naiveGear(window []byte) uint64 {
+	h := uint64(0)
+	n := len(window)
+	for ii, b := range window {
+		shift := uint(n - 1 - ii)
+		h += kGearTable[b] << shift
+	}
+	return h
+}
+
+func naiveAdler(window []byte) uint64 {
+	a, b := uint64(0), uint64(0)
+	n := len(window)
+	for ii, x := range window {
+		a += uint64(x)
+		b += uint64(n-ii) * uint64(x)
+	}
+	return (b&0xffff)<<16 | (a & 0xffff)
+}
+
+// Rolls each family one byte at a time across 1MB of random data.
+func Benchmark_RollingThroughput(b *testing.B) {
+	const windowSize = 48
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	for _, family := range rollingFamilies {
+		b.Run(family.name, func(b *testing.B) {
+			hash := family.newFn(windowSize)
+			b.SetBytes(int64(len(data) - windowSize))
+			b.ResetTimer()
+			for ii := 0; ii < b.N; ii++ {
+				hash.Reset()
+				hash.Write(data[:windowSize])
+				for jj := windowSize; jj < len(data); jj++ {
+					hash.Roll(data[jj-windowSize:jj-windowSize+1], data[jj:jj+1])
+				}
+			}
+		})
+	}
+}
+
+// Reports how often each family hits a 13-bit boundary mask over random
+// data and how regular the gaps between hits are.  An ideal hash hits
+// once every 8192 bytes on average, with a coefficient of variation
+// (stddev / mean) of the gaps near 1.
+func Benchmark_RollingBoundaries(b *testing.B) {
+	const (
+		windowSize = 48
+		mask       = 1<<13 - 1
+	)
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	for _, family := range rollingFamilies {
+		b.Run(family.name, func(b *testing.B) {
+			hash := family.newFn(windowSize)
+			var gaps []float64
+			for ii := 0; ii < b.N; ii++ {
+				gaps = gaps[:0]
+				last := 0
+				hash.Reset()
+				hash.Write(data[:windowSize])
+				for jj := windowSize; jj < len(data); jj++ {
+					hash.Roll(data[jj-windowSize:jj-windowSize+1], data[jj:jj+1])
+					if hash.Sum64()&mask == mask {
+						gaps = append(gaps, float64(jj-last))
+						last = jj
+					}
+				}
+			}
+
+			mean, stddev := 0.0, 0.0
+			for _, gap := range gaps {
+				mean += gap
+			}
+			if len(gaps) > 0 {
+				mean /= float64(len(gaps))
+			}
+			for _, gap := range gaps {
+				stddev += (gap - mean) * (gap - mean)
+			}
+			if len(gaps) > 1 {
+				stddev = math.Sqrt(stddev / float64(len(gaps)-1))
+			}
+
+			b.ReportMetric(float64(len(gaps))*float64(1<<20)/float64(len(data)), "hits/MB")
+			if mean > 0 {
+				b.ReportMetric(stddev/mean, "gap-cv")
+			}
+		})
+	}
+}
@@ -0,0 +1,479 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// Returned (wrapped) when a signature or delta is malformed.
+	ErrInvalidDelta = errors.New("rabin: invalid signature or delta")
+	// Returned (wrapped) by Patch when the result does not match the
+	// delta.
+	ErrPatchMismatch = errors.New("rabin: patched data does not match delta")
+)
+
+const (
+	kSignatureMagic = "RBSG"
+	kDeltaMagic     = "RBDL"
+	kDeltaVersion   = 1
+
+	// The length of strong block hashes: truncated SHA-256.
+	kStrongHashSize = 16
+
+	// Literals are passed to onLiteral in pieces of at most this many
+	// bytes, which bounds the buffer of blockMatcher.scan.
+	kMaxLiteralSize = 64 * 1024
+)
+
+type StrongHash [kStrongHashSize]byte
+
+func strongHash(data []byte) StrongHash {
+	var h StrongHash
+	sum := sha256.Sum256(data)
+	copy(h[:], sum[:])
+	return h
+}
+
+// The hashes of one block of a file.
+type BlockSignature struct {
+	// The Rabin fingerprint of the block.
+	Weak   uint64
+	Strong StrongHash
+}
+
+// The block hashes of a file, from which a Delta against another file can
+// be computed without access to the file itself.  All blocks hold
+// BlockSize bytes, except that the last may be shorter.
+type FileSignature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []BlockSignature
+}
+
+// Returns the length of block ii.
+func (s *FileSignature) blockLength(ii int) int {
+	if ii == len(s.Blocks)-1 {
+		if tail := int(s.Size % int64(s.BlockSize)); tail != 0 {
+			return tail
+		}
+	}
+	return s.BlockSize
+}
+
+// Reads r and returns the signature of its blocks of blockSize bytes.
+func Signature(r io.Reader, blockSize int) (*FileSignature, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("%w: block size %d", ErrInvalidDelta, blockSize)
+	}
+	sig := &FileSignature{BlockSize: blockSize, Blocks: []BlockSignature{}}
+	hash := New()
+	buff := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buff)
+		if n > 0 {
+			hash.Reset()
+			hash.Write(buff[:n])
+			sig.Blocks = append(sig.Blocks, BlockSignature{
+				Weak:   hash.Sum64(),
+				Strong: strongHash(buff[:n]),
+			})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Finds the blocks of a signature in a stream.
+type blockMatcher struct {
+	sig   *FileSignature
+	index map[uint64][]int
+}
+
+func newBlockMatcher(sig *FileSignature) *blockMatcher {
+	m := &blockMatcher{sig: sig, index: make(map[uint64][]int, len(sig.Blocks))}
+	for ii, block := range sig.Blocks {
+		m.index[block.Weak] = append(m.index[block.Weak], ii)
+	}
+	return m
+}
+
+// Returns the index of a block of length len(data) that matches data, or
+// -1.
+func (m *blockMatcher) find(weak uint64, data []byte) int {
+	candidates := m.index[weak]
+	if len(candidates) == 0 {
+		return -1
+	}
+	strong := strongHash(data)
+	for _, ii := range candidates {
+		if m.sig.blockLength(ii) == len(data) && m.sig.Blocks[ii].Strong == strong {
+			return ii
+		}
+	}
+	return -1
+}
+
+// Slides a window of BlockSize bytes over r.  Whenever the window matches
+// a block, onMatch is called with the offset of the window in r and the
+// block index, and the window skips past the match.  A short final block
+// only matches the last bytes of r, although literals may precede it.
+// onLiteral receives the bytes between matches, which are only valid
+// during the call.  The matcher buffers at most two blocks and
+// kMaxLiteralSize bytes; whatever the callbacks keep is up to them.
+func (m *blockMatcher) scan(r io.Reader, onMatch func(offset int64, block int) error, onLiteral func(data []byte) error) error {
+	blockSize := m.sig.BlockSize
+	hash, _ := newRollingDigest(nil, blockSize)
+
+	// buff[litStart:start] is pending literal data, and the window is
+	// buff[start:start+blockSize].  base is the stream offset of buff[0].
+	buff := make([]byte, 0, 2*blockSize+kMaxLiteralSize)
+	litStart, start := 0, 0
+	base := int64(0)
+	eof := false
+	primed := false
+
+	// Ensures that buff holds n bytes from start, unless r ends first.
+	fill := func(n int) error {
+		for len(buff)-start < n && !eof {
+			if len(buff) == cap(buff) {
+				// Discard consumed bytes.
+				copied := copy(buff, buff[litStart:])
+				buff = buff[:copied]
+				base += int64(litStart)
+				start -= litStart
+				litStart = 0
+			}
+			read, err := r.Read(buff[len(buff):cap(buff)])
+			buff = buff[:len(buff)+read]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	flushLiteral := func() error {
+		if start == litStart {
+			return nil
+		}
+		err := onLiteral(buff[litStart:start])
+		litStart = start
+		return err
+	}
+
+	var weak uint64
+	for {
+		if err := fill(blockSize + 1); err != nil {
+			return err
+		}
+		if len(buff)-start < blockSize {
+			break
+		}
+
+		if !primed {
+			hash.Reset()
+			hash.Write(buff[start : start+blockSize])
+			weak = hash.Sum64()
+			primed = true
+		}
+		if block := m.find(weak, buff[start:start+blockSize]); block >= 0 {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+			if err := onMatch(base+int64(start), block); err != nil {
+				return err
+			}
+			start += blockSize
+			litStart = start
+			primed = false
+			continue
+		}
+
+		if len(buff)-start == blockSize {
+			// The window ends at the end of r.
+			break
+		}
+		weak = hash.rollByte(buff[start], buff[start+blockSize])
+		start++
+		if start-litStart >= kMaxLiteralSize {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// r may end with the short final block, after any pending literal.
+	if last := len(m.sig.Blocks) - 1; last >= 0 {
+		if n := m.sig.blockLength(last); n < blockSize && len(buff)-n >= litStart {
+			tail := buff[len(buff)-n:]
+			tailHash := New()
+			tailHash.Write(tail)
+			if m.find(tailHash.Sum64(), tail) == last {
+				start = len(buff) - n
+				if err := flushLiteral(); err != nil {
+					return err
+				}
+				return onMatch(base+int64(start), last)
+			}
+		}
+	}
+	start = len(buff)
+	return flushLiteral()
+}
+
+type DeltaOpKind byte
+
+const (
+	// Copy bytes from the old file.
+	DeltaCopy DeltaOpKind = 1
+	// Insert literal bytes.
+	DeltaLiteral DeltaOpKind = 2
+)
+
+// One instruction of a delta.
+type DeltaOp struct {
+	Kind DeltaOpKind
+	// For copies, the range of the old file.
+	Offset int64
+	Length int64
+	// For literals, the bytes to insert.
+	Data []byte
+}
+
+// Instructions that rebuild a new file from an old one.
+type FileDelta struct {
+	Ops []DeltaOp
+	// The size and New64 fingerprint of the new file.
+	Size        int64
+	Fingerprint uint64
+}
+
+// Reads the new version of a file from r and returns the delta that
+// rebuilds it from the old version, given only the old version's
+// signature.  Adjacent copies and literals are merged.  The delta,
+// including all literal data, is held in memory.
+func Delta(sig *FileSignature, r io.Reader) (*FileDelta, error) {
+	if sig.BlockSize <= 0 {
+		return nil, fmt.Errorf("%w: block size %d", ErrInvalidDelta, sig.BlockSize)
+	}
+	delta := &FileDelta{Ops: []DeltaOp{}}
+	hash := New64()
+	onMatch := func(offset int64, block int) error {
+		length := int64(sig.blockLength(block))
+		oldOffset := int64(block) * int64(sig.BlockSize)
+		if last := len(delta.Ops) - 1; last >= 0 && delta.Ops[last].Kind == DeltaCopy &&
+			delta.Ops[last].Offset+delta.Ops[last].Length == oldOffset {
+			delta.Ops[last].Length += length
+		} else {
+			delta.Ops = append(delta.Ops, DeltaOp{Kind: DeltaCopy, Offset: oldOffset, Length: length})
+		}
+		delta.Size += length
+		return nil
+	}
+	onLiteral := func(data []byte) error {
+		if last := len(delta.Ops) - 1; last >= 0 && delta.Ops[last].Kind == DeltaLiteral {
+			delta.Ops[last].Data = append(delta.Ops[last].Data, data...)
+			delta.Ops[last].Length += int64(len(data))
+		} else {
+			delta.Ops = append(delta.Ops, DeltaOp{
+				Kind:   DeltaLiteral,
+				Length: int64(len(data)),
+				Data:   append([]byte{}, data...),
+			})
+		}
+		delta.Size += int64(len(data))
+		return nil
+	}
+
+	// Fingerprint the new file as it is scanned.
+	err := newBlockMatcher(sig).scan(io.TeeReader(r, hash), onMatch, onLiteral)
+	if err != nil {
+		return nil, err
+	}
+	delta.Fingerprint = hash.Sum64()
+	return delta, nil
+}
+
+// Writes the new file to w by applying delta to old.  The result is
+// checked against the size and fingerprint in delta.
+func Patch(old io.ReaderAt, delta *FileDelta, w io.Writer) error {
+	hash := New64()
+	out := io.MultiWriter(w, hash)
+	size := int64(0)
+	for _, op := range delta.Ops {
+		switch op.Kind {
+		case DeltaCopy:
+			n, err := io.Copy(out, io.NewSectionReader(old, op.Offset, op.Length))
+			if err != nil {
+				return err
+			}
+			if n != op.Length {
+				return fmt.Errorf("%w: copy of [%d, %d) past the end of the old file",
+					ErrPatchMismatch, op.Offset, op.Offset+op.Length)
+			}
+		case DeltaLiteral:
+			if _, err := out.Write(op.Data); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: op kind %d", ErrInvalidDelta, op.Kind)
+		}
+		size += op.Length
+	}
+	if size != delta.Size || hash.Sum64() != delta.Fingerprint {
+		return fmt.Errorf("%w: %d bytes", ErrPatchMismatch, size)
+	}
+	return nil
+}
+
+// Checks the magic and version that begin a signature or delta.
+func readDeltaHeader(r *bytes.Reader, magic string) error {
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, header); err != nil ||
+		string(header[:len(magic)]) != magic || header[len(magic)] != kDeltaVersion {
+		return fmt.Errorf("%w: bad header", ErrInvalidDelta)
+	}
+	return nil
+}
+
+func (s *FileSignature) MarshalBinary() ([]byte, error) {
+	b := []byte(kSignatureMagic)
+	b = append(b, kDeltaVersion)
+	b = binary.AppendUvarint(b, uint64(s.BlockSize))
+	b = binary.AppendUvarint(b, uint64(s.Size))
+	for _, block := range s.Blocks {
+		b = binary.BigEndian.AppendUint64(b, block.Weak)
+		b = append(b, block.Strong[:]...)
+	}
+	return b, nil
+}
+
+func (s *FileSignature) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if err := readDeltaHeader(r, kSignatureMagic); err != nil {
+		return err
+	}
+	blockSize, err := binary.ReadUvarint(r)
+	if err != nil || blockSize == 0 || blockSize > 1<<30 {
+		return fmt.Errorf("%w: block size", ErrInvalidDelta)
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil || size > 1<<62 {
+		return fmt.Errorf("%w: size", ErrInvalidDelta)
+	}
+	// The number of blocks follows from the size.  Check it against the
+	// data before multiplying, which could overflow.
+	count := (size + blockSize - 1) / blockSize
+	if count > uint64(r.Len())/(8+kStrongHashSize) || uint64(r.Len()) != count*(8+kStrongHashSize) {
+		return fmt.Errorf("%w: %d bytes of blocks", ErrInvalidDelta, r.Len())
+	}
+	sig := FileSignature{
+		BlockSize: int(blockSize),
+		Size:      int64(size),
+		Blocks:    make([]BlockSignature, count),
+	}
+	for ii := range sig.Blocks {
+		binary.Read(r, binary.BigEndian, &sig.Blocks[ii].Weak)
+		r.Read(sig.Blocks[ii].Strong[:])
+	}
+	*s = sig
+	return nil
+}
+
+func (d *FileDelta) MarshalBinary() ([]byte, error) {
+	b := []byte(kDeltaMagic)
+	b = append(b, kDeltaVersion)
+	b = binary.AppendUvarint(b, uint64(d.Size))
+	b = binary.BigEndian.AppendUint64(b, d.Fingerprint)
+	b = binary.AppendUvarint(b, uint64(len(d.Ops)))
+	for _, op := range d.Ops {
+		b = append(b, byte(op.Kind))
+		switch op.Kind {
+		case DeltaCopy:
+			b = binary.AppendUvarint(b, uint64(op.Offset))
+			b = binary.AppendUvarint(b, uint64(op.Length))
+		case DeltaLiteral:
+			b = binary.AppendUvarint(b, uint64(len(op.Data)))
+			b = append(b, op.Data...)
+		default:
+			return nil, fmt.Errorf("%w: op kind %d", ErrInvalidDelta, op.Kind)
+		}
+	}
+	return b, nil
+}
+
+func (d *FileDelta) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if err := readDeltaHeader(r, kDeltaMagic); err != nil {
+		return err
+	}
+
+	var err error
+	readUvarint := func() int64 {
+		var v uint64
+		if err == nil {
+			v, err = binary.ReadUvarint(r)
+			if v > 1<<62 {
+				err = errors.New("value out of range")
+			}
+		}
+		return int64(v)
+	}
+	delta := FileDelta{Ops: []DeltaOp{}}
+	delta.Size = readUvarint()
+	if err == nil {
+		err = binary.Read(r, binary.BigEndian, &delta.Fingerprint)
+	}
+	count := readUvarint()
+	// Each op takes at least 2 bytes.
+	if err == nil && count > int64(r.Len()/2) {
+		err = io.ErrUnexpectedEOF
+	}
+	for ii := int64(0); ii < count && err == nil; ii++ {
+		var kind byte
+		if kind, err = r.ReadByte(); err != nil {
+			break
+		}
+		op := DeltaOp{Kind: DeltaOpKind(kind)}
+		switch op.Kind {
+		case DeltaCopy:
+			op.Offset = readUvarint()
+			op.Length = readUvarint()
+		case DeltaLiteral:
+			op.Length = readUvarint()
+			if err == nil && op.Length > int64(r.Len()) {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == nil {
+				op.Data = make([]byte, op.Length)
+				r.Read(op.Data)
+			}
+		default:
+			err = fmt.Errorf("op kind %d", kind)
+		}
+		delta.Ops = append(delta.Ops, op)
+	}
+	if err == nil && r.Len() != 0 {
+		err = errors.New("trailing data")
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDelta, err)
+	}
+	*d = delta
+	return nil
+}
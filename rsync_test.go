@@ -0,0 +1,176 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Computes, encodes and decodes a signature and delta, and patches old.
+func rsyncRoundTrip(t *testing.T, old, updated []byte, blockSize int) *FileDelta {
+	sig, err := Signature(bytes.NewReader(old), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := sig.MarshalBinary()
+	var decodedSig FileSignature
+	if err := decodedSig.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decodedSig, sig) {
+		t.Fatal("signature round trip differs")
+	}
+
+	delta, err := Delta(&decodedSig, bytes.NewReader(updated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = delta.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded FileDelta
+	if err := decoded.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, delta) {
+		t.Fatal("delta round trip differs")
+	}
+
+	out := new(bytes.Buffer)
+	if err := Patch(bytes.NewReader(old), &decoded, out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), updated) {
+		t.Fatal(fmt.Sprintf("patched %d bytes differ from %d expected", out.Len(), len(updated)))
+	}
+	return delta
+}
+
+func literalBytes(delta *FileDelta) int64 {
+	total := int64(0)
+	for _, op := range delta.Ops {
+		if op.Kind == DeltaLiteral {
+			total += op.Length
+		}
+	}
+	return total
+}
+
+func concat(pieces ...[]byte) []byte {
+	return bytes.Join(pieces, nil)
+}
+
+func Test_Rsync(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for ii := 0; ii < 20; ii++ {
+		old := makeRandomData(int64(ii), 100000+r.Intn(200000))
+		numEdits := r.Intn(10)
+		updated := mutate(r, old, numEdits)
+		blockSize := []int{100, 700, 1024, 4096}[ii%4]
+
+		delta := rsyncRoundTrip(t, old, updated, blockSize)
+		// Each edit costs at most a few blocks of literals.
+		if limit := int64(numEdits * (2*blockSize + 1024)); literalBytes(delta) > limit {
+			t.Error(fmt.Sprintf("%d edits, block size %d: %d literal bytes",
+				numEdits, blockSize, literalBytes(delta)))
+		}
+	}
+}
+
+func Test_RsyncEdges(t *testing.T) {
+	data := makeRandomData(1, 10000)
+	tests := []struct {
+		name         string
+		old, updated []byte
+	}{
+		{"empty", nil, nil},
+		{"from empty", nil, data},
+		{"to empty", data, nil},
+		{"identical", data, data},
+		{"short tail", data[:9999], data[:9999]},
+		{"tail moved", data[:9999], append(makeRandomData(2, 10), data[:9999]...)},
+		{"literal before tail", data[:9999], concat(data[:9000], makeRandomData(3, 30), data[9000:9999])},
+		{"tail after literals", data[:9999], concat(makeRandomData(4, 2500), data[9000:9999])},
+		{"truncated", data, data[:5000]},
+		{"repeated", data[:1000], bytes.Repeat(data[:1000], 5)},
+		{"zeros", make([]byte, 10000), make([]byte, 20000)},
+	}
+	for _, test := range tests {
+		delta := rsyncRoundTrip(t, test.old, test.updated, 1000)
+		if test.name == "identical" || test.name == "short tail" {
+			if len(delta.Ops) != 1 || delta.Ops[0].Kind != DeltaCopy {
+				t.Error(fmt.Sprintf("%s: ops %+v", test.name, delta.Ops))
+			}
+		}
+		// The short final block is found after literals.
+		literals := map[string]int64{
+			"tail moved":          10,
+			"literal before tail": 30,
+			"tail after literals": 2500,
+		}
+		if want, ok := literals[test.name]; ok && literalBytes(delta) != want {
+			t.Error(fmt.Sprintf("%s: %d literal bytes, expected %d", test.name,
+				literalBytes(delta), want))
+		}
+	}
+}
+
+func Test_RsyncErrors(t *testing.T) {
+	old := makeRandomData(3, 10000)
+	updated := mutate(rand.New(rand.NewSource(3)), old, 3)
+	sig, _ := Signature(bytes.NewReader(old), 512)
+	delta, _ := Delta(sig, bytes.NewReader(updated))
+
+	// Patching the wrong file.
+	other := makeRandomData(4, 10000)
+	err := Patch(bytes.NewReader(other), delta, new(bytes.Buffer))
+	if !errors.Is(err, ErrPatchMismatch) {
+		t.Error(fmt.Sprintf("wrong old file: %v", err))
+	}
+	err = Patch(bytes.NewReader(old[:100]), delta, new(bytes.Buffer))
+	if !errors.Is(err, ErrPatchMismatch) {
+		t.Error(fmt.Sprintf("short old file: %v", err))
+	}
+
+	if _, err := Signature(bytes.NewReader(old), 0); !errors.Is(err, ErrInvalidDelta) {
+		t.Error(fmt.Sprintf("zero block size: %v", err))
+	}
+	b, _ := delta.MarshalBinary()
+	for _, bad := range [][]byte{nil, b[:len(b)-1], append(b, 0)} {
+		if err := new(FileDelta).UnmarshalBinary(bad); !errors.Is(err, ErrInvalidDelta) {
+			t.Error(fmt.Sprintf("%d byte delta: %v", len(bad), err))
+		}
+	}
+	b, _ = sig.MarshalBinary()
+	if err := new(FileSignature).UnmarshalBinary(b[:len(b)-1]); !errors.Is(err, ErrInvalidDelta) {
+		t.Error(fmt.Sprintf("truncated signature: %v", err))
+	}
+	// Blocks of one byte for 1<<62 bytes, where the length of the blocks
+	// overflows.
+	b = append([]byte(kSignatureMagic), kDeltaVersion)
+	b = binary.AppendUvarint(b, 1)
+	b = binary.AppendUvarint(b, 1<<62)
+	if err := new(FileSignature).UnmarshalBinary(b); !errors.Is(err, ErrInvalidDelta) {
+		t.Error(fmt.Sprintf("overflowing signature: %v", err))
+	}
+}
+
+func Benchmark_RsyncDelta(b *testing.B) {
+	old := makeRandomData(5, 4<<20)
+	updated := mutate(rand.New(rand.NewSource(5)), old, 100)
+	sig, _ := Signature(bytes.NewReader(old), 2048)
+	b.SetBytes(int64(len(updated)))
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		Delta(sig, bytes.NewReader(updated))
+	}
+}
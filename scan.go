@@ -0,0 +1,119 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"errors"
+	"io"
+	"iter"
+)
+
+// Returned when a window size is not positive.
+var ErrWindowSize = errors.New("rabin: window size must be positive")
+
+// The number of bytes read from the underlying reader at a time, in
+// addition to the window itself.
+const kScanBufferSize = 64 * 1024
+
+// Scanner rolls a NewRolling window across an io.Reader, one byte at a
+// time.  Memory use is bounded by the window size plus a fixed read
+// buffer, regardless of the length of the stream.
+type Scanner struct {
+	r          io.Reader
+	windowSize int
+	err        error
+}
+
+func NewScanner(r io.Reader, windowSize int) *Scanner {
+	return &Scanner{r: r, windowSize: windowSize}
+}
+
+// Returns a sequence of (offset, fingerprint) pairs, where offset is the
+// position in the stream of the first byte of each window.  Streams that
+// are shorter than the window yield nothing.  The sequence ends early if
+// the consumer stops iterating; any read error is available from Err once
+// the sequence ends.
+func (s *Scanner) All() iter.Seq2[int64, uint64] {
+	return func(yield func(int64, uint64) bool) {
+		s.err = s.scan(yield)
+	}
+}
+
+// Returns the first non-EOF error that was encountered by the last
+// iteration of All.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+func (s *Scanner) scan(fn func(int64, uint64) bool) error {
+	windowSize := s.windowSize
+	if windowSize <= 0 {
+		return ErrWindowSize
+	}
+
+	hash := NewRolling(windowSize)
+	buff := make([]byte, windowSize+kScanBufferSize)
+
+	// Load the first window.
+	n, err := io.ReadFull(s.r, buff[:windowSize])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return err
+	}
+	hash.Write(buff[:windowSize])
+	if !fn(0, hash.Sum64()) {
+		return nil
+	}
+
+	// buff[:n] holds valid data, and buff[pos] is the next byte to roll
+	// in.  base is the stream offset of buff[0].
+	base := int64(0)
+	pos := n
+	for {
+		for ; pos < n; pos++ {
+			start := pos - windowSize
+			hash.Roll(buff[start:start+1], buff[pos:pos+1])
+			if !fn(base+int64(start+1), hash.Sum64()) {
+				return nil
+			}
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		// Retain only the current window.
+		start := pos - windowSize
+		copy(buff, buff[start:n])
+		base += int64(start)
+		n = windowSize
+		pos = windowSize
+
+		var read int
+		read, err = s.r.Read(buff[n:])
+		n += read
+	}
+}
+
+// Returns a sequence of (offset, fingerprint) pairs for every window of
+// windowSize bytes in r.  See Scanner.All.  The sequence stops at the
+// first read error, or yields nothing if windowSize is invalid, without
+// reporting it; use NewScanner and Scanner.Err, or ScanFunc, when errors
+// must be observed.
+func Scan(r io.Reader, windowSize int) iter.Seq2[int64, uint64] {
+	return NewScanner(r, windowSize).All()
+}
+
+// Calls fn with the offset and fingerprint of every window of windowSize
+// bytes in r until fn returns false or the stream ends.  Returns the first
+// non-EOF read error.
+func ScanFunc(r io.Reader, windowSize int, fn func(offset int64, fingerprint uint64) bool) error {
+	return NewScanner(r, windowSize).scan(fn)
+}
@@ -0,0 +1,141 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func Test_Scan(t *testing.T) {
+	data := makeSequence(300)
+	windowSize := 17
+
+	readers := map[string]io.Reader{
+		"Bytes":   bytes.NewReader(data),
+		"OneByte": iotest.OneByteReader(bytes.NewReader(data)),
+		"Half":    iotest.HalfReader(bytes.NewReader(data)),
+		"DataErr": iotest.DataErrReader(bytes.NewReader(data)),
+	}
+	for name, r := range readers {
+		count := 0
+		for offset, fp := range Scan(r, windowSize) {
+			if offset != int64(count) {
+				t.Fatal(fmt.Sprintf("%s: offset %d != %d", name, offset, count))
+			}
+			cmp := RabinFingerprintFixed(data[offset : offset+int64(windowSize)])
+			if fp != cmp {
+				t.Fatal(fmt.Sprintf("%s offset %d: mismatch 0x%x != 0x%x", name, offset, fp, cmp))
+			}
+			count++
+		}
+		if count != len(data)-windowSize+1 {
+			t.Error(fmt.Sprintf("%s: %d windows, expected %d", name, count, len(data)-windowSize+1))
+		}
+	}
+}
+
+// Streams longer than the read buffer must wrap the buffer correctly.
+func Test_ScanLong(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := make([]byte, 3*kScanBufferSize+123)
+	r.Read(data)
+	windowSize := 48
+
+	hash := NewRolling(windowSize)
+	count := 0
+	err := ScanFunc(bytes.NewReader(data), windowSize, func(offset int64, fp uint64) bool {
+		hash.Reset()
+		hash.Write(data[offset : offset+int64(windowSize)])
+		if fp != hash.Sum64() {
+			t.Fatal(fmt.Sprintf("offset %d: mismatch 0x%x != 0x%x", offset, fp, hash.Sum64()))
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if count != len(data)-windowSize+1 {
+		t.Error(fmt.Sprintf("%d windows, expected %d", count, len(data)-windowSize+1))
+	}
+}
+
+func Test_ScanShort(t *testing.T) {
+	for offset := range Scan(bytes.NewReader(makeSequence(10)), 11) {
+		t.Error(fmt.Sprintf("unexpected window at %d", offset))
+	}
+
+	count := 0
+	for range Scan(bytes.NewReader(makeSequence(11)), 11) {
+		count++
+	}
+	if count != 1 {
+		t.Error(fmt.Sprintf("%d windows, expected 1", count))
+	}
+}
+
+func Test_ScanBreak(t *testing.T) {
+	data := makeBlock(3 * kScanBufferSize)
+	r := bytes.NewReader(data)
+	count := 0
+	for offset := range Scan(r, 8) {
+		if offset == 10 {
+			break
+		}
+		count++
+	}
+	if count != 10 {
+		t.Error(fmt.Sprintf("%d windows, expected 10", count))
+	}
+	// The scan must not drain the reader after the consumer stops.
+	if r.Len() == 0 {
+		t.Error("reader drained after break")
+	}
+}
+
+func Test_ScanError(t *testing.T) {
+	errRead := errors.New("read failed")
+	data := makeSequence(100)
+	r := io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errRead))
+
+	s := NewScanner(r, 8)
+	count := 0
+	for range s.All() {
+		count++
+	}
+	if s.Err() != errRead {
+		t.Error(fmt.Sprintf("expected read error, got %v", s.Err()))
+	}
+	if count != len(data)-8+1 {
+		t.Error(fmt.Sprintf("%d windows before error, expected %d", count, len(data)-8+1))
+	}
+
+	// Scan stops at the same point.
+	count = 0
+	for range Scan(io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errRead)), 8) {
+		count++
+	}
+	if count != len(data)-8+1 {
+		t.Error(fmt.Sprintf("Scan: %d windows before error, expected %d", count, len(data)-8+1))
+	}
+
+	// Errors while loading the first window are also reported.
+	err := ScanFunc(iotest.ErrReader(errRead), 8, func(int64, uint64) bool {
+		return true
+	})
+	if err != errRead {
+		t.Error(fmt.Sprintf("expected read error, got %v", err))
+	}
+
+	if err := ScanFunc(bytes.NewReader(data), 0, nil); err != ErrWindowSize {
+		t.Error(fmt.Sprintf("expected ErrWindowSize, got %v", err))
+	}
+}
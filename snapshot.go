@@ -0,0 +1,504 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Returned (wrapped) when a tree or snapshot object is malformed.
+var ErrInvalidObject = errors.New("rabin: invalid object")
+
+const (
+	kTreeMagic     = "RBTR"
+	kSnapshotMagic = "RBSN"
+	kObjectVersion = 1
+)
+
+// An entry of a Tree: a regular file, directory or symbolic link.
+type TreeEntry struct {
+	Name    string
+	Mode    fs.FileMode
+	Size    int64
+	ModTime time.Time
+	// The inode number, where available, which is only used to detect
+	// unchanged files.
+	Inode uint64
+	// The ID of the file's Manifest or the directory's Tree.
+	Ref ChunkID
+	// The target of a symbolic link.
+	Target string
+}
+
+// The entries of a directory, sorted by name.
+type Tree struct {
+	Entries []TreeEntry
+}
+
+// The root of a backup.
+type Snapshot struct {
+	Tree ChunkID
+	// The snapshot that this one was based on, or 0.
+	Parent ChunkID
+	Time   time.Time
+}
+
+// Counts what a Snapshotter did.
+type SnapshotStats struct {
+	Files int
+	// Files that were unchanged since the parent snapshot and not read.
+	Reused int
+	// Bytes that were read and chunked.
+	Chunked int64
+}
+
+// Backs up directory trees into a ChunkStore.  File contents are stored as
+// content-defined chunks and described by Manifests; each directory is
+// stored as a Tree, and the whole backup as a Snapshot.  All are stored
+// once, under their 64-bit Rabin fingerprints (see ChunkIDOf), so that
+// unchanged data between snapshots takes no extra space.
+//
+// A file whose size, modification time and inode match the parent
+// snapshot is assumed to be unchanged and is not read.
+type Snapshotter struct {
+	store  ChunkStore
+	params ChunkerParams
+	stats  SnapshotStats
+}
+
+// Returns a Snapshotter that cuts files according to params.
+func NewSnapshotter(store ChunkStore, params ChunkerParams) (*Snapshotter, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return &Snapshotter{store: store, params: params}, nil
+}
+
+// Returns the counts for the last call to Snapshot.
+func (s *Snapshotter) Stats() SnapshotStats {
+	return s.stats
+}
+
+// Stores an object under its fingerprint.
+func (s *Snapshotter) putObject(b []byte) (ChunkID, error) {
+	id := ChunkIDOf(b)
+	return id, s.store.Put(id, b)
+}
+
+// Backs up fsys and returns the snapshot ID.  parent, if nonzero, is an
+// earlier snapshot of the same tree whose unchanged files are reused.
+// Symbolic links are recorded (not followed) if fsys implements
+// fs.ReadLinkFS and skipped otherwise, as are other special files.
+func (s *Snapshotter) Snapshot(fsys fs.FS, parent ChunkID) (ChunkID, error) {
+	s.stats = SnapshotStats{}
+	var parentTree *Tree
+	if parent != 0 {
+		snapshot, err := LoadSnapshot(s.store, parent)
+		if err != nil {
+			return 0, err
+		}
+		if parentTree, err = LoadTree(s.store, snapshot.Tree); err != nil {
+			return 0, err
+		}
+	}
+
+	tree, err := s.snapshotDir(fsys, ".", parentTree)
+	if err != nil {
+		return 0, err
+	}
+	snapshot := &Snapshot{Tree: tree, Parent: parent, Time: time.Now()}
+	b, _ := snapshot.MarshalBinary()
+	return s.putObject(b)
+}
+
+// Backs up the directory dir.
+func (s *Snapshotter) SnapshotDir(dir string, parent ChunkID) (ChunkID, error) {
+	return s.Snapshot(os.DirFS(dir), parent)
+}
+
+// Stores the tree of dir and returns its ID.
+func (s *Snapshotter) snapshotDir(fsys fs.FS, dir string, parent *Tree) (ChunkID, error) {
+	dirEntries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return 0, err
+	}
+	previous := map[string]*TreeEntry{}
+	if parent != nil {
+		for ii := range parent.Entries {
+			previous[parent.Entries[ii].Name] = &parent.Entries[ii]
+		}
+	}
+
+	tree := &Tree{Entries: []TreeEntry{}}
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil {
+			return 0, err
+		}
+		name := path.Join(dir, dirEntry.Name())
+		entry := TreeEntry{
+			Name:    dirEntry.Name(),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			Inode:   fileInode(info),
+		}
+		prev := previous[entry.Name]
+
+		switch {
+		case info.Mode().IsDir():
+			var prevTree *Tree
+			if prev != nil && prev.Mode.IsDir() {
+				if prevTree, err = LoadTree(s.store, prev.Ref); err != nil {
+					return 0, err
+				}
+			}
+			if entry.Ref, err = s.snapshotDir(fsys, name, prevTree); err != nil {
+				return 0, err
+			}
+
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			s.stats.Files++
+			if prev != nil && prev.Mode.IsRegular() && prev.Size == entry.Size &&
+				prev.ModTime.Equal(entry.ModTime) && prev.Inode == entry.Inode {
+				entry.Ref = prev.Ref
+				s.stats.Reused++
+				break
+			}
+			if entry.Ref, err = s.snapshotFile(fsys, name); err != nil {
+				return 0, err
+			}
+
+		case info.Mode()&fs.ModeSymlink != 0:
+			linkFS, ok := fsys.(fs.ReadLinkFS)
+			if !ok {
+				continue
+			}
+			if entry.Target, err = linkFS.ReadLink(name); err != nil {
+				return 0, err
+			}
+
+		default:
+			continue
+		}
+		tree.Entries = append(tree.Entries, entry)
+	}
+
+	b, _ := tree.MarshalBinary()
+	return s.putObject(b)
+}
+
+// Chunks and stores a file and returns the ID of its manifest.
+func (s *Snapshotter) snapshotFile(fsys fs.FS, name string) (ChunkID, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	m, err := ChunkFileFunc(f, s.params, s.store.Put)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	s.stats.Chunked += m.Size
+	b, _ := m.MarshalBinary()
+	return s.putObject(b)
+}
+
+// Recreates the tree of a snapshot in dir, which is created if necessary.
+// The snapshot is overlaid on dir rather than replacing it: existing
+// entries with the names of snapshot entries are replaced, and links are
+// removed rather than followed, but other existing entries are kept.  The
+// mode of dir itself is left unchanged, since snapshots do not record it.
+func Restore(store ChunkStore, id ChunkID, dir string) error {
+	snapshot, err := LoadSnapshot(store, id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return restoreTree(store, snapshot.Tree, dir)
+}
+
+func restoreTree(store ChunkStore, id ChunkID, dir string) error {
+	tree, err := LoadTree(store, id)
+	if err != nil {
+		return err
+	}
+	for _, entry := range tree.Entries {
+		if !validEntryName(entry.Name) {
+			return fmt.Errorf("%w: entry name %q", ErrInvalidObject, entry.Name)
+		}
+		name := filepath.Join(dir, entry.Name)
+		// Remove anything in the way that is not of the same type, so that
+		// an existing link cannot redirect the restore.
+		if info, err := os.Lstat(name); err == nil {
+			same := (entry.Mode.IsDir() && info.IsDir()) ||
+				(entry.Mode.IsRegular() && info.Mode().IsRegular())
+			if !same {
+				if err := os.RemoveAll(name); err != nil {
+					return err
+				}
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		switch {
+		case entry.Mode.IsDir():
+			// Fill the directory before restricting it.
+			if err := os.Mkdir(name, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+			if err := restoreTree(store, entry.Ref, name); err != nil {
+				return err
+			}
+
+		case entry.Mode.IsRegular():
+			if err := restoreFile(store, entry.Ref, name); err != nil {
+				return err
+			}
+
+		default:
+			if err := os.Symlink(entry.Target, name); err != nil {
+				return err
+			}
+			// Links have no mode or time of their own on most systems.
+			continue
+		}
+		mode := entry.Mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		if err := os.Chmod(name, mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(name, entry.ModTime, entry.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether name is a single path element other than "." and "..".
+func validEntryName(name string) bool {
+	return name != "." && filepath.IsLocal(name) && filepath.Base(name) == name &&
+		!strings.Contains(name, "/")
+}
+
+func restoreFile(store ChunkStore, id ChunkID, name string) error {
+	m, err := LoadManifest(store, id)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = Reassemble(m, store.Get, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// Reads a Snapshot from store.
+func LoadSnapshot(store ChunkStore, id ChunkID) (*Snapshot, error) {
+	b, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := new(Snapshot)
+	if err := snapshot.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Reads a Tree from store.
+func LoadTree(store ChunkStore, id ChunkID) (*Tree, error) {
+	b, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	tree := new(Tree)
+	if err := tree.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// Reads a Manifest from store.
+func LoadManifest(store ChunkStore, id ChunkID) (*Manifest, error) {
+	b, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if err := m.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// Appends t as seconds and nanoseconds since the Unix epoch.
+func appendTime(b []byte, t time.Time) []byte {
+	b = binary.AppendVarint(b, t.Unix())
+	return binary.AppendUvarint(b, uint64(t.Nanosecond()))
+}
+
+func (t *Tree) MarshalBinary() ([]byte, error) {
+	b := []byte(kTreeMagic)
+	b = append(b, kObjectVersion)
+	b = binary.AppendUvarint(b, uint64(len(t.Entries)))
+	for _, entry := range t.Entries {
+		b = appendString(b, entry.Name)
+		b = binary.AppendUvarint(b, uint64(entry.Mode))
+		b = binary.AppendVarint(b, entry.Size)
+		b = appendTime(b, entry.ModTime)
+		b = binary.AppendUvarint(b, entry.Inode)
+		b = binary.BigEndian.AppendUint64(b, uint64(entry.Ref))
+		b = appendString(b, entry.Target)
+	}
+	return b, nil
+}
+
+// Reads the fields of an object after checking its magic and version.
+type objectReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func newObjectReader(data []byte, magic string) *objectReader {
+	r := &objectReader{r: bytes.NewReader(data)}
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r.r, header); err != nil ||
+		string(header[:len(magic)]) != magic || header[len(magic)] != kObjectVersion {
+		r.err = fmt.Errorf("%w: bad header", ErrInvalidObject)
+	}
+	return r
+}
+
+func (r *objectReader) uvarint() uint64 {
+	var v uint64
+	if r.err == nil {
+		v, r.err = binary.ReadUvarint(r.r)
+	}
+	return v
+}
+
+func (r *objectReader) varint() int64 {
+	var v int64
+	if r.err == nil {
+		v, r.err = binary.ReadVarint(r.r)
+	}
+	return v
+}
+
+func (r *objectReader) time() time.Time {
+	sec := r.varint()
+	nsec := r.uvarint()
+	return time.Unix(sec, int64(nsec))
+}
+
+func (r *objectReader) uint64() uint64 {
+	var v uint64
+	if r.err == nil {
+		r.err = binary.Read(r.r, binary.BigEndian, &v)
+	}
+	return v
+}
+
+func (r *objectReader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(r.r.Len()) {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	b := make([]byte, n)
+	r.r.Read(b)
+	return string(b)
+}
+
+// Returns the first error, if any, including trailing data.
+func (r *objectReader) close() error {
+	if r.err == nil && r.r.Len() != 0 {
+		r.err = errors.New("trailing data")
+	}
+	if r.err != nil && !errors.Is(r.err, ErrInvalidObject) {
+		return fmt.Errorf("%w: %v", ErrInvalidObject, r.err)
+	}
+	return r.err
+}
+
+func (t *Tree) UnmarshalBinary(data []byte) error {
+	r := newObjectReader(data, kTreeMagic)
+	count := r.uvarint()
+	// Each entry takes at least 14 bytes.
+	if r.err == nil && count > uint64(r.r.Len()/14) {
+		r.err = io.ErrUnexpectedEOF
+	}
+	tree := Tree{Entries: []TreeEntry{}}
+	for ii := uint64(0); ii < count && r.err == nil; ii++ {
+		var entry TreeEntry
+		entry.Name = r.string()
+		if r.err == nil && !validEntryName(entry.Name) {
+			r.err = fmt.Errorf("entry name %q", entry.Name)
+		}
+		entry.Mode = fs.FileMode(r.uvarint())
+		entry.Size = r.varint()
+		entry.ModTime = r.time()
+		entry.Inode = r.uvarint()
+		entry.Ref = ChunkID(r.uint64())
+		entry.Target = r.string()
+		tree.Entries = append(tree.Entries, entry)
+	}
+	if err := r.close(); err != nil {
+		return err
+	}
+	*t = tree
+	return nil
+}
+
+func (s *Snapshot) MarshalBinary() ([]byte, error) {
+	b := []byte(kSnapshotMagic)
+	b = append(b, kObjectVersion)
+	b = binary.BigEndian.AppendUint64(b, uint64(s.Tree))
+	b = binary.BigEndian.AppendUint64(b, uint64(s.Parent))
+	b = appendTime(b, s.Time)
+	return b, nil
+}
+
+func (s *Snapshot) UnmarshalBinary(data []byte) error {
+	r := newObjectReader(data, kSnapshotMagic)
+	snapshot := Snapshot{
+		Tree:   ChunkID(r.uint64()),
+		Parent: ChunkID(r.uint64()),
+		Time:   r.time(),
+	}
+	if err := r.close(); err != nil {
+		return err
+	}
+	*s = snapshot
+	return nil
+}
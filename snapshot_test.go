@@ -0,0 +1,308 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// Creates a directory tree for snapshots.
+func makeTestTree(t *testing.T, dir string) {
+	mtime := time.Date(2012, 6, 1, 12, 0, 0, 0, time.UTC)
+	files := []struct {
+		name string
+		data []byte
+		mode fs.FileMode
+	}{
+		{"empty", nil, 0644},
+		{"small", []byte("hello, world\n"), 0600},
+		{"big", makeRandomData(0, 300*1024), 0644},
+		{"a/copy", makeRandomData(0, 300*1024), 0755},
+		{"a/b/c/deep", makeRandomData(1, 100*1024), 0640},
+		{"a/empty/.keep", nil, 0644},
+	}
+	for _, file := range files {
+		name := filepath.Join(dir, file.name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, file.data, file.mode); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(name, file.mode)
+		os.Chtimes(name, mtime, mtime)
+	}
+	if err := os.Symlink("../big", filepath.Join(dir, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(filepath.Join(dir, "a", "b"), 0700)
+	os.Chtimes(filepath.Join(dir, "a", "b"), mtime, mtime)
+}
+
+// Checks that two directory trees are identical.
+func compareTrees(t *testing.T, want, got string) {
+	count := 0
+	err := filepath.WalkDir(want, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(want, name)
+		other := filepath.Join(got, rel)
+		count++
+
+		wantInfo, _ := os.Lstat(name)
+		gotInfo, err := os.Lstat(other)
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: %v", rel, err))
+			return nil
+		}
+		if wantInfo.Mode() != gotInfo.Mode() {
+			t.Error(fmt.Sprintf("%s: mode %v, expected %v", rel, gotInfo.Mode(), wantInfo.Mode()))
+		}
+		switch {
+		case wantInfo.Mode()&fs.ModeSymlink != 0:
+			wantTarget, _ := os.Readlink(name)
+			gotTarget, _ := os.Readlink(other)
+			if wantTarget != gotTarget {
+				t.Error(fmt.Sprintf("%s: link to %q, expected %q", rel, gotTarget, wantTarget))
+			}
+		case wantInfo.Mode().IsRegular():
+			wantData, _ := os.ReadFile(name)
+			gotData, _ := os.ReadFile(other)
+			if !bytes.Equal(wantData, gotData) {
+				t.Error(fmt.Sprintf("%s: contents differ", rel))
+			}
+			fallthrough
+		default:
+			if rel != "." && !wantInfo.ModTime().Equal(gotInfo.ModTime()) {
+				t.Error(fmt.Sprintf("%s: mtime %v, expected %v", rel,
+					gotInfo.ModTime(), wantInfo.ModTime()))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing extra.
+	extra := 0
+	filepath.WalkDir(got, func(name string, d fs.DirEntry, err error) error {
+		extra++
+		return nil
+	})
+	if extra != count {
+		t.Error(fmt.Sprintf("restored %d entries, expected %d", extra, count))
+	}
+}
+
+func Test_Snapshot(t *testing.T) {
+	src := t.TempDir()
+	makeTestTree(t, src)
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSnapshotter(store, DefaultChunkerParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := s.SnapshotDir(src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats.Files != 6 || stats.Reused != 0 {
+		t.Error(fmt.Sprintf("first snapshot: %+v", stats))
+	}
+	dst := filepath.Join(t.TempDir(), "restore")
+	if err := Restore(store, first, dst); err != nil {
+		t.Fatal(err)
+	}
+	compareTrees(t, src, dst)
+
+	// The duplicate file adds no chunks.
+	chunks := 0
+	store.Walk(func(id ChunkID) error {
+		chunks++
+		return nil
+	})
+	bigChunks := len(chunkAll(t, bytes.NewReader(makeRandomData(0, 300*1024)), DefaultChunkerParams()))
+	deepChunks := len(chunkAll(t, bytes.NewReader(makeRandomData(1, 100*1024)), DefaultChunkerParams()))
+	// Data chunks, manifests, trees and the snapshot.
+	objects := (bigChunks + deepChunks + 1) + 4 + 5 + 1
+	if chunks != objects {
+		t.Error(fmt.Sprintf("%d objects stored, expected %d", chunks, objects))
+	}
+
+	// An unchanged tree is not reread.
+	second, err := s.SnapshotDir(src, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats.Reused != stats.Files || stats.Chunked != 0 {
+		t.Error(fmt.Sprintf("unchanged snapshot: %+v", stats))
+	}
+	snap1, _ := LoadSnapshot(store, first)
+	snap2, err := LoadSnapshot(store, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap2.Tree != snap1.Tree || snap2.Parent != first {
+		t.Error(fmt.Sprintf("unchanged snapshot: %+v, first %+v", snap2, snap1))
+	}
+
+	// A modified file is.
+	old := t.TempDir()
+	if err := Restore(store, first, old); err != nil {
+		t.Fatal(err)
+	}
+	deep := filepath.Join(src, "a", "b", "c", "deep")
+	data, _ := os.ReadFile(deep)
+	data[1000] ^= 1
+	os.WriteFile(deep, data, 0640)
+	third, err := s.SnapshotDir(src, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats.Reused != stats.Files-1 || stats.Chunked != int64(len(data)) {
+		t.Error(fmt.Sprintf("modified snapshot: %+v", stats))
+	}
+	dst = t.TempDir()
+	if err := Restore(store, third, dst); err != nil {
+		t.Fatal(err)
+	}
+	compareTrees(t, src, dst)
+
+	// The first snapshot is unaffected.
+	dst = t.TempDir()
+	if err := Restore(store, first, dst); err != nil {
+		t.Fatal(err)
+	}
+	compareTrees(t, old, dst)
+}
+
+func Test_SnapshotFS(t *testing.T) {
+	mtime := time.Date(2012, 6, 1, 0, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"x":     {Data: []byte("x"), Mode: 0644, ModTime: mtime},
+		"d/y":   {Data: makeRandomData(2, 50000), Mode: 0600, ModTime: mtime},
+		"d/e/z": {Data: nil, Mode: 0644, ModTime: mtime},
+	}
+	store := NewMemoryStore()
+	s, _ := NewSnapshotter(store, DefaultChunkerParams())
+	id, err := s.Snapshot(fsys, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := Restore(store, id, dst); err != nil {
+		t.Fatal(err)
+	}
+	for name, file := range fsys {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || !bytes.Equal(got, file.Data) {
+			t.Error(fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+}
+
+func Test_SnapshotObjects(t *testing.T) {
+	tree := &Tree{Entries: []TreeEntry{
+		{Name: "f", Mode: 0644, Size: 10, ModTime: time.Unix(0, 12345), Inode: 7, Ref: 99},
+		{Name: "d", Mode: fs.ModeDir | 0755, ModTime: time.Unix(5, 0), Ref: 1},
+		{Name: "l", Mode: fs.ModeSymlink | 0777, Target: "f"},
+	}}
+	b, _ := tree.MarshalBinary()
+	var got Tree
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	for ii := range tree.Entries {
+		want, entry := tree.Entries[ii], got.Entries[ii]
+		if entry.Name != want.Name || entry.Mode != want.Mode || entry.Size != want.Size ||
+			!entry.ModTime.Equal(want.ModTime) || entry.Inode != want.Inode ||
+			entry.Ref != want.Ref || entry.Target != want.Target {
+			t.Error(fmt.Sprintf("entry %d: %+v, expected %+v", ii, entry, want))
+		}
+	}
+
+	for _, bad := range [][]byte{nil, []byte("RBTR"), b[:len(b)-1], append(b, 0)} {
+		if err := new(Tree).UnmarshalBinary(bad); !errors.Is(err, ErrInvalidObject) {
+			t.Error(fmt.Sprintf("%d bytes: %v", len(bad), err))
+		}
+	}
+	// Names must be single path elements.
+	for _, name := range []string{"", ".", "..", "a/b", "/abs", "../up"} {
+		bad := &Tree{Entries: []TreeEntry{{Name: name, Mode: 0644}}}
+		b, _ := bad.MarshalBinary()
+		if err := new(Tree).UnmarshalBinary(b); !errors.Is(err, ErrInvalidObject) {
+			t.Error(fmt.Sprintf("name %q: %v", name, err))
+		}
+	}
+
+	snapshot := &Snapshot{Tree: 1, Parent: 2, Time: time.Unix(3, 4)}
+	b, _ = snapshot.MarshalBinary()
+	if err := new(Snapshot).UnmarshalBinary(b[:len(b)-1]); !errors.Is(err, ErrInvalidObject) {
+		t.Error(fmt.Sprintf("truncated snapshot: %v", err))
+	}
+	if err := new(Snapshot).UnmarshalBinary(b); err != nil {
+		t.Error(err)
+	}
+}
+
+// Links in the restore directory are replaced rather than followed.
+func Test_RestoreExisting(t *testing.T) {
+	src := t.TempDir()
+	makeTestTree(t, src)
+	store := NewMemoryStore()
+	s, _ := NewSnapshotter(store, DefaultChunkerParams())
+	id, err := s.SnapshotDir(src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outside := t.TempDir()
+	victim := filepath.Join(outside, "victim")
+	os.WriteFile(victim, []byte("untouched"), 0644)
+	dst := t.TempDir()
+	os.Symlink(victim, filepath.Join(dst, "big"))
+	os.Symlink(outside, filepath.Join(dst, "a"))
+	// A directory where the snapshot has a file.
+	os.MkdirAll(filepath.Join(dst, "small", "sub"), 0755)
+	// Entries that are not in the snapshot.
+	extra := filepath.Join(dst, "extra")
+	os.WriteFile(extra, []byte("kept"), 0644)
+	os.Chmod(dst, 0750)
+
+	if err := Restore(store, id, dst); err != nil {
+		t.Fatal(err)
+	}
+	// Restore overlays the snapshot.
+	if data, err := os.ReadFile(extra); err != nil || string(data) != "kept" {
+		t.Error(fmt.Sprintf("extra file: %q, %v", data, err))
+	}
+	if info, err := os.Stat(dst); err != nil || info.Mode().Perm() != 0750 {
+		t.Error(fmt.Sprintf("restore directory mode changed: %v", err))
+	}
+	os.Remove(extra)
+	srcInfo, _ := os.Stat(src)
+	os.Chmod(dst, srcInfo.Mode().Perm())
+	compareTrees(t, src, dst)
+	if data, _ := os.ReadFile(victim); string(data) != "untouched" {
+		t.Error(fmt.Sprintf("file outside the restore was changed: %q", data))
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Error(fmt.Sprintf("%d entries written outside the restore", len(entries)))
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+var (
+	// Returned (wrapped) when a chunk is not in a store.
+	ErrChunkNotFound = errors.New("rabin: chunk not found")
+	// Returned (wrapped) when stored chunk data does not match its
+	// fingerprint.
+	ErrChunkCorrupt = errors.New("rabin: chunk corrupt")
+	// Returned (wrapped) when stored chunk data is shorter than recorded.
+	ErrChunkTruncated = errors.New("rabin: chunk truncated")
+)
+
+// Identifies a chunk in a ChunkStore.  This is normally the 64-bit Rabin
+// fingerprint of the chunk (see ChunkIDOf), but stores accept any ID.
+type ChunkID uint64
+
+// Returns the ID of data: its 64-bit Rabin fingerprint.
+func ChunkIDOf(data []byte) ChunkID {
+	hash := New64()
+	hash.Write(data)
+	return ChunkID(hash.Sum64())
+}
+
+// Returns the ID as 16 hex digits.
+func (id ChunkID) String() string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// Parses an ID in the form returned by String.
+func ParseChunkID(s string) (ChunkID, error) {
+	if len(s) != 16 {
+		return 0, fmt.Errorf("rabin: invalid chunk ID %q", s)
+	}
+	v, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("rabin: invalid chunk ID %q", s)
+	}
+	return ChunkID(v), nil
+}
+
+func (id ChunkID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *ChunkID) UnmarshalText(text []byte) error {
+	parsed, err := ParseChunkID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// Stores chunks by ID.  Each ID is stored at most once: a Put of an ID that
+// is already present does nothing.  Get verifies data against the Rabin
+// fingerprint recorded by Put and fails with ErrChunkCorrupt or
+// ErrChunkTruncated if it does not match.  Implementations are safe for
+// concurrent use.
+type ChunkStore interface {
+	Put(id ChunkID, data []byte) error
+	// Returns ErrChunkNotFound if id is not present.
+	Get(id ChunkID) ([]byte, error)
+	Has(id ChunkID) (bool, error)
+	// Deleting a missing chunk is not an error.
+	Delete(id ChunkID) error
+}
+
+// A chunk that failed verification.
+type ChunkError struct {
+	ID  ChunkID
+	Err error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %s: %v", e.ID, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+type memoryChunk struct {
+	data        []byte
+	fingerprint uint64
+}
+
+// An in-memory ChunkStore, mainly for tests.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	chunks map[ChunkID]memoryChunk
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{chunks: make(map[ChunkID]memoryChunk)}
+}
+
+func (s *MemoryStore) Put(id ChunkID, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.chunks[id]; ok {
+		return nil
+	}
+	s.chunks[id] = memoryChunk{
+		data:        append([]byte{}, data...),
+		fingerprint: uint64(ChunkIDOf(data)),
+	}
+	return nil
+}
+
+func (s *MemoryStore) Get(id ChunkID) ([]byte, error) {
+	s.mu.RLock()
+	chunk, ok := s.chunks[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrChunkNotFound, id)
+	}
+	if uint64(ChunkIDOf(chunk.data)) != chunk.fingerprint {
+		return nil, &ChunkError{ID: id, Err: ErrChunkCorrupt}
+	}
+	return append([]byte{}, chunk.data...), nil
+}
+
+func (s *MemoryStore) Has(id ChunkID) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.chunks[id]
+	return ok, nil
+}
+
+func (s *MemoryStore) Delete(id ChunkID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.chunks, id)
+	return nil
+}
+
+// Calls fn for each chunk ID in an unspecified order and stops at the first
+// error, which is returned.
+func (s *MemoryStore) Walk(fn func(id ChunkID) error) error {
+	s.mu.RLock()
+	ids := make([]ChunkID, 0, len(s.chunks))
+	for id := range s.chunks {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
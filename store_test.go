@@ -0,0 +1,112 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Exercises the ChunkStore contract.
+func testChunkStore(t *testing.T, store ChunkStore) {
+	data := makeRandomData(0, 1<<20)
+	params := DefaultChunkerParams()
+	chunks := chunkAll(t, bytes.NewReader(data), params)
+
+	for _, chunk := range chunks {
+		id := ChunkIDOf(chunk.Data)
+		if ok, err := store.Has(id); err != nil || ok {
+			t.Fatal(fmt.Sprintf("%s: Has before Put: %v, %v", id, ok, err))
+		}
+		if _, err := store.Get(id); !errors.Is(err, ErrChunkNotFound) {
+			t.Fatal(fmt.Sprintf("%s: Get before Put: %v", id, err))
+		}
+		if err := store.Put(id, chunk.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Puts from concurrent writers of the same chunks.
+	var wg sync.WaitGroup
+	for ii := 0; ii < 4; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, chunk := range chunks {
+				if err := store.Put(ChunkIDOf(chunk.Data), chunk.Data); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, chunk := range chunks {
+		id := ChunkIDOf(chunk.Data)
+		if ok, err := store.Has(id); err != nil || !ok {
+			t.Error(fmt.Sprintf("%s: Has after Put: %v, %v", id, ok, err))
+		}
+		got, err := store.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, chunk.Data) {
+			t.Error(fmt.Sprintf("%s: data mismatch", id))
+		}
+	}
+
+	id := ChunkIDOf(chunks[0].Data)
+	if err := store.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Has(id); ok {
+		t.Error("chunk present after Delete")
+	}
+	if err := store.Delete(id); err != nil {
+		t.Error(fmt.Sprintf("second Delete: %v", err))
+	}
+
+	// IDs need not be fingerprints.
+	if err := store.Put(1, []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get(1); err != nil || string(got) != "one" {
+		t.Error(fmt.Sprintf("Get(1) = %q, %v", got, err))
+	}
+}
+
+func Test_MemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	testChunkStore(t, store)
+
+	count := 0
+	store.Walk(func(id ChunkID) error {
+		count++
+		return nil
+	})
+	if count != len(store.chunks) {
+		t.Error(fmt.Sprintf("walked %d of %d chunks", count, len(store.chunks)))
+	}
+}
+
+func Test_ChunkID(t *testing.T) {
+	for _, id := range []ChunkID{0, 1, 0xdeadbeef, ^ChunkID(0)} {
+		parsed, err := ParseChunkID(id.String())
+		if err != nil || parsed != id {
+			t.Error(fmt.Sprintf("%s: parsed %s, %v", id, parsed, err))
+		}
+	}
+	for _, s := range []string{"", "123", "000000000000000g", "00000000000000001"} {
+		if _, err := ParseChunkID(s); err == nil {
+			t.Error(fmt.Sprintf("parsed %q", s))
+		}
+	}
+	if ChunkIDOf([]byte("hello")) != ChunkID(fingerprint64([]byte("hello"))) {
+		t.Error("ChunkIDOf differs from New64")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"fmt"
+)
+
+// Counts how TTTD chunks were cut.
+type TTTDStats struct {
+	// Cuts at a match of the main divisor.
+	Main int
+	// Cuts at the last backup divisor match when MaxSize was reached.
+	Backup int
+	// Cuts at MaxSize with no backup match.
+	Hard int
+	// Chunks that were ended by the end of the stream.
+	Final int
+}
+
+// Two Thresholds, Two Divisors chunking (Eshghi and Tang, HP Labs
+// TR-2005-30).  In addition to the main mask of ChunkerParams, a backup
+// mask with fewer bits is matched during scanning.  If MaxSize is reached
+// without a main match, the chunk is cut at the last backup match instead
+// of at MaxSize, which preserves boundary stability on data where main
+// matches are rare.
+type TTTDSplitter struct {
+	rabin *rabinSplitter
+
+	backupMask   uint64
+	backupTarget uint64
+
+	stats TTTDStats
+}
+
+// Returns a TTTD splitter.  backupSize plays the role of
+// ChunkerParams.AvgSize for the backup divisor; it must be a power of two
+// less than params.AvgSize.  The paper suggests params.AvgSize / 2.
+func NewTTTDSplitter(params ChunkerParams, backupSize int) (*TTTDSplitter, error) {
+	if backupSize <= 0 || backupSize >= params.AvgSize || !IsPowerOfTwo(backupSize) {
+		return nil, fmt.Errorf("%w: backupSize %d", ErrChunkerParams, backupSize)
+	}
+	rabin, err := newRabinSplitter(params)
+	if err != nil {
+		return nil, err
+	}
+	backupMask := uint64(backupSize - 1)
+	return &TTTDSplitter{
+		rabin:        rabin,
+		backupMask:   backupMask,
+		backupTarget: params.Target & backupMask,
+	}, nil
+}
+
+func (s *TTTDSplitter) MaxSize() int {
+	return s.rabin.params.MaxSize
+}
+
+// Returns counts of each kind of cut made so far.
+func (s *TTTDSplitter) Stats() TTTDStats {
+	return s.stats
+}
+
+func (s *TTTDSplitter) Split(data []byte) (int, uint64) {
+	params := &s.rabin.params
+	windowSize := params.WindowSize
+	minSize := params.MinSize
+	if len(data) <= minSize {
+		s.stats.Final++
+		return len(data), s.rabin.fingerprint(data)
+	}
+
+	hash := s.rabin.hash
+	hash.Reset()
+	hash.Write(data[minSize-windowSize : minSize])
+	fp := hash.Sum64()
+
+	backup := 0
+	backupFp := uint64(0)
+	for n := minSize; ; n++ {
+		if n > minSize {
+			fp = hash.rollByte(data[n-1-windowSize], data[n-1])
+		}
+		if fp&s.rabin.mask == s.rabin.target {
+			s.stats.Main++
+			return n, fp
+		}
+		if fp&s.backupMask == s.backupTarget {
+			backup = n
+			backupFp = fp
+		}
+		if n == len(data) {
+			break
+		}
+	}
+
+	switch {
+	case len(data) < params.MaxSize:
+		s.stats.Final++
+		return len(data), fp
+	case backup > 0:
+		s.stats.Backup++
+		return backup, backupFp
+	}
+	s.stats.Hard++
+	return len(data), fp
+}
@@ -0,0 +1,94 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Parameters under which main matches are rare, so that many chunks reach
+// MaxSize.
+func makeSparseMatchParams() ChunkerParams {
+	params := DefaultChunkerParams()
+	params.AvgSize = 64 * 1024
+	params.MaxSize = 32 * 1024
+	return params
+}
+
+func Test_TTTD(t *testing.T) {
+	params := makeSparseMatchParams()
+	splitter, err := NewTTTDSplitter(params, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeRandomData(0, 4<<20)
+	chunks := chunkAllWithSplitter(t, data, splitter)
+	checkChunks(t, data, chunks, params.MinSize, params.MaxSize)
+
+	stats := splitter.Stats()
+	if stats.Main+stats.Backup+stats.Hard+stats.Final != len(chunks) {
+		t.Error(fmt.Sprintf("stats %+v do not add up to %d chunks", stats, len(chunks)))
+	}
+	if stats.Final != 1 {
+		t.Error(fmt.Sprintf("%d final chunks", stats.Final))
+	}
+	if stats.Backup == 0 || stats.Main == 0 {
+		t.Error(fmt.Sprintf("expected main and backup cuts: %+v", stats))
+	}
+
+	for ii, chunk := range chunks {
+		fp := RabinFingerprintFixed(chunk.Data[chunk.Length-params.WindowSize:])
+		if fp != chunk.Fingerprint {
+			t.Error(fmt.Sprintf("chunk %d: fingerprint 0x%x != 0x%x", ii, chunk.Fingerprint, fp))
+		}
+	}
+
+	// Plain Rabin chunking cuts far more chunks at MaxSize.
+	rabinChunks := chunkAll(t, bytes.NewReader(data), params)
+	rabinHard := 0
+	for _, chunk := range rabinChunks {
+		if chunk.Length == params.MaxSize {
+			rabinHard++
+		}
+	}
+	if stats.Hard*10 > rabinHard {
+		t.Error(fmt.Sprintf("TTTD hard cuts %d vs. Rabin %d", stats.Hard, rabinHard))
+	}
+}
+
+// Backup cuts keep boundaries stable where hard cuts would shift.
+func Test_TTTDInsertion(t *testing.T) {
+	params := makeSparseMatchParams()
+	data := makeRandomData(1, 4<<20)
+	edited := append(append(append([]byte{}, data[:1000]...), "inserted bytes"...), data[1000:]...)
+	versions := [][]byte{data, edited}
+
+	tttd, err := NewTTTDSplitter(params, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rabin, err := NewRabinSplitter(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tttdRatio, _ := dedupRatio(tttd, versions)
+	rabinRatio, _ := dedupRatio(rabin, versions)
+	if tttdRatio <= rabinRatio {
+		t.Error(fmt.Sprintf("TTTD ratio %f <= Rabin ratio %f", tttdRatio, rabinRatio))
+	}
+}
+
+func Test_TTTDParams(t *testing.T) {
+	params := DefaultChunkerParams()
+	for _, backupSize := range []int{0, 3000, params.AvgSize, 2 * params.AvgSize} {
+		if _, err := NewTTTDSplitter(params, backupSize); !errors.Is(err, ErrChunkerParams) {
+			t.Error(fmt.Sprintf("backupSize %d: expected ErrChunkerParams, got %v", backupSize, err))
+		}
+	}
+}
@@ -27,6 +27,11 @@ type rabinRollingTables32 struct {
 	t8m24 *[256]uint64
 }
 
+type rabinRollingTables64 struct {
+	// m is the rolling window size in bytes.  raw[k] holds t^{8m + 8k}.
+	raw *[8][256]uint64
+}
+
 type rabinTables32 struct {
 	// t64 is [0]
 	raw *[4][256]uint64
@@ -199,10 +204,14 @@ func FindIrreducible(degree int) *Polynomial {
 		panic(err)
 	}
 	source := rand.NewSource(seed.Int64())
-	randGen := rand.New(source)
+	return FindIrreducibleRand(rand.New(source), degree)
+}
 
+// Returns an irreducible polynomial of given degree using gen, which
+// determines the result.
+func FindIrreducibleRand(gen *rand.Rand, degree int) *Polynomial {
 	for {
-		p := MakeRandom(randGen, degree)
+		p := MakeRandom(gen, degree)
 		if p.Irreducible() {
 			return p
 		}
@@ -239,21 +248,24 @@ func RabinFingerprintFixed(data []byte) (fp uint64) {
 // Returns a 64-entry table of t^k mod P(t) for
 // basePower \le k < (64 + basePower).
 //
-// basePower must be >= 64.
-//
-// P(t) is kIrreduciblePolyCoeffs
+// P(t) is the degree 64 polynomial whose remaining coefficients are
+// polyCoeffs (e.g., kIrreduciblePolyCoeffs).
 // See rabin.tex (Basic Operations) for an explanation.
-func makePowerTable(basePower int) *[64]uint64 {
+func makePowerTable(basePower int, polyCoeffs uint64) *[64]uint64 {
 	powerTable := &[64]uint64{}
 
 	// t^k mod P(t) = P(t) + t^k.  Note that degree(P(t)) = 64 and that
-	// kIrreduciblePolyCoeffs does not include the implied t^64 term.
-	pTk := uint64(kIrreduciblePolyCoeffs)
+	// polyCoeffs does not include the implied t^64 term.
+	pTk := polyCoeffs
 
-	// We always start from t^64.  Polynomials of degree < 64 are trivially
-	// determined, since deg(P(t)) = 64.
+	// Polynomials of degree < 64 are trivially determined, since
+	// deg(P(t)) = 64.  Otherwise, we start from t^64.
 	index := 64
 	curr := pTk
+	if basePower < 64 {
+		index = basePower
+		curr = uint64(1) << uint(basePower)
+	}
 
 	// Advance to basePower.
 	for index < basePower {
@@ -315,8 +327,8 @@ func makeTables32Raw(powerTable *[64]uint64) (tables *[4][256]uint64) {
 	return tables
 }
 
-func makeRabinTables32() *rabinTables32 {
-	rawTables := makeRabinTables32Raw()
+func makeRabinTables32(polyCoeffs uint64) *rabinTables32 {
+	rawTables := makeRabinTables32Raw(polyCoeffs)
 	return &rabinTables32{
 		raw: rawTables,
 		t64: &rawTables[0],
@@ -327,8 +339,8 @@ func makeRabinTables32() *rabinTables32 {
 }
 
 // windowSize is in bytes.
-func makeRabinRollingTables32(windowSize int) *rabinRollingTables32 {
-	rawTables := makeRabinRollingTables32Raw(windowSize)
+func makeRabinRollingTables32(windowSize int, polyCoeffs uint64) *rabinRollingTables32 {
+	rawTables := makeRabinRollingTables32Raw(windowSize, polyCoeffs)
 	return &rabinRollingTables32{
 		t8m0:  &rawTables[0],
 		t8m8:  &rawTables[1],
@@ -339,36 +351,22 @@ func makeRabinRollingTables32(windowSize int) *rabinRollingTables32 {
 
 // windowSize is the number of bytes for the window.  This generates 4
 // tables for a 32-bit word starting at t^{8*size}.
-func makeRabinRollingTables32Raw(windowSize int) (tables *[4][256]uint64) {
-	powerTable := makePowerTable(8 * windowSize)
+func makeRabinRollingTables32Raw(windowSize int, polyCoeffs uint64) (tables *[4][256]uint64) {
+	powerTable := makePowerTable(8*windowSize, polyCoeffs)
 	return makeTables32Raw(powerTable)
 }
 
 // T64 is [0].
-func makeRabinTables32Raw() *[4][256]uint64 {
-	powerTable := makePowerTable(64)
+func makeRabinTables32Raw(polyCoeffs uint64) *[4][256]uint64 {
+	powerTable := makePowerTable(64, polyCoeffs)
 	return makeTables32Raw(powerTable)
 }
 
-func makeRabinTables64() *rabinTables64 {
-	rawTables := makeRabinTables64Raw()
-	return &rabinTables64{
-		raw:  rawTables,
-		t64:  &rawTables[0],
-		t72:  &rawTables[1],
-		t80:  &rawTables[2],
-		t88:  &rawTables[3],
-		t96:  &rawTables[4],
-		t104: &rawTables[5],
-		t112: &rawTables[6],
-		t120: &rawTables[7],
-	}
-}
-
-// T64 is [0]
-func makeRabinTables64Raw() (tables *[8][256]uint64) {
-	powerTable := makePowerTable(64)
-
+// Generates byte tables for a 64-bit word using the given power table.
+// This is the 64-bit analogue of makeTables32Raw.
+//
+// tables[0] will correspond with t^{basePower}.
+func makeTables64Raw(powerTable *[64]uint64) (tables *[8][256]uint64) {
 	tables = &[8][256]uint64{}
 	for ii := 0; ii < 256; ii++ {
 		// Expand ii bit-wise.
@@ -380,19 +378,41 @@ func makeRabinTables64Raw() (tables *[8][256]uint64) {
 
 			// Fill by each table offset.
 			for kk := 0; kk < 8; kk++ {
-				// (ii) * t^{basePower}
-				basePower := 64 + 8*kk
-
-				// Expand bit-wise:
-				// ii_1 t^{basePower + 7} + ... ii_8 t^{basePower}
-				powerOffset := basePower + jj - 64
-				tables[kk][ii] ^= powerTable[powerOffset]
+				tables[kk][ii] ^= powerTable[8*kk+jj]
 			}
 		}
 	}
 	return tables
 }
 
+// windowSize is in bytes.  This generates 8 tables for a 64-bit word
+// starting at t^{8*size}.
+func makeRabinRollingTables64(windowSize int, polyCoeffs uint64) *rabinRollingTables64 {
+	powerTable := makePowerTable(8*windowSize, polyCoeffs)
+	return &rabinRollingTables64{raw: makeTables64Raw(powerTable)}
+}
+
+func makeRabinTables64(polyCoeffs uint64) *rabinTables64 {
+	rawTables := makeRabinTables64Raw(polyCoeffs)
+	return &rabinTables64{
+		raw:  rawTables,
+		t64:  &rawTables[0],
+		t72:  &rawTables[1],
+		t80:  &rawTables[2],
+		t88:  &rawTables[3],
+		t96:  &rawTables[4],
+		t104: &rawTables[5],
+		t112: &rawTables[6],
+		t120: &rawTables[7],
+	}
+}
+
+// T64 is [0]
+func makeRabinTables64Raw(polyCoeffs uint64) (tables *[8][256]uint64) {
+	powerTable := makePowerTable(64, polyCoeffs)
+	return makeTables64Raw(powerTable)
+}
+
 // p is the irreducible polynomial.  This generates the 4 tables
 // TA, TB, TC, TD for fast 32-bit Rabin fingerprinting.  (See rabin.tex.)
 //
@@ -424,3 +444,18 @@ func MakeRabinTables64FromPoly(p *Polynomial) (tables *[8][256]uint64) {
 	}
 	return
 }
+
+// Returns a table of 256 pseudo-random values generated from seed with
+// splitmix64.  The table is fixed for a given seed so that hashes built on
+// it are stable across runs and platforms.
+func makeRandomTable(seed uint64) *[256]uint64 {
+	table := &[256]uint64{}
+	for ii := 0; ii < len(table); ii++ {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[ii] = z ^ (z >> 31)
+	}
+	return table
+}
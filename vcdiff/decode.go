@@ -0,0 +1,214 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vcdiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+)
+
+// Applies delta to source and returns the target.
+func Decode(source, delta []byte) ([]byte, error) {
+	if len(delta) < len(kMagic)+1 || !bytes.Equal(delta[:len(kMagic)], kMagic) {
+		return nil, fmt.Errorf("%w: bad header", ErrInvalid)
+	}
+	indicator := delta[len(kMagic)]
+	b := delta[len(kMagic)+1:]
+	if indicator&kVCDDecompress != 0 {
+		return nil, fmt.Errorf("%w: secondary compression", ErrUnsupported)
+	}
+	if indicator&kVCDCodeTable != 0 {
+		return nil, fmt.Errorf("%w: custom code table", ErrUnsupported)
+	}
+	if indicator&^(kVCDDecompress|kVCDCodeTable|kVCDAppHeader) != 0 {
+		return nil, fmt.Errorf("%w: header indicator 0x%x", ErrInvalid, indicator)
+	}
+	if indicator&kVCDAppHeader != 0 {
+		n, rest, err := readInt(b)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(rest)) {
+			return nil, fmt.Errorf("%w: truncated application header", ErrInvalid)
+		}
+		b = rest[n:]
+	}
+
+	target := []byte{}
+	for len(b) > 0 {
+		var err error
+		if target, b, err = decodeWindow(source, target, b); err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
+
+// Reads an integer that must not exceed limit.
+func readSize(b []byte, limit uint64, what string) (int, []byte, error) {
+	v, rest, err := readInt(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if v > limit {
+		return 0, nil, fmt.Errorf("%w: %s %d exceeds %d", ErrInvalid, what, v, limit)
+	}
+	return int(v), rest, nil
+}
+
+// Reads the length of a section that follows the integer.
+func readLength(b []byte, what string) (int, []byte, error) {
+	v, rest, err := readInt(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if v > uint64(len(rest)) {
+		return 0, nil, fmt.Errorf("%w: truncated %s", ErrInvalid, what)
+	}
+	return int(v), rest, nil
+}
+
+// Decodes the window at the start of b, appends its target window to
+// target and returns the result with the remainder of b.
+func decodeWindow(source, target, b []byte) ([]byte, []byte, error) {
+	indicator := b[0]
+	b = b[1:]
+	if indicator&^(kVCDSource|kVCDTarget|kVCDAdler32) != 0 ||
+		indicator&(kVCDSource|kVCDTarget) == kVCDSource|kVCDTarget {
+		return nil, nil, fmt.Errorf("%w: window indicator 0x%x", ErrInvalid, indicator)
+	}
+
+	// The source segment.
+	var segment []byte
+	if indicator&(kVCDSource|kVCDTarget) != 0 {
+		from := source
+		if indicator&kVCDTarget != 0 {
+			from = target
+		}
+		size, rest, err := readSize(b, uint64(len(from)), "source segment size")
+		if err != nil {
+			return nil, nil, err
+		}
+		pos, rest, err := readSize(rest, uint64(len(from)-size), "source segment position")
+		if err != nil {
+			return nil, nil, err
+		}
+		segment = from[pos : pos+size]
+		b = rest
+	}
+
+	deltaLen, b, err := readLength(b, "delta encoding")
+	if err != nil {
+		return nil, nil, err
+	}
+	rest := b[deltaLen:]
+	b = b[:deltaLen]
+
+	targetLen, b, err := readSize(b, 1<<31, "target window length")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("%w: truncated window", ErrInvalid)
+	}
+	if b[0] != 0 {
+		return nil, nil, fmt.Errorf("%w: compressed sections", ErrUnsupported)
+	}
+	b = b[1:]
+	dataLen, b, err := readLength(b, "data")
+	if err != nil {
+		return nil, nil, err
+	}
+	instLen, b, err := readLength(b, "instructions")
+	if err != nil {
+		return nil, nil, err
+	}
+	addrLen, b, err := readLength(b, "addresses")
+	if err != nil {
+		return nil, nil, err
+	}
+	var checksum uint32
+	if indicator&kVCDAdler32 != 0 {
+		if len(b) < 4 {
+			return nil, nil, fmt.Errorf("%w: truncated checksum", ErrInvalid)
+		}
+		checksum = binary.BigEndian.Uint32(b)
+		b = b[4:]
+	}
+	if dataLen+instLen+addrLen != len(b) {
+		return nil, nil, fmt.Errorf("%w: section lengths do not match window", ErrInvalid)
+	}
+	data, inst, addrs := b[:dataLen], b[dataLen:dataLen+instLen], b[dataLen+instLen:]
+
+	start := len(target)
+	var cache addressCache
+	for len(inst) > 0 {
+		entry := kDefaultCodeTable[inst[0]]
+		inst = inst[1:]
+		ops := [2][3]byte{
+			{entry.inst1, entry.size1, entry.mode1},
+			{entry.inst2, entry.size2, entry.mode2},
+		}
+		for _, op := range ops {
+			instType, size, mode := op[0], int(op[1]), op[2]
+			if instType == kNoop {
+				continue
+			}
+			if size == 0 {
+				if size, inst, err = readSize(inst, uint64(targetLen), "instruction size"); err != nil {
+					return nil, nil, err
+				}
+			}
+			if len(target)-start+size > targetLen {
+				return nil, nil, fmt.Errorf("%w: target window overflow", ErrInvalid)
+			}
+
+			switch instType {
+			case kAdd:
+				if size > len(data) {
+					return nil, nil, fmt.Errorf("%w: data section overflow", ErrInvalid)
+				}
+				target = append(target, data[:size]...)
+				data = data[size:]
+			case kRun:
+				if len(data) == 0 {
+					return nil, nil, fmt.Errorf("%w: data section overflow", ErrInvalid)
+				}
+				for ii := 0; ii < size; ii++ {
+					target = append(target, data[0])
+				}
+				data = data[1:]
+			case kCopy:
+				here := uint64(len(segment) + len(target) - start)
+				var addr uint64
+				if addr, addrs, err = cache.decode(addrs, mode, here); err != nil {
+					return nil, nil, err
+				}
+				// Copies from the target window may overlap their output,
+				// so copy a byte at a time.
+				for ii := uint64(0); ii < uint64(size); ii++ {
+					pos := addr + ii
+					if pos < uint64(len(segment)) {
+						target = append(target, segment[pos])
+					} else {
+						target = append(target, target[start+int(pos)-len(segment)])
+					}
+				}
+			default:
+				return nil, nil, fmt.Errorf("%w: instruction type %d", ErrInvalid, instType)
+			}
+		}
+	}
+
+	if len(target)-start != targetLen || len(data) != 0 || len(addrs) != 0 {
+		return nil, nil, fmt.Errorf("%w: window does not decode to its length", ErrInvalid)
+	}
+	if indicator&kVCDAdler32 != 0 && adler32.Checksum(target[start:]) != checksum {
+		return nil, nil, fmt.Errorf("%w: checksum mismatch", ErrInvalid)
+	}
+	return target, rest, nil
+}
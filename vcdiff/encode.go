@@ -0,0 +1,275 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vcdiff
+
+import (
+	"github.com/kevinko/rabin"
+)
+
+const (
+	// Matches are found through the Rabin fingerprints of blocks of this
+	// many bytes, so shorter matches are not found.
+	kBlockSize = 16
+
+	// Runs of at least this many bytes are encoded with RUN.
+	kMinRun = 8
+
+	// The target is split into windows of at most this many bytes.
+	kMaxWindowSize = 1 << 22
+)
+
+// A delta instruction before encoding.
+type vcdiffOp struct {
+	inst byte
+	size int
+	// The address of a COPY.
+	addr uint64
+	// The bytes of an ADD, or the byte of a RUN.
+	data []byte
+}
+
+// Returns a delta that transforms source into target.  Each window of the
+// target is matched against the whole source and against the part of the
+// window that precedes the match.
+func Encode(source, target []byte) []byte {
+	e := newEncoder(source)
+	out := append([]byte{}, kMagic...)
+	out = append(out, 0)
+	for start := 0; start < len(target); start += kMaxWindowSize {
+		end := start + kMaxWindowSize
+		if end > len(target) {
+			end = len(target)
+		}
+		out = e.encodeWindow(out, target[start:end])
+	}
+	return out
+}
+
+type encoder struct {
+	source []byte
+	// Fingerprints of the source blocks at multiples of kBlockSize.
+	sourceIndex map[uint64]int
+	hash        rabin.RollingHash
+}
+
+func newEncoder(source []byte) *encoder {
+	e := &encoder{
+		source:      source,
+		sourceIndex: make(map[uint64]int, len(source)/kBlockSize),
+		hash:        rabin.NewRolling(kBlockSize),
+	}
+	for pos := 0; pos+kBlockSize <= len(source); pos += kBlockSize {
+		fp := e.fingerprint(source[pos : pos+kBlockSize])
+		if _, ok := e.sourceIndex[fp]; !ok {
+			e.sourceIndex[fp] = pos
+		}
+	}
+	return e
+}
+
+// Resets the rolling hash to block and returns its fingerprint.
+func (e *encoder) fingerprint(block []byte) uint64 {
+	e.hash.Reset()
+	e.hash.Write(block)
+	return e.hash.Sum64()
+}
+
+// Returns the lengths by which a match of block at a and b extends
+// backward, not past limit bytes, and forward from the block.  src and dst
+// may be the same slice.
+func extendMatch(src []byte, a int, dst []byte, b, limit int) (back, forward int) {
+	for back < limit && back < a && src[a-back-1] == dst[b-back-1] {
+		back++
+	}
+	forward = kBlockSize
+	for a+forward < len(src) && b+forward < len(dst) && src[a+forward] == dst[b+forward] {
+		forward++
+	}
+	return back, forward
+}
+
+// Finds the instructions for one target window.
+func (e *encoder) match(window []byte) []vcdiffOp {
+	ops := []vcdiffOp{}
+	targetIndex := map[uint64]int{}
+	litStart := 0
+	flushLiteral := func(end int) {
+		if end > litStart {
+			ops = append(ops, vcdiffOp{inst: kAdd, size: end - litStart, data: window[litStart:end]})
+		}
+	}
+
+	pos := 0
+	primed := false
+	var fp uint64
+	for pos+kBlockSize <= len(window) {
+		run := 1
+		for pos+run < len(window) && window[pos+run] == window[pos] {
+			run++
+		}
+		if run >= kMinRun {
+			flushLiteral(pos)
+			ops = append(ops, vcdiffOp{inst: kRun, size: run, data: window[pos : pos+1]})
+			pos += run
+			litStart = pos
+			primed = false
+			continue
+		}
+
+		if !primed {
+			fp = e.fingerprint(window[pos : pos+kBlockSize])
+			primed = true
+		}
+		bestLen, bestBack := 0, 0
+		var bestAddr uint64
+		if s, ok := e.sourceIndex[fp]; ok &&
+			string(e.source[s:s+kBlockSize]) == string(window[pos:pos+kBlockSize]) {
+			back, forward := extendMatch(e.source, s, window, pos, pos-litStart)
+			bestLen, bestBack, bestAddr = back+forward, back, uint64(s-back)
+		}
+		if q, ok := targetIndex[fp]; ok &&
+			string(window[q:q+kBlockSize]) == string(window[pos:pos+kBlockSize]) {
+			back, forward := extendMatch(window, q, window, pos, pos-litStart)
+			if back+forward > bestLen {
+				bestLen, bestBack = back+forward, back
+				bestAddr = uint64(len(e.source) + q - back)
+			}
+		}
+
+		if bestLen > 0 {
+			flushLiteral(pos - bestBack)
+			ops = append(ops, vcdiffOp{inst: kCopy, size: bestLen, addr: bestAddr})
+			pos += bestLen - bestBack
+			litStart = pos
+			primed = false
+			continue
+		}
+
+		// Index the block at pos once it precedes the scan.
+		if pos%kBlockSize == 0 {
+			if _, ok := targetIndex[fp]; !ok {
+				targetIndex[fp] = pos
+			}
+		}
+		if pos+kBlockSize == len(window) {
+			break
+		}
+		e.hash.Roll(window[pos:pos+1], window[pos+kBlockSize:pos+kBlockSize+1])
+		fp = e.hash.Sum64()
+		pos++
+	}
+	flushLiteral(len(window))
+	return ops
+}
+
+// Lookup tables for the default code table.
+var kSingleOpcodes, kPairOpcodes = makeOpcodeTables()
+
+func makeOpcodeTables() (map[[3]byte]byte, map[[6]byte]byte) {
+	singles := map[[3]byte]byte{}
+	pairs := map[[6]byte]byte{}
+	for ii, entry := range kDefaultCodeTable {
+		if entry.inst2 == kNoop {
+			singles[[3]byte{entry.inst1, entry.size1, entry.mode1}] = byte(ii)
+		} else {
+			pairs[[6]byte{entry.inst1, entry.size1, entry.mode1,
+				entry.inst2, entry.size2, entry.mode2}] = byte(ii)
+		}
+	}
+	return singles, pairs
+}
+
+// Encodes instructions into the sections of a window, combining pairs of
+// instructions into one opcode where the code table allows.
+type emitter struct {
+	data, inst, addrs []byte
+	cache             addressCache
+	// The position in the combined source and target address space.
+	here uint64
+
+	// An instruction whose opcode has not been written, since it may
+	// combine with the next.
+	held    [3]byte
+	heldLen int
+	hasHeld bool
+}
+
+func (e *emitter) flushHeld() {
+	if !e.hasHeld {
+		return
+	}
+	e.hasHeld = false
+	if e.held[1] != 0 {
+		if opcode, ok := kSingleOpcodes[e.held]; ok {
+			e.inst = append(e.inst, opcode)
+			return
+		}
+	}
+	explicit := e.held
+	explicit[1] = 0
+	e.inst = append(e.inst, kSingleOpcodes[explicit])
+	e.inst = appendInt(e.inst, uint64(e.heldLen))
+}
+
+func (e *emitter) emit(op vcdiffOp) {
+	var mode byte
+	switch op.inst {
+	case kAdd:
+		e.data = append(e.data, op.data...)
+	case kRun:
+		e.data = append(e.data, op.data[0])
+	case kCopy:
+		e.addrs, mode = e.cache.encode(e.addrs, op.addr, e.here)
+	}
+	e.here += uint64(op.size)
+
+	// Sizes that do not fit in a byte are never implicit.
+	size := byte(0)
+	if op.size <= 255 {
+		size = byte(op.size)
+	}
+	cur := [3]byte{op.inst, size, mode}
+	// Paired instructions always have implicit sizes.
+	if e.hasHeld && e.held[1] != 0 && cur[1] != 0 {
+		key := [6]byte{e.held[0], e.held[1], e.held[2], cur[0], cur[1], cur[2]}
+		if opcode, ok := kPairOpcodes[key]; ok {
+			e.inst = append(e.inst, opcode)
+			e.hasHeld = false
+			return
+		}
+	}
+	e.flushHeld()
+	e.held, e.heldLen, e.hasHeld = cur, op.size, true
+}
+
+// Appends the encoding of one target window to out.
+func (e *encoder) encodeWindow(out, window []byte) []byte {
+	em := &emitter{here: uint64(len(e.source))}
+	for _, op := range e.match(window) {
+		em.emit(op)
+	}
+	em.flushHeld()
+
+	var enc []byte
+	enc = appendInt(enc, uint64(len(window)))
+	// No compressed sections.
+	enc = append(enc, 0)
+	enc = appendInt(enc, uint64(len(em.data)))
+	enc = appendInt(enc, uint64(len(em.inst)))
+	enc = appendInt(enc, uint64(len(em.addrs)))
+	enc = append(enc, em.data...)
+	enc = append(enc, em.inst...)
+	enc = append(enc, em.addrs...)
+
+	if len(e.source) > 0 {
+		out = append(out, kVCDSource)
+		out = appendInt(out, uint64(len(e.source)))
+		out = appendInt(out, 0)
+	} else {
+		out = append(out, 0)
+	}
+	out = appendInt(out, uint64(len(enc)))
+	return append(out, enc...)
+}
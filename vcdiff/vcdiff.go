@@ -0,0 +1,230 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package vcdiff implements the VCDIFF generic differencing and
+// compression data format of RFC 3284.  The encoder finds matches with
+// Rabin fingerprints and uses the default code table, so its output can be
+// decoded by any conforming decoder.  The decoder accepts deltas that use
+// the default code table and no secondary compression.
+package vcdiff
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// Returned (wrapped) when a delta is malformed.
+	ErrInvalid = errors.New("vcdiff: invalid delta")
+	// Returned (wrapped) when a delta uses an unsupported feature, such as
+	// secondary compression or a custom code table.
+	ErrUnsupported = errors.New("vcdiff: unsupported feature")
+)
+
+// The file header: "VCD" with the high bits set, and version 0.
+var kMagic = []byte{0xd6, 0xc3, 0xc4, 0x00}
+
+// Hdr_Indicator bits.
+const (
+	kVCDDecompress = 0x01
+	kVCDCodeTable  = 0x02
+	// An application header; an extension used by some encoders.
+	kVCDAppHeader = 0x04
+)
+
+// Win_Indicator bits.
+const (
+	kVCDSource = 0x01
+	kVCDTarget = 0x02
+	// An Adler-32 checksum of the target window; an extension used by
+	// some encoders.
+	kVCDAdler32 = 0x04
+)
+
+// Instruction types.
+const (
+	kNoop = 0
+	kAdd  = 1
+	kRun  = 2
+	kCopy = 3
+)
+
+// Address cache sizes of the default code table.
+const (
+	kNearSize = 4
+	kSameSize = 3
+)
+
+// Address modes.
+const (
+	kModeSelf = 0
+	kModeHere = 1
+	kModeNear = 2
+	kModeSame = kModeNear + kNearSize
+)
+
+// An entry of a code table: up to two instructions.  A size of 0 means
+// that the size follows the opcode in the instructions section.
+type instruction struct {
+	inst1, size1, mode1 byte
+	inst2, size2, mode2 byte
+}
+
+// The default code table of RFC 3284, section 5.6.
+var kDefaultCodeTable = makeDefaultCodeTable()
+
+func makeDefaultCodeTable() *[256]instruction {
+	var table [256]instruction
+	ii := 0
+	add := func(entry instruction) {
+		table[ii] = entry
+		ii++
+	}
+
+	add(instruction{inst1: kRun})
+	for size := 0; size <= 17; size++ {
+		add(instruction{inst1: kAdd, size1: byte(size)})
+	}
+	for mode := 0; mode < kModeSame+kSameSize; mode++ {
+		add(instruction{inst1: kCopy, mode1: byte(mode)})
+		for size := 4; size <= 18; size++ {
+			add(instruction{inst1: kCopy, size1: byte(size), mode1: byte(mode)})
+		}
+	}
+	for mode := 0; mode < kModeSame+kSameSize; mode++ {
+		maxCopy := 6
+		if mode >= kModeSame {
+			maxCopy = 4
+		}
+		for addSize := 1; addSize <= 4; addSize++ {
+			for copySize := 4; copySize <= maxCopy; copySize++ {
+				add(instruction{
+					inst1: kAdd, size1: byte(addSize),
+					inst2: kCopy, size2: byte(copySize), mode2: byte(mode),
+				})
+			}
+		}
+	}
+	for mode := 0; mode < kModeSame+kSameSize; mode++ {
+		add(instruction{
+			inst1: kCopy, size1: 4, mode1: byte(mode),
+			inst2: kAdd, size2: 1,
+		})
+	}
+	return &table
+}
+
+// Appends v as a VCDIFF integer: base 128, most significant digit first,
+// with the high bit set on all but the last byte.
+func appendInt(b []byte, v uint64) []byte {
+	var digits [10]byte
+	ii := len(digits) - 1
+	digits[ii] = byte(v & 0x7f)
+	for v >>= 7; v != 0; v >>= 7 {
+		ii--
+		digits[ii] = byte(v&0x7f) | 0x80
+	}
+	return append(b, digits[ii:]...)
+}
+
+// Returns the length of v as a VCDIFF integer.
+func intSize(v uint64) int {
+	n := 1
+	for v >>= 7; v != 0; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// Reads a VCDIFF integer from b and returns it with the remainder of b.
+// Values must fit in 63 bits.
+func readInt(b []byte) (uint64, []byte, error) {
+	v := uint64(0)
+	for ii, c := range b {
+		if v > (1<<63-1)>>7 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", ErrInvalid)
+		}
+		v = v<<7 | uint64(c&0x7f)
+		if c&0x80 == 0 {
+			return v, b[ii+1:], nil
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: truncated integer", ErrInvalid)
+}
+
+// The address cache of RFC 3284, section 5.1.
+type addressCache struct {
+	near     [kNearSize]uint64
+	nextSlot int
+	same     [kSameSize * 256]uint64
+}
+
+func (c *addressCache) reset() {
+	*c = addressCache{}
+}
+
+func (c *addressCache) update(addr uint64) {
+	c.near[c.nextSlot] = addr
+	c.nextSlot = (c.nextSlot + 1) % kNearSize
+	c.same[addr%uint64(len(c.same))] = addr
+}
+
+// Returns the mode that encodes addr, at position here, most compactly,
+// and appends the encoded address to b.
+func (c *addressCache) encode(b []byte, addr, here uint64) ([]byte, byte) {
+	if slot := addr % uint64(len(c.same)); c.same[slot] == addr {
+		c.update(addr)
+		return append(b, byte(slot%256)), byte(kModeSame + slot/256)
+	}
+
+	mode, value := byte(kModeSelf), addr
+	if d := here - addr; intSize(d) < intSize(value) {
+		mode, value = kModeHere, d
+	}
+	for ii, near := range c.near {
+		if addr >= near && intSize(addr-near) < intSize(value) {
+			mode, value = byte(kModeNear+ii), addr-near
+		}
+	}
+	c.update(addr)
+	return appendInt(b, value), mode
+}
+
+// Decodes an address in the given mode at position here from b, and
+// returns it with the remainder of b.
+func (c *addressCache) decode(b []byte, mode byte, here uint64) (uint64, []byte, error) {
+	var addr uint64
+	switch {
+	case mode >= kModeSame+kSameSize:
+		return 0, nil, fmt.Errorf("%w: address mode %d", ErrInvalid, mode)
+	case mode >= kModeSame:
+		if len(b) == 0 {
+			return 0, nil, fmt.Errorf("%w: truncated address", ErrInvalid)
+		}
+		addr = c.same[int(mode-kModeSame)*256+int(b[0])]
+		b = b[1:]
+	default:
+		v, rest, err := readInt(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		b = rest
+		switch {
+		case mode == kModeSelf:
+			addr = v
+		case mode == kModeHere:
+			if v > here {
+				return 0, nil, fmt.Errorf("%w: address before start", ErrInvalid)
+			}
+			addr = here - v
+		default:
+			addr = c.near[mode-kModeNear] + v
+		}
+	}
+	if addr >= here {
+		return 0, nil, fmt.Errorf("%w: address %d at %d", ErrInvalid, addr, here)
+	}
+	c.update(addr)
+	return addr, b, nil
+}
@@ -0,0 +1,314 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vcdiff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"math/rand"
+	"testing"
+)
+
+func Test_Integers(t *testing.T) {
+	// The example of RFC 3284, section 2.
+	if b := appendInt(nil, 123456789); !bytes.Equal(b, []byte{0xba, 0xef, 0x9a, 0x15}) {
+		t.Error(fmt.Sprintf("123456789 encodes to % x", b))
+	}
+	for _, v := range []uint64{0, 1, 127, 128, 300, 1<<32 + 5, 1<<63 - 1} {
+		b := appendInt(nil, v)
+		if len(b) != intSize(v) {
+			t.Error(fmt.Sprintf("%d: %d bytes, intSize %d", v, len(b), intSize(v)))
+		}
+		got, rest, err := readInt(append(b, 0xff))
+		if err != nil || got != v || len(rest) != 1 {
+			t.Error(fmt.Sprintf("%d: read %d, %v", v, got, err))
+		}
+	}
+	if _, _, err := readInt([]byte{0x81, 0x82}); !errors.Is(err, ErrInvalid) {
+		t.Error(fmt.Sprintf("truncated integer: %v", err))
+	}
+	overflow := append(bytes.Repeat([]byte{0xff}, 9), 0x7f)
+	if _, _, err := readInt(overflow); !errors.Is(err, ErrInvalid) {
+		t.Error(fmt.Sprintf("overflow: %v", err))
+	}
+}
+
+func Test_DefaultCodeTable(t *testing.T) {
+	// Entries from the table of RFC 3284, section 5.6.
+	tests := []struct {
+		index int
+		entry instruction
+	}{
+		{0, instruction{inst1: kRun}},
+		{1, instruction{inst1: kAdd}},
+		{18, instruction{inst1: kAdd, size1: 17}},
+		{19, instruction{inst1: kCopy}},
+		{20, instruction{inst1: kCopy, size1: 4}},
+		{34, instruction{inst1: kCopy, size1: 18}},
+		{35, instruction{inst1: kCopy, mode1: 1}},
+		{162, instruction{inst1: kCopy, size1: 18, mode1: 8}},
+		{163, instruction{inst1: kAdd, size1: 1, inst2: kCopy, size2: 4}},
+		{174, instruction{inst1: kAdd, size1: 4, inst2: kCopy, size2: 6}},
+		{234, instruction{inst1: kAdd, size1: 4, inst2: kCopy, size2: 6, mode2: 5}},
+		{235, instruction{inst1: kAdd, size1: 1, inst2: kCopy, size2: 4, mode2: 6}},
+		{246, instruction{inst1: kAdd, size1: 4, inst2: kCopy, size2: 4, mode2: 8}},
+		{247, instruction{inst1: kCopy, size1: 4, inst2: kAdd, size2: 1}},
+		{255, instruction{inst1: kCopy, size1: 4, mode1: 8, inst2: kAdd, size2: 1}},
+	}
+	for _, test := range tests {
+		if got := kDefaultCodeTable[test.index]; got != test.entry {
+			t.Error(fmt.Sprintf("entry %d: %+v, expected %+v", test.index, got, test.entry))
+		}
+	}
+}
+
+// Hand-constructed deltas.
+var kVectors = []struct {
+	name   string
+	source []byte
+	delta  []byte
+	target []byte
+}{
+	{
+		// The example of RFC 3284, section 3, with SELF and HERE
+		// addresses and an ADD/COPY pair.
+		name:   "rfc",
+		source: []byte("abcdefghijklmnop"),
+		delta: []byte{
+			0xd6, 0xc3, 0xc4, 0x00, 0x00,
+			// Window: VCD_SOURCE of 16 bytes at 0, 18 bytes of delta.
+			0x01, 0x10, 0x00, 0x12,
+			// 28 target bytes, no compression, section lengths.
+			0x1c, 0x00, 0x05, 0x05, 0x03,
+			// Data: ADD "wxyz", RUN "z".
+			'w', 'x', 'y', 'z', 'z',
+			// Instructions: COPY 4 mode 0; ADD 4 + COPY 4 mode 0;
+			// COPY 12 mode 1; RUN with size 4.
+			0x14, 0xac, 0x2c, 0x00, 0x04,
+			// Addresses: 0 (SELF), 4 (SELF), 28-4=24 (HERE).
+			0x00, 0x04, 0x04,
+		},
+		target: []byte("abcdwxyzefghefghefghefghzzzz"),
+	},
+	{
+		// NEAR and SAME addresses, a multi-byte source size, and a
+		// second window whose source segment is the first window's
+		// target.
+		name:   "cache",
+		source: kBytes300,
+		delta: []byte{
+			0xd6, 0xc3, 0xc4, 0x00, 0x00,
+			// Window: VCD_SOURCE of 300 bytes at 0, 12 bytes of delta.
+			0x01, 0x82, 0x2c, 0x00, 0x0c,
+			0x0c, 0x00, 0x00, 0x03, 0x04,
+			// COPY 4 mode 0, COPY 4 mode 2 (NEAR 0), COPY 4 mode 6
+			// (SAME 0).
+			0x14, 0x34, 0x74,
+			// 200, 200+10, same[200].
+			0x81, 0x48, 0x0a, 0xc8,
+
+			// Window: VCD_TARGET of 12 bytes at 0, 9 bytes of delta.
+			0x02, 0x0c, 0x00, 0x09,
+			0x0d, 0x00, 0x01, 0x02, 0x01,
+			'!',
+			// COPY 12 mode 0, ADD 1.
+			0x1c, 0x02,
+			0x00,
+		},
+		target: bytes.Join([][]byte{
+			kBytes300[200:204], kBytes300[210:214], kBytes300[200:204],
+			kBytes300[200:204], kBytes300[210:214], kBytes300[200:204], []byte("!"),
+		}, nil),
+	},
+	{
+		// An application header, no source, explicit sizes, an
+		// overlapping copy within the target and the Adler-32
+		// extension.
+		name:   "checksum",
+		source: nil,
+		delta: bytes.Join([][]byte{
+			{0xd6, 0xc3, 0xc4, 0x00, 0x04, 0x02, 'h', 'i'},
+			// Window without a source, 18 bytes of delta.
+			{0x04, 0x12},
+			{0x14, 0x00, 0x03, 0x05, 0x01},
+			adler32Bytes([]byte("ababababcccccccccccc")),
+			// Data: ADD "ab", RUN "c".
+			{'a', 'b', 'c'},
+			// ADD with size 2, COPY 6 mode 1, RUN with size 12.
+			{0x01, 0x02, 0x26, 0x00, 0x0c},
+			// 2-0 (HERE).
+			{0x02},
+		}, nil),
+		target: []byte("ababababcccccccccccc"),
+	},
+}
+
+var kBytes300 = func() []byte {
+	b := make([]byte, 300)
+	for ii := range b {
+		b[ii] = byte(ii * 7)
+	}
+	return b
+}()
+
+func adler32Bytes(data []byte) []byte {
+	sum := adler32.Checksum(data)
+	return []byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)}
+}
+
+func Test_DecodeVectors(t *testing.T) {
+	for _, vector := range kVectors {
+		got, err := Decode(vector.source, vector.delta)
+		if err != nil {
+			t.Error(fmt.Sprintf("%s: %v", vector.name, err))
+			continue
+		}
+		if !bytes.Equal(got, vector.target) {
+			t.Error(fmt.Sprintf("%s: decoded %q, expected %q", vector.name, got, vector.target))
+		}
+	}
+}
+
+func Test_DecodeErrors(t *testing.T) {
+	vector := kVectors[0]
+	// Corrupt each header field and section in turn.  The instructions
+	// are skipped, since a different opcode may decode identically (for
+	// example, NEAR modes with an empty cache).
+	for ii := len(kMagic); ii < len(vector.delta); ii++ {
+		if ii >= 19 && ii < 24 {
+			continue
+		}
+		delta := append([]byte{}, vector.delta...)
+		delta[ii] ^= 0x40
+		got, err := Decode(vector.source, delta)
+		if err == nil && bytes.Equal(got, vector.target) {
+			t.Error(fmt.Sprintf("byte %d: corruption not detected", ii))
+		}
+	}
+	for ii := 0; ii < len(vector.delta); ii++ {
+		if _, err := Decode(vector.source, vector.delta[:ii]); err == nil && ii != 5 {
+			t.Error(fmt.Sprintf("truncated to %d bytes: no error", ii))
+		}
+	}
+
+	// A delta without windows has an empty target.
+	if got, err := Decode(nil, vector.delta[:5]); err != nil || len(got) != 0 {
+		t.Error(fmt.Sprintf("empty delta: %q, %v", got, err))
+	}
+
+	unsupported := [][]byte{
+		{0xd6, 0xc3, 0xc4, 0x00, 0x01, 0x01},
+		{0xd6, 0xc3, 0xc4, 0x00, 0x02, 0x00},
+	}
+	for _, delta := range unsupported {
+		if _, err := Decode(nil, delta); !errors.Is(err, ErrUnsupported) {
+			t.Error(fmt.Sprintf("% x: %v", delta, err))
+		}
+	}
+
+	// A wrong checksum.
+	delta := append([]byte{}, kVectors[2].delta...)
+	delta[15] ^= 1
+	if _, err := Decode(nil, delta); !errors.Is(err, ErrInvalid) {
+		t.Error(fmt.Sprintf("bad checksum: %v", err))
+	}
+}
+
+// Applies numEdits random insertions, deletions and overwrites.
+func mutate(r *rand.Rand, data []byte, numEdits int) []byte {
+	out := append([]byte{}, data...)
+	for ii := 0; ii < numEdits && len(out) > 0; ii++ {
+		offset := r.Intn(len(out))
+		edit := make([]byte, 1+r.Intn(100))
+		r.Read(edit)
+		switch r.Intn(3) {
+		case 0:
+			out = append(out[:offset], append(edit, out[offset:]...)...)
+		case 1:
+			end := offset + len(edit)
+			if end > len(out) {
+				end = len(out)
+			}
+			out = append(out[:offset], out[end:]...)
+		default:
+			copy(out[offset:], edit)
+		}
+	}
+	return out
+}
+
+func Test_EncodeRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for ii := 0; ii < 30; ii++ {
+		source := make([]byte, r.Intn(100000))
+		r.Read(source)
+		// Some repetition within the target.
+		if ii%3 == 0 && len(source) > 1000 {
+			copy(source[len(source)/2:], source[:len(source)/2])
+		}
+		target := mutate(r, source, r.Intn(20))
+		if ii%5 == 0 {
+			target = append(target, bytes.Repeat([]byte{'x'}, r.Intn(1000))...)
+		}
+
+		delta := Encode(source, target)
+		got, err := Decode(source, delta)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("case %d: %v", ii, err))
+		}
+		if !bytes.Equal(got, target) {
+			t.Fatal(fmt.Sprintf("case %d: round trip differs", ii))
+		}
+		if len(target) > 10000 && len(delta) > len(target)/4 {
+			t.Error(fmt.Sprintf("case %d: %d byte delta for %d bytes", ii, len(delta), len(target)))
+		}
+	}
+
+	// Edge cases.
+	tests := [][2][]byte{
+		{nil, nil},
+		{[]byte("abc"), nil},
+		{nil, []byte("abc")},
+		{nil, bytes.Repeat([]byte("0123456789abcdef"), 100)},
+		{kBytes300, kBytes300},
+		{kBytes300, bytes.Repeat(kBytes300, 3)},
+	}
+	for ii, test := range tests {
+		got, err := Decode(test[0], Encode(test[0], test[1]))
+		if err != nil || !bytes.Equal(got, test[1]) {
+			t.Error(fmt.Sprintf("edge case %d: %v", ii, err))
+		}
+	}
+}
+
+// Targets larger than one window.
+func Test_EncodeWindows(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	source := make([]byte, 1<<20)
+	r.Read(source)
+	target := bytes.Repeat(source, 5)
+	delta := Encode(source, target)
+	got, err := Decode(source, delta)
+	if err != nil || !bytes.Equal(got, target) {
+		t.Fatal(fmt.Sprintf("round trip: %v", err))
+	}
+	if len(delta) > 1000 {
+		t.Error(fmt.Sprintf("%d byte delta", len(delta)))
+	}
+}
+
+func Benchmark_Encode(b *testing.B) {
+	r := rand.New(rand.NewSource(2))
+	source := make([]byte, 4<<20)
+	r.Read(source)
+	target := mutate(r, source, 100)
+	b.SetBytes(int64(len(target)))
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		Encode(source, target)
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Returned (wrapped) when a server does not answer a range request with
+// the requested range.
+var ErrRangeRequest = errors.New("rabin: range request failed")
+
+const (
+	kControlMagic = "RBZS"
+
+	// The conventional suffix of control files.
+	ControlFileSuffix = ".rsig"
+)
+
+// A zsync-style control file, published next to a file so that clients
+// holding a stale copy can download only the blocks they lack.
+type ControlFile struct {
+	// The URL of the file, which may be relative to the URL of the
+	// control file.
+	URL string
+
+	// The New64 fingerprint of the whole file.
+	Fingerprint uint64
+
+	// The block hashes of the file.  Weak hashes are rolling digests of
+	// the blocks, so that a client can find them at any offset.
+	Signature FileSignature
+}
+
+// Reads r and returns a control file for it with blocks of blockSize
+// bytes.  fileURL is stored as the URL of the file.
+func NewControlFile(r io.Reader, blockSize int, fileURL string) (*ControlFile, error) {
+	hash := New64()
+	sig, err := Signature(io.TeeReader(r, hash), blockSize)
+	if err != nil {
+		return nil, err
+	}
+	return &ControlFile{URL: fileURL, Fingerprint: hash.Sum64(), Signature: *sig}, nil
+}
+
+func (c *ControlFile) MarshalBinary() ([]byte, error) {
+	b := []byte(kControlMagic)
+	b = append(b, kDeltaVersion)
+	b = binary.AppendUvarint(b, uint64(len(c.URL)))
+	b = append(b, c.URL...)
+	b = binary.BigEndian.AppendUint64(b, c.Fingerprint)
+	sig, err := c.Signature.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(b, sig...), nil
+}
+
+func (c *ControlFile) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if err := readDeltaHeader(r, kControlMagic); err != nil {
+		return err
+	}
+	control := ControlFile{}
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return fmt.Errorf("%w: URL", ErrInvalidDelta)
+	}
+	fileURL := make([]byte, n)
+	r.Read(fileURL)
+	control.URL = string(fileURL)
+	if err := binary.Read(r, binary.BigEndian, &control.Fingerprint); err != nil {
+		return fmt.Errorf("%w: fingerprint", ErrInvalidDelta)
+	}
+	if err := control.Signature.UnmarshalBinary(data[len(data)-r.Len():]); err != nil {
+		return err
+	}
+	*c = control
+	return nil
+}
+
+// Fetches and decodes the control file at controlURL.  The URL of the
+// returned control file is resolved against controlURL; if it is empty,
+// controlURL without its ControlFileSuffix is used.  If client is nil,
+// http.DefaultClient is used.
+func FetchControlFile(client *http.Client, controlURL string) (*ControlFile, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	base, err := url.Parse(controlURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(controlURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rabin: fetching %s: %s", controlURL, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	control := &ControlFile{}
+	if err := control.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	if control.URL == "" {
+		control.URL = strings.TrimSuffix(controlURL, ControlFileSuffix)
+	} else {
+		ref, err := url.Parse(control.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%w: URL: %v", ErrInvalidDelta, err)
+		}
+		control.URL = base.ResolveReference(ref).String()
+	}
+	return control, nil
+}
+
+type ZsyncStats struct {
+	// The number of blocks copied from the local file.
+	Reused int
+	// The number of blocks downloaded.
+	Fetched int
+	// The number of range requests and the bytes they returned.
+	Requests     int
+	BytesFetched int64
+}
+
+// Writes the file described by control to w.  Blocks found anywhere in
+// local, a stale copy of localSize bytes, are copied from it, and each
+// run of missing blocks is downloaded from control.URL with one HTTP range
+// request.  Downloaded blocks are checked against the signature and the
+// result against the fingerprint, so a failed download returns
+// ErrPatchMismatch after writing part of the file.  If client is nil,
+// http.DefaultClient is used.
+func ZsyncDownload(client *http.Client, control *ControlFile, local io.ReaderAt, localSize int64, w io.Writer) (ZsyncStats, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var stats ZsyncStats
+	sig := &control.Signature
+	if sig.BlockSize <= 0 {
+		return stats, fmt.Errorf("%w: block size %d", ErrInvalidDelta, sig.BlockSize)
+	}
+
+	have := make(map[StrongHash]int64)
+	if local != nil && localSize > 0 {
+		var err error
+		if have, err = findLocalBlocks(sig, local, localSize); err != nil {
+			return stats, err
+		}
+	}
+	present := func(ii int) bool {
+		_, ok := have[sig.Blocks[ii].Strong]
+		return ok
+	}
+
+	hash := New64()
+	out := io.MultiWriter(w, hash)
+	buff := make([]byte, sig.BlockSize)
+	for ii := 0; ii < len(sig.Blocks); {
+		if present(ii) {
+			data := buff[:sig.blockLength(ii)]
+			// A read that ends at the end of local may also return io.EOF.
+			n, err := local.ReadAt(data, have[sig.Blocks[ii].Strong])
+			if err != nil && !(err == io.EOF && n == len(data)) {
+				return stats, err
+			}
+			if _, err := out.Write(data); err != nil {
+				return stats, err
+			}
+			stats.Reused++
+			ii++
+			continue
+		}
+
+		end := ii + 1
+		for end < len(sig.Blocks) && !present(end) {
+			end++
+		}
+		if err := fetchBlocks(client, control.URL, sig, ii, end, buff, out, &stats); err != nil {
+			return stats, err
+		}
+		ii = end
+	}
+
+	if hash.Sum64() != control.Fingerprint {
+		return stats, fmt.Errorf("%w: file fingerprint", ErrPatchMismatch)
+	}
+	return stats, nil
+}
+
+// Returns the offsets in local, which holds size bytes, of the blocks of
+// sig that it contains.  They are keyed by content, since a file may
+// repeat a block.  Unlike blockMatcher.scan, the window does not skip past
+// matches, so blocks are found even where they overlap others.
+func findLocalBlocks(sig *FileSignature, local io.ReaderAt, size int64) (map[StrongHash]int64, error) {
+	blockSize := sig.BlockSize
+	m := newBlockMatcher(sig)
+	have := make(map[StrongHash]int64)
+	check := func(weak uint64, data []byte, offset int64) {
+		// Skip the strong hash if every block with this weak hash has
+		// been found, as for runs of repeated content.
+		missing := false
+		for _, ii := range m.index[weak] {
+			if _, ok := have[sig.Blocks[ii].Strong]; !ok {
+				missing = true
+				break
+			}
+		}
+		if !missing {
+			return
+		}
+		if block := m.find(weak, data); block >= 0 {
+			have[sig.Blocks[block].Strong] = offset
+		}
+	}
+
+	// The window is buff[start:start+blockSize], and base is the offset
+	// of buff[0] in local.
+	r := io.NewSectionReader(local, 0, size)
+	hash := NewRolling(blockSize)
+	buff := make([]byte, 0, blockSize+kMaxLiteralSize)
+	start := 0
+	base := int64(0)
+	eof := false
+	primed := false
+	for {
+		if len(buff)-start <= blockSize && !eof {
+			buff = buff[:copy(buff, buff[start:])]
+			base += int64(start)
+			start = 0
+			n, err := io.ReadFull(r, buff[len(buff):cap(buff)])
+			buff = buff[:len(buff)+n]
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if len(buff)-start < blockSize {
+			break
+		}
+
+		if !primed {
+			hash.Reset()
+			hash.Write(buff[start : start+blockSize])
+			primed = true
+		}
+		check(hash.Sum64(), buff[start:start+blockSize], base+int64(start))
+		if len(buff)-start == blockSize {
+			break
+		}
+		hash.Roll(buff[start:start+1], buff[start+blockSize:start+blockSize+1])
+		start++
+	}
+
+	// A short final block is only looked for at the end of local.
+	if last := len(sig.Blocks) - 1; last >= 0 {
+		if n := sig.blockLength(last); n < blockSize && n <= len(buff) {
+			tail := buff[len(buff)-n:]
+			tailHash := New()
+			tailHash.Write(tail)
+			check(tailHash.Sum64(), tail, base+int64(len(buff)-n))
+		}
+	}
+	return have, nil
+}
+
+// Downloads blocks [first, end) of the file at fileURL, checks them
+// against sig and writes them to w.  buff holds one block.
+func fetchBlocks(client *http.Client, fileURL string, sig *FileSignature, first, end int, buff []byte, w io.Writer, stats *ZsyncStats) error {
+	start := int64(first) * int64(sig.BlockSize)
+	stop := int64(end) * int64(sig.BlockSize)
+	if stop > sig.Size {
+		stop = sig.Size
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, stop-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	stats.Requests++
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%w: %s: %s", ErrRangeRequest, fileURL, resp.Status)
+	}
+	var gotStart, gotEnd int64
+	contentRange := resp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &gotStart, &gotEnd); err != nil ||
+		gotStart != start || gotEnd != stop-1 {
+		return fmt.Errorf("%w: %s: Content-Range %q for [%d, %d)",
+			ErrRangeRequest, fileURL, contentRange, start, stop)
+	}
+
+	for ii := first; ii < end; ii++ {
+		data := buff[:sig.blockLength(ii)]
+		n, err := io.ReadFull(resp.Body, data)
+		stats.BytesFetched += int64(n)
+		if err != nil {
+			return fmt.Errorf("%w: %s: block %d: %v", ErrRangeRequest, fileURL, ii, err)
+		}
+		if strongHash(data) != sig.Blocks[ii].Strong {
+			return fmt.Errorf("%w: downloaded block %d", ErrPatchMismatch, ii)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		stats.Fetched++
+	}
+	return nil
+}
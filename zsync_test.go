@@ -0,0 +1,205 @@
+// Copyright 2012, Kevin Ko <kevin@faveset.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Serves image and its control file, counting range requests.
+type zsyncServer struct {
+	*httptest.Server
+	image    []byte
+	control  []byte
+	requests int
+	// Whether to ignore Range headers.
+	noRanges bool
+}
+
+func newZsyncServer(t *testing.T, image []byte, blockSize int) *zsyncServer {
+	control, err := NewControlFile(bytes.NewReader(image), blockSize, "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &zsyncServer{image: image}
+	if s.control, err = control.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files/image"+ControlFileSuffix, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(s.control)
+	})
+	mux.HandleFunc("/files/image", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			s.requests++
+		}
+		if s.noRanges {
+			w.Write(s.image)
+			return
+		}
+		http.ServeContent(w, r, "image", time.Time{}, bytes.NewReader(s.image))
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Returns io.EOF with reads that reach the end, as io.ReaderAt allows.
+type eofReaderAt struct {
+	*bytes.Reader
+}
+
+func (r eofReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	if err == nil && off+int64(n) == r.Size() {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *zsyncServer) download(t *testing.T, local []byte) ([]byte, ZsyncStats, error) {
+	control, err := FetchControlFile(s.Client(), s.URL+"/files/image"+ControlFileSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if control.URL != s.URL+"/files/image" {
+		t.Fatal(fmt.Sprintf("resolved URL %s", control.URL))
+	}
+	out := new(bytes.Buffer)
+	stats, err := ZsyncDownload(s.Client(), control, eofReaderAt{bytes.NewReader(local)},
+		int64(len(local)), out)
+	return out.Bytes(), stats, err
+}
+
+func Test_Zsync(t *testing.T) {
+	const blockSize = 2048
+	r := rand.New(rand.NewSource(0))
+	stale := make([]byte, 1<<20+100)
+	r.Read(stale)
+
+	// A few edits, and a shifted copy of a region.
+	image := append([]byte{}, stale[:100000]...)
+	image = append(image, []byte("inserted")...)
+	image = append(image, stale[100000:500000]...)
+	image = append(image, stale[600000:]...)
+	image = append(image, stale[10000:30000]...)
+	copy(image[800000:], "overwritten")
+
+	s := newZsyncServer(t, image, blockSize)
+	defer s.Close()
+
+	got, stats, err := s.download(t, stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, image) {
+		t.Fatal("downloaded image differs")
+	}
+	numBlocks := (len(image) + blockSize - 1) / blockSize
+	if stats.Reused+stats.Fetched != numBlocks {
+		t.Error(fmt.Sprintf("%d reused + %d fetched != %d blocks", stats.Reused, stats.Fetched, numBlocks))
+	}
+	// Each edit costs about one block, plus the short final block.
+	if stats.Fetched > 8 || stats.BytesFetched > 8*blockSize {
+		t.Error(fmt.Sprintf("fetched %d blocks, %d bytes", stats.Fetched, stats.BytesFetched))
+	}
+	if stats.Requests != s.requests || stats.Requests > stats.Fetched {
+		t.Error(fmt.Sprintf("%d requests, server saw %d", stats.Requests, s.requests))
+	}
+
+	// An up-to-date copy needs no requests.
+	s.requests = 0
+	got, stats, err = s.download(t, image)
+	if err != nil || !bytes.Equal(got, image) || stats.Fetched != 0 || s.requests != 0 {
+		t.Error(fmt.Sprintf("up to date: %+v, %v", stats, err))
+	}
+
+	// Without a local copy, everything is fetched in one request.
+	s.requests = 0
+	got, stats, err = s.download(t, nil)
+	if err != nil || !bytes.Equal(got, image) || stats.Fetched != numBlocks || s.requests != 1 {
+		t.Error(fmt.Sprintf("no local copy: %+v, %v", stats, err))
+	}
+}
+
+func Test_ZsyncEdges(t *testing.T) {
+	tests := [][2][]byte{
+		{nil, nil},
+		{[]byte("stale"), nil},
+		{nil, []byte("short")},
+		// Repeated blocks are found once.
+		{bytes.Repeat([]byte("abcd"), 100), bytes.Repeat([]byte("abcd"), 300)},
+	}
+	for ii, test := range tests {
+		s := newZsyncServer(t, test[1], 16)
+		got, _, err := s.download(t, test[0])
+		if err != nil || !bytes.Equal(got, test[1]) {
+			t.Error(fmt.Sprintf("case %d: %v", ii, err))
+		}
+		s.Close()
+	}
+}
+
+func Test_ZsyncErrors(t *testing.T) {
+	image := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(image)
+	s := newZsyncServer(t, image, 1024)
+	defer s.Close()
+
+	// The image changed after the control file was generated.
+	s.image = append([]byte{}, image...)
+	s.image[5000] ^= 1
+	if _, _, err := s.download(t, image[:4000]); !errors.Is(err, ErrPatchMismatch) {
+		t.Error(fmt.Sprintf("changed image: %v", err))
+	}
+
+	// The server ignores ranges.
+	s.image = image
+	s.noRanges = true
+	if _, _, err := s.download(t, image[:4000]); !errors.Is(err, ErrRangeRequest) {
+		t.Error(fmt.Sprintf("no ranges: %v", err))
+	}
+
+	var control ControlFile
+	if err := control.UnmarshalBinary(s.control); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := control.MarshalBinary()
+	var decoded ControlFile
+	if err := decoded.UnmarshalBinary(b); err != nil || !reflect.DeepEqual(decoded, control) {
+		t.Error(fmt.Sprintf("round trip: %v", err))
+	}
+	for ii := 0; ii < len(b); ii += 7 {
+		if err := decoded.UnmarshalBinary(b[:ii]); !errors.Is(err, ErrInvalidDelta) {
+			t.Error(fmt.Sprintf("truncated to %d bytes: %v", ii, err))
+		}
+	}
+
+	// A control file whose signature claims 1<<62 blocks of one byte.
+	b = append([]byte(kControlMagic), kDeltaVersion, 0)
+	b = binary.BigEndian.AppendUint64(b, 0)
+	b = append(b, kSignatureMagic...)
+	b = append(b, kDeltaVersion)
+	b = binary.AppendUvarint(b, 1)
+	b = binary.AppendUvarint(b, 1<<62)
+	if err := decoded.UnmarshalBinary(b); !errors.Is(err, ErrInvalidDelta) {
+		t.Error(fmt.Sprintf("overflowing signature: %v", err))
+	}
+	s.control = b
+	_, err := FetchControlFile(s.Client(), s.URL+"/files/image"+ControlFileSuffix)
+	if !errors.Is(err, ErrInvalidDelta) {
+		t.Error(fmt.Sprintf("fetched overflowing signature: %v", err))
+	}
+}